@@ -0,0 +1,590 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Numpkens/chirpy/internal/auth"
+	"github.com/Numpkens/chirpy/internal/database"
+	"github.com/Numpkens/chirpy/internal/hashtags"
+	"github.com/google/uuid"
+)
+
+type Chirp struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	Body      string     `json:"body"`
+	UserID    uuid.UUID  `json:"user_id"`
+	Edited    bool       `json:"edited"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	InReplyTo *uuid.UUID `json:"in_reply_to"`
+	ThreadID  uuid.UUID  `json:"thread_id"`
+	Kind      string     `json:"kind"`
+	// The rest are filled in by enrichChirps. ReferencedChirp is the chirp a
+	// rechirp or quote points at, or null once that has been deleted.
+	ReferencedChirp *Chirp `json:"referenced_chirp"`
+	ReplyCount      int64  `json:"reply_count"`
+	RechirpCount    int64  `json:"rechirp_count"`
+	QuoteCount      int64  `json:"quote_count"`
+	LikeCount       int64  `json:"like_count"`
+	// Reactions counts each emoji left on the chirp.
+	Reactions map[string]int64 `json:"reactions"`
+	// LikedByMe and MyReactions are only set for an authenticated reader.
+	LikedByMe   *bool    `json:"liked_by_me,omitempty"`
+	MyReactions []string `json:"my_reactions,omitempty"`
+
+	referencedChirpID uuid.NullUUID
+}
+
+// Chirp kinds. A rechirp repeats another chirp as it is; a quote adds a body
+// of its own.
+const (
+	chirpKindPost    = "post"
+	chirpKindRechirp = "rechirp"
+	chirpKindQuote   = "quote"
+)
+
+// ChirpThread is a conversation as a tree. Its top-level chirps are the one
+// that started it and any whose parent has been deleted.
+type ChirpThread struct {
+	ThreadID uuid.UUID      `json:"thread_id"`
+	Chirps   []*ThreadChirp `json:"chirps"`
+}
+
+type ThreadChirp struct {
+	Chirp
+	Replies []*ThreadChirp `json:"replies"`
+}
+
+// ChirpRevision is a body a chirp had before it was edited.
+type ChirpRevision struct {
+	Body       string    `json:"body"`
+	CreatedAt  time.Time `json:"created_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+type chirpPage struct {
+	Chirps     []Chirp `json:"chirps"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+	PrevCursor string  `json:"prev_cursor,omitempty"`
+}
+
+func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+	userID := caller.UserID
+	type parameters struct {
+		Body      string     `json:"body"`
+		InReplyTo *uuid.UUID `json:"in_reply_to"`
+		QuoteOf   *uuid.UUID `json:"quote_of"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	parentID := uuid.NullUUID{}
+	if params.InReplyTo != nil {
+		parent, err := cfg.resolveChirp(r.Context(), *params.InReplyTo)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Chirp being replied to doesn't exist")
+			return
+		}
+		parentID = uuid.NullUUID{UUID: parent.ID, Valid: true}
+	}
+	kind, referencedChirpID := chirpKindPost, uuid.NullUUID{}
+	if params.QuoteOf != nil {
+		quoted, err := cfg.resolveChirp(r.Context(), *params.QuoteOf)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Chirp being quoted doesn't exist")
+			return
+		}
+		if strings.TrimSpace(params.Body) == "" {
+			respondWithError(w, http.StatusBadRequest, "A quote needs a body; use a rechirp instead")
+			return
+		}
+		kind, referencedChirpID = chirpKindQuote, uuid.NullUUID{UUID: quoted.ID, Valid: true}
+	}
+	body := getCleanedBody(params.Body)
+	dbChirp, err := cfg.db.CreateChirp(r.Context(), database.CreateChirpParams{
+		Body:              body,
+		UserID:            userID,
+		Kind:              kind,
+		Hashtags:          hashtags.Extract(body),
+		ParentID:          parentID,
+		ReferencedChirpID: referencedChirpID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error creating chirp")
+		return
+	}
+	cfg.respondWithChirp(w, r, http.StatusCreated, uuid.NullUUID{UUID: userID, Valid: true}, dbChirp)
+}
+
+func (cfg *apiConfig) handlerChirpsGet(w http.ResponseWriter, r *http.Request) {
+	authorIDStr := r.URL.Query().Get("author_id")
+
+	page, err := parsePageQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Clients that send neither limit nor cursor predate paging, and still
+	// get every chirp.
+	page.all = !r.URL.Query().Has("limit") && !r.URL.Query().Has("cursor")
+
+	authorID := uuid.NullUUID{}
+	if authorIDStr != "" {
+		id, err := uuid.Parse(authorIDStr)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid author ID")
+			return
+		}
+		authorID = uuid.NullUUID{UUID: id, Valid: true}
+	}
+
+	cursorCreatedAt, cursorID := page.cursorParams()
+	var dbChirps []database.Chirp
+	if page.ascending() {
+		dbChirps, err = cfg.db.ListChirpsAfter(r.Context(), database.ListChirpsAfterParams{
+			AuthorID:        authorID,
+			CursorCreatedAt: cursorCreatedAt,
+			CursorID:        cursorID,
+			RowLimit:        page.fetchLimit(),
+		})
+	} else {
+		dbChirps, err = cfg.db.ListChirpsBefore(r.Context(), database.ListChirpsBeforeParams{
+			AuthorID:        authorID,
+			CursorCreatedAt: cursorCreatedAt,
+			CursorID:        cursorID,
+			RowLimit:        page.fetchLimit(),
+		})
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching chirps")
+		return
+	}
+
+	dbChirps, next, prev := buildPage(page, dbChirps, func(c database.Chirp) pageCursor {
+		return pageCursor{CreatedAt: c.CreatedAt, ID: c.ID}
+	})
+
+	chirps := []Chirp{}
+	for _, dbChirp := range dbChirps {
+		chirps = append(chirps, chirpFromDB(dbChirp))
+	}
+	if err := cfg.enrichChirps(r.Context(), cfg.viewer(r), chirps); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching chirps")
+		return
+	}
+
+	// The response stays a plain array, as it was before paging; the
+	// neighbouring pages are linked from the headers instead.
+	setPageLinks(w, r, next, prev)
+	respondWithJSON(w, http.StatusOK, chirps)
+}
+
+func (cfg *apiConfig) handlerChirpsGetOne(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	dbChirp, err := cfg.db.GetChirp(r.Context(), id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	cfg.respondWithChirp(w, r, http.StatusOK, cfg.viewer(r), dbChirp)
+}
+
+// handlerChirpsUpdate lets the author change a chirp's body within
+// chirpEditWindow. The body it replaces is kept as a revision.
+func (cfg *apiConfig) handlerChirpsUpdate(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+	id, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	type parameters struct {
+		Body string `json:"body"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	chirp, err := cfg.db.GetChirp(r.Context(), id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if chirp.UserID != caller.UserID {
+		respondWithError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+	if chirp.Kind == chirpKindRechirp {
+		respondWithError(w, http.StatusBadRequest, "Rechirps can't be edited")
+		return
+	}
+	if cfg.chirpEditWindow > 0 && time.Now().UTC().Sub(chirp.CreatedAt) > cfg.chirpEditWindow {
+		respondWithError(w, http.StatusForbidden, "Chirp can no longer be edited")
+		return
+	}
+	body := getCleanedBody(params.Body)
+	if body == chirp.Body {
+		cfg.respondWithChirp(w, r, http.StatusOK, uuid.NullUUID{UUID: caller.UserID, Valid: true}, chirp)
+		return
+	}
+	dbChirp, err := cfg.db.EditChirp(r.Context(), database.EditChirpParams{
+		ID:       id,
+		Body:     body,
+		Hashtags: hashtags.Extract(body),
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Error updating chirp")
+		return
+	}
+	cfg.respondWithChirp(w, r, http.StatusOK, uuid.NullUUID{UUID: caller.UserID, Valid: true}, dbChirp)
+}
+
+// resolveChirp looks a chirp up, following a rechirp to the chirp it
+// repeats: that is the one replies, quotes and rechirps are really aimed at.
+func (cfg *apiConfig) resolveChirp(ctx context.Context, id uuid.UUID) (database.Chirp, error) {
+	chirp, err := cfg.db.GetChirp(ctx, id)
+	if err != nil {
+		return database.Chirp{}, err
+	}
+	if chirp.Kind == chirpKindRechirp && chirp.ReferencedChirpID.Valid {
+		return cfg.db.GetChirp(ctx, chirp.ReferencedChirpID.UUID)
+	}
+	return chirp, nil
+}
+
+// handlerChirpRevisionsList returns a chirp's earlier bodies, oldest first.
+func (cfg *apiConfig) handlerChirpRevisionsList(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	if _, err := cfg.db.GetChirp(r.Context(), id); err != nil {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	dbRevisions, err := cfg.db.ListChirpRevisions(r.Context(), id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching revisions")
+		return
+	}
+	revisions := []ChirpRevision{}
+	for _, revision := range dbRevisions {
+		revisions = append(revisions, ChirpRevision{
+			Body:       revision.Body,
+			CreatedAt:  revision.CreatedAt,
+			ReplacedAt: revision.ReplacedAt,
+		})
+	}
+	respondWithJSON(w, http.StatusOK, revisions)
+}
+
+// handlerChirpThread returns the conversation a chirp belongs to as a tree,
+// replies oldest first. The depth query parameter limits how many levels of
+// replies are included.
+func (cfg *apiConfig) handlerChirpThread(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	depth := maxThreadDepth
+	if depthStr := r.URL.Query().Get("depth"); depthStr != "" {
+		depth, err = strconv.Atoi(depthStr)
+		if err != nil || depth < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid depth")
+			return
+		}
+		depth = min(depth, maxThreadDepth)
+	}
+	dbChirp, err := cfg.db.GetChirp(r.Context(), id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	rows, err := cfg.db.GetChirpThread(r.Context(), database.GetChirpThreadParams{
+		ChirpID:  id,
+		MaxDepth: int32(depth),
+		RowLimit: maxThreadSize,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching thread")
+		return
+	}
+
+	chirps := make([]Chirp, len(rows))
+	for i, row := range rows {
+		chirps[i] = chirpFromDB(database.Chirp{
+			ID:        row.ID,
+			CreatedAt: row.CreatedAt,
+			UpdatedAt: row.UpdatedAt,
+			Body:      row.Body,
+			UserID:    row.UserID,
+			EditedAt:  row.EditedAt,
+			ParentID:  row.ParentID,
+			ThreadID:  row.ThreadID,
+			Kind:      row.Kind,
+
+			ReferencedChirpID: row.ReferencedChirpID,
+		})
+	}
+	if err := cfg.enrichChirps(r.Context(), cfg.viewer(r), chirps); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching thread")
+		return
+	}
+
+	// Rows come parents first, so each reply's parent is already placed.
+	thread := ChirpThread{ThreadID: dbChirp.ThreadID, Chirps: []*ThreadChirp{}}
+	nodes := map[uuid.UUID]*ThreadChirp{}
+	for i, row := range rows {
+		node := &ThreadChirp{Chirp: chirps[i], Replies: []*ThreadChirp{}}
+		nodes[row.ID] = node
+		if parent, ok := nodes[row.ParentID.UUID]; ok && row.Depth > 0 {
+			parent.Replies = append(parent.Replies, node)
+		} else {
+			thread.Chirps = append(thread.Chirps, node)
+		}
+	}
+	respondWithJSON(w, http.StatusOK, thread)
+}
+
+// respondWithChirp answers with a single chirp, enriched for viewer.
+func (cfg *apiConfig) respondWithChirp(w http.ResponseWriter, r *http.Request, code int, viewer uuid.NullUUID, dbChirp database.Chirp) {
+	chirps := []Chirp{chirpFromDB(dbChirp)}
+	if err := cfg.enrichChirps(r.Context(), viewer, chirps); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching chirp")
+		return
+	}
+	respondWithJSON(w, code, chirps[0])
+}
+
+// enrichChirps fills in the fields of chirps that come from other rows, with
+// one query per field for the whole batch. Referenced chirps are embedded
+// and enriched too, though their own references aren't followed. Fields
+// about the reader, like LikedByMe, are only set if viewer is.
+func (cfg *apiConfig) enrichChirps(ctx context.Context, viewer uuid.NullUUID, chirps []Chirp) error {
+	if len(chirps) == 0 {
+		return nil
+	}
+	all := make([]*Chirp, len(chirps))
+	referencedIDs := []uuid.UUID{}
+	for i := range chirps {
+		all[i] = &chirps[i]
+		if id := chirps[i].referencedChirpID; id.Valid {
+			referencedIDs = append(referencedIDs, id.UUID)
+		}
+	}
+	referenced := map[uuid.UUID]*Chirp{}
+	if len(referencedIDs) > 0 {
+		dbChirps, err := cfg.db.GetChirpsByIDs(ctx, referencedIDs)
+		if err != nil {
+			return err
+		}
+		for _, dbChirp := range dbChirps {
+			chirp := chirpFromDB(dbChirp)
+			referenced[chirp.ID] = &chirp
+			all = append(all, &chirp)
+		}
+	}
+	if err := cfg.countChirpActivity(ctx, all); err != nil {
+		return err
+	}
+	if viewer.Valid {
+		if err := cfg.markViewerActivity(ctx, viewer.UUID, all); err != nil {
+			return err
+		}
+	}
+	for i := range chirps {
+		if id := chirps[i].referencedChirpID; id.Valid {
+			chirps[i].ReferencedChirp = referenced[id.UUID]
+		}
+	}
+	return nil
+}
+
+// countChirpActivity fills in the reply, rechirp, quote, like and reaction
+// counts.
+func (cfg *apiConfig) countChirpActivity(ctx context.Context, chirps []*Chirp) error {
+	ids := make([]uuid.UUID, len(chirps))
+	for i, chirp := range chirps {
+		ids[i] = chirp.ID
+	}
+
+	replyCounts, err := cfg.db.CountChirpReplies(ctx, ids)
+	if err != nil {
+		return err
+	}
+	replies := map[uuid.UUID]int64{}
+	for _, row := range replyCounts {
+		replies[row.ParentID.UUID] = row.ReplyCount
+	}
+	referenceCounts, err := cfg.db.CountChirpReferences(ctx, ids)
+	if err != nil {
+		return err
+	}
+	rechirps, quotes := map[uuid.UUID]int64{}, map[uuid.UUID]int64{}
+	for _, row := range referenceCounts {
+		switch row.Kind {
+		case chirpKindRechirp:
+			rechirps[row.ReferencedChirpID.UUID] = row.ReferenceCount
+		case chirpKindQuote:
+			quotes[row.ReferencedChirpID.UUID] = row.ReferenceCount
+		}
+	}
+
+	likeCounts, err := cfg.db.CountChirpLikes(ctx, ids)
+	if err != nil {
+		return err
+	}
+	likes := map[uuid.UUID]int64{}
+	for _, row := range likeCounts {
+		likes[row.ChirpID] = row.LikeCount
+	}
+
+	reactionCounts, err := cfg.db.CountChirpReactions(ctx, ids)
+	if err != nil {
+		return err
+	}
+	reactions := map[uuid.UUID]map[string]int64{}
+	for _, row := range reactionCounts {
+		if reactions[row.ChirpID] == nil {
+			reactions[row.ChirpID] = map[string]int64{}
+		}
+		reactions[row.ChirpID][row.Emoji] = row.ReactionCount
+	}
+
+	for _, chirp := range chirps {
+		chirp.ReplyCount = replies[chirp.ID]
+		chirp.RechirpCount = rechirps[chirp.ID]
+		chirp.QuoteCount = quotes[chirp.ID]
+		chirp.LikeCount = likes[chirp.ID]
+		chirp.Reactions = reactions[chirp.ID]
+		if chirp.Reactions == nil {
+			chirp.Reactions = map[string]int64{}
+		}
+	}
+	return nil
+}
+
+// markViewerActivity fills in whether userID liked each chirp and what they
+// reacted to it with.
+func (cfg *apiConfig) markViewerActivity(ctx context.Context, userID uuid.UUID, chirps []*Chirp) error {
+	ids := make([]uuid.UUID, len(chirps))
+	for i, chirp := range chirps {
+		ids[i] = chirp.ID
+	}
+	likedIDs, err := cfg.db.ListLikedChirpIDs(ctx, database.ListLikedChirpIDsParams{
+		UserID:   userID,
+		ChirpIds: ids,
+	})
+	if err != nil {
+		return err
+	}
+	userReactions, err := cfg.db.ListUserChirpReactions(ctx, database.ListUserChirpReactionsParams{
+		UserID:   userID,
+		ChirpIds: ids,
+	})
+	if err != nil {
+		return err
+	}
+	reacted := map[uuid.UUID][]string{}
+	for _, row := range userReactions {
+		reacted[row.ChirpID] = append(reacted[row.ChirpID], row.Emoji)
+	}
+
+	for _, chirp := range chirps {
+		liked := slices.Contains(likedIDs, chirp.ID)
+		chirp.LikedByMe = &liked
+		chirp.MyReactions = reacted[chirp.ID]
+	}
+	return nil
+}
+
+// viewer returns who is reading, for fields like LikedByMe, if the request
+// is authenticated to read chirps. Reading doesn't need a token, so a bad
+// one just makes for an anonymous reader.
+func (cfg *apiConfig) viewer(r *http.Request) uuid.NullUUID {
+	if r.Header.Get("Authorization") == "" {
+		return uuid.NullUUID{}
+	}
+	caller, err := cfg.authenticate(r)
+	if err != nil || !caller.hasScope(auth.ScopeChirpsRead) {
+		return uuid.NullUUID{}
+	}
+	return uuid.NullUUID{UUID: caller.UserID, Valid: true}
+}
+
+func chirpFromDB(c database.Chirp) Chirp {
+	return Chirp{
+		ID:        c.ID,
+		CreatedAt: c.CreatedAt,
+		UpdatedAt: c.UpdatedAt,
+		Body:      c.Body,
+		UserID:    c.UserID,
+		Edited:    c.EditedAt.Valid,
+		EditedAt:  nullTimePtr(c.EditedAt),
+		InReplyTo: nullUUIDPtr(c.ParentID),
+		ThreadID:  c.ThreadID,
+		Kind:      c.Kind,
+
+		referencedChirpID: c.ReferencedChirpID,
+	}
+}
+
+func (cfg *apiConfig) handlerChirpsDelete(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+	userID := caller.UserID
+	id, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	chirp, err := cfg.db.GetChirp(r.Context(), id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if chirp.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+	err = cfg.db.DeleteChirp(r.Context(), database.DeleteChirpParams{ID: id, UserID: userID})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete chirp")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getCleanedBody(body string) string {
+	badWords := map[string]struct{}{"kerfuffle": {}, "sharbert": {}, "fornax": {}}
+	words := strings.Split(body, " ")
+	for i, word := range words {
+		if _, ok := badWords[strings.ToLower(word)]; ok {
+			words[i] = "****"
+		}
+	}
+	return strings.Join(words, " ")
+}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"net/http"
@@ -13,53 +14,174 @@ import (
 	"github.com/google/uuid"
 )
 
-func HashPassword(password string) (string, error) {
-	return argon2id.CreateHash(password, argon2id.DefaultParams)
+// PasswordParams are the argon2id cost settings used for new hashes.
+// Memory is in KiB.
+type PasswordParams struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+func DefaultPasswordParams() PasswordParams {
+	return PasswordParams{
+		Memory:      argon2id.DefaultParams.Memory,
+		Iterations:  argon2id.DefaultParams.Iterations,
+		Parallelism: argon2id.DefaultParams.Parallelism,
+	}
+}
+
+func HashPassword(password string, params PasswordParams) (string, error) {
+	return argon2id.CreateHash(password, &argon2id.Params{
+		Memory:      params.Memory,
+		Iterations:  params.Iterations,
+		Parallelism: params.Parallelism,
+		SaltLength:  argon2id.DefaultParams.SaltLength,
+		KeyLength:   argon2id.DefaultParams.KeyLength,
+	})
+}
+
+// NeedsRehash reports whether hash was made with a lower cost than params in
+// any dimension. Hashes are never downgraded.
+func NeedsRehash(hash string, params PasswordParams) (bool, error) {
+	stored, _, _, err := argon2id.DecodeHash(hash)
+	if err != nil {
+		return false, err
+	}
+	return stored.Memory < params.Memory ||
+		stored.Iterations < params.Iterations ||
+		stored.Parallelism < params.Parallelism, nil
 }
 
 func CheckPasswordHash(password, hash string) (bool, error) {
 	return argon2id.ComparePasswordAndHash(password, hash)
 }
 
-func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
-	signingKey := []byte(tokenSecret)
+// Claims are the claims carried by an access token. UserID is parsed from
+// the subject when a token is validated.
+type Claims struct {
+	jwt.RegisteredClaims
+	Role string `json:"role,omitempty"`
+	// ClientID and Scope are set on tokens issued to OAuth clients, which
+	// may only do what the scopes allow.
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	// Actor is set when someone else, such as an admin impersonating the
+	// user, is acting as the subject. ActorID is parsed from it.
+	Actor   *Actor        `json:"act,omitempty"`
+	UserID  uuid.UUID     `json:"-"`
+	ActorID uuid.NullUUID `json:"-"`
+}
+
+// Actor is the RFC 8693 act claim.
+type Actor struct {
+	Subject string `json:"sub"`
+}
+
+// TokenOption sets an optional claim on a token made by MakeJWT.
+type TokenOption func(*Claims)
 
-	claims := jwt.RegisteredClaims{
-		Issuer:    "chirpy",
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
-		Subject:   userID.String(),
+func WithRole(role string) TokenOption {
+	return func(c *Claims) {
+		c.Role = role
 	}
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(signingKey)
+func WithClientID(clientID string) TokenOption {
+	return func(c *Claims) {
+		c.ClientID = clientID
+	}
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	claimsStruct := jwt.RegisteredClaims{}
+func WithScopes(scopes []string) TokenOption {
+	return func(c *Claims) {
+		c.Scope = FormatScope(scopes)
+	}
+}
 
-	token, err := jwt.ParseWithClaims(
-		tokenString,
-		&claimsStruct,
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(tokenSecret), nil
+func WithActor(actorID uuid.UUID) TokenOption {
+	return func(c *Claims) {
+		c.Actor = &Actor{Subject: actorID.String()}
+	}
+}
+
+// WithIssuedAfter dates the token after cutoff, for a token issued straight
+// after its user's tokens were cut off, which would otherwise share the
+// cutoff's second and be rejected with them.
+func WithIssuedAfter(cutoff time.Time) TokenOption {
+	return func(c *Claims) {
+		if c.IssuedBefore(cutoff) {
+			c.IssuedAt = jwt.NewNumericDate(cutoff.Truncate(time.Second).Add(time.Second))
+		}
+	}
+}
+
+// IssuedBefore reports whether the token may have been issued before cutoff.
+// Issue times are whole seconds, so a token from the same second as cutoff
+// counts, as does one with no issue time.
+func (c *Claims) IssuedBefore(cutoff time.Time) bool {
+	return c.IssuedAt == nil || !c.IssuedAt.After(cutoff.Truncate(time.Second))
+}
+
+// MakeJWT issues an access token. Every token gets a unique jti so it can be
+// revoked on its own.
+func MakeJWT(userID uuid.UUID, keys *KeySet, expiresIn time.Duration, opts ...TokenOption) (string, error) {
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Issuer:    "chirpy",
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+			Subject:   userID.String(),
 		},
+	}
+	for _, opt := range opts {
+		opt(&claims)
+	}
+
+	return keys.sign(claims)
+}
+
+// ValidateJWT checks an access token's signature and expiry, and that
+// denylist hasn't revoked it. denylist may be nil where revocation doesn't
+// apply.
+func ValidateJWT(tokenString string, keys *KeySet, denylist *Denylist) (*Claims, error) {
+	claims := &Claims{}
+
+	_, err := jwt.ParseWithClaims(
+		tokenString,
+		claims,
+		keys.keyFunc,
+		jwt.WithExpirationRequired(),
 	)
 	if err != nil {
-		return uuid.Nil, err
+		return nil, err
+	}
+	// Access tokens have no audience; anything with one, such as an MFA
+	// challenge, is meant for somewhere else.
+	if len(claims.Audience) > 0 {
+		return nil, fmt.Errorf("unexpected token audience")
 	}
 
-	userIDString, err := token.Claims.GetSubject()
+	userID, err := uuid.Parse(claims.Subject)
 	if err != nil {
-		return uuid.Nil, err
+		return nil, err
+	}
+	claims.UserID = userID
+	if claims.Actor != nil {
+		actorID, err := uuid.Parse(claims.Actor.Subject)
+		if err != nil {
+			return nil, err
+		}
+		claims.ActorID = uuid.NullUUID{UUID: actorID, Valid: true}
 	}
 
-	userID, err := uuid.Parse(userIDString)
-	if err != nil {
-		return uuid.Nil, err
+	if denylist != nil {
+		if err := denylist.check(claims); err != nil {
+			return nil, err
+		}
 	}
 
-	return userID, nil
+	return claims, nil
 }
 
 func GetBearerToken(headers http.Header) (string, error) {
@@ -77,6 +199,12 @@ func GetBearerToken(headers http.Header) (string, error) {
 }
 
 func MakeRefreshToken() (string, error) {
+	return MakeOpaqueToken()
+}
+
+// MakeOpaqueToken returns 32 random bytes, hex encoded, for tokens that are
+// looked up in the database rather than verified by signature.
+func MakeOpaqueToken() (string, error) {
 	bytes := make([]byte, 32)
 	_, err := rand.Read(bytes)
 	if err != nil {
@@ -85,6 +213,13 @@ func MakeRefreshToken() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
+// HashToken returns the hex SHA-256 digest of an opaque token. Tokens are
+// stored by digest only, so a database dump can't be replayed as sessions.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func GetAPIKey(headers http.Header) (string, error) {
 	authHeader := headers.Get("Authorization")
 	if authHeader == "" {
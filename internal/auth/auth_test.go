@@ -21,7 +21,7 @@ func TestGetAPIKey(t *testing.T) {
 			expectedError: false,
 		},
 		{
-			name: "Missing Authorization header",
+			name:          "Missing Authorization header",
 			headers:       http.Header{},
 			expectedKey:   "",
 			expectedError: true,
@@ -56,4 +56,51 @@ func TestGetAPIKey(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestHashToken(t *testing.T) {
+	got := HashToken("abc")
+	expected := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	if got != expected {
+		t.Errorf("HashToken() = %v, expected %v", got, expected)
+	}
+	if HashToken("abd") == got {
+		t.Errorf("HashToken() returned the same digest for different tokens")
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	weak := PasswordParams{Memory: 8 * 1024, Iterations: 1, Parallelism: 1}
+	hash, err := HashPassword("correct horse battery staple", weak)
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		params         PasswordParams
+		expectedRehash bool
+	}{
+		{name: "Same params", params: weak, expectedRehash: false},
+		{name: "More memory", params: PasswordParams{Memory: 16 * 1024, Iterations: 1, Parallelism: 1}, expectedRehash: true},
+		{name: "More iterations", params: PasswordParams{Memory: 8 * 1024, Iterations: 2, Parallelism: 1}, expectedRehash: true},
+		{name: "More parallelism", params: PasswordParams{Memory: 8 * 1024, Iterations: 1, Parallelism: 2}, expectedRehash: true},
+		{name: "Lower params", params: PasswordParams{Memory: 4 * 1024, Iterations: 1, Parallelism: 1}, expectedRehash: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rehash, err := NeedsRehash(hash, tt.params)
+			if err != nil {
+				t.Fatalf("NeedsRehash() error = %v", err)
+			}
+			if rehash != tt.expectedRehash {
+				t.Errorf("NeedsRehash() = %v, expected %v", rehash, tt.expectedRehash)
+			}
+		})
+	}
+
+	if _, err := NeedsRehash("unset", weak); err == nil {
+		t.Errorf("NeedsRehash() accepted a malformed hash")
+	}
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Denylist rejects access tokens before they expire: single tokens by jti,
+// and every token issued to a user before a cutoff, as set when they change
+// their password. It only caches what the caller stores elsewhere; call Load
+// periodically to pick up revocations made by other instances.
+type Denylist struct {
+	mu sync.RWMutex
+	// maxTokenAge is how long access tokens live. Cutoffs older than that
+	// can't reject anything and are pruned.
+	maxTokenAge time.Duration
+	tokens      map[string]time.Time
+	cutoffs     map[uuid.UUID]time.Time
+}
+
+func NewDenylist(maxTokenAge time.Duration) *Denylist {
+	return &Denylist{
+		maxTokenAge: maxTokenAge,
+		tokens:      map[string]time.Time{},
+		cutoffs:     map[uuid.UUID]time.Time{},
+	}
+}
+
+// Revoke denies the token with the given ID until it expires.
+func (d *Denylist) Revoke(jti string, expiresAt time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tokens[jti] = expiresAt
+}
+
+// RevokeIssuedBefore denies every token issued to userID before cutoff, and,
+// since issue times are whole seconds, in the same second as it.
+func (d *Denylist) RevokeIssuedBefore(userID uuid.UUID, cutoff time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if cutoff.After(d.cutoffs[userID]) {
+		d.cutoffs[userID] = cutoff
+	}
+}
+
+// Load adds revocations read from storage, keyed by token ID with their
+// expiry and by user ID with their cutoff, and drops entries that can no
+// longer match a live token.
+func (d *Denylist) Load(tokens map[string]time.Time, cutoffs map[uuid.UUID]time.Time, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for jti, expiresAt := range tokens {
+		d.tokens[jti] = expiresAt
+	}
+	for userID, cutoff := range cutoffs {
+		if cutoff.After(d.cutoffs[userID]) {
+			d.cutoffs[userID] = cutoff
+		}
+	}
+	for jti, expiresAt := range d.tokens {
+		if expiresAt.Before(now) {
+			delete(d.tokens, jti)
+		}
+	}
+	for userID, cutoff := range d.cutoffs {
+		if cutoff.Add(d.maxTokenAge).Before(now) {
+			delete(d.cutoffs, userID)
+		}
+	}
+}
+
+func (d *Denylist) check(claims *Claims) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.tokens[claims.ID]; ok && claims.ID != "" {
+		return fmt.Errorf("token has been revoked")
+	}
+	cutoff, ok := d.cutoffs[claims.UserID]
+	if ok && claims.IssuedBefore(cutoff) {
+		return fmt.Errorf("token has been revoked")
+	}
+	return nil
+}
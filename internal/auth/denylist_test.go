@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDenylist(t *testing.T) {
+	keys := NewHMACKeySet("secret")
+	denylist := NewDenylist(time.Hour)
+	userID := uuid.New()
+	otherUserID := uuid.New()
+
+	revoked, _ := MakeJWT(userID, keys, time.Hour)
+	claims, err := ValidateJWT(revoked, keys, denylist)
+	if err != nil {
+		t.Fatalf("ValidateJWT() error = %v", err)
+	}
+	if claims.ID == "" {
+		t.Fatalf("MakeJWT() issued a token without a jti")
+	}
+	denylist.Revoke(claims.ID, claims.ExpiresAt.Time)
+	if _, err := ValidateJWT(revoked, keys, denylist); err == nil {
+		t.Errorf("ValidateJWT() accepted a revoked token")
+	}
+
+	other, _ := MakeJWT(otherUserID, keys, time.Hour)
+	if _, err := ValidateJWT(other, keys, denylist); err != nil {
+		t.Errorf("ValidateJWT() rejected another token: %v", err)
+	}
+
+	denylist.RevokeIssuedBefore(otherUserID, time.Now().UTC().Add(time.Second))
+	if _, err := ValidateJWT(other, keys, denylist); err == nil {
+		t.Errorf("ValidateJWT() accepted a token issued before the cutoff")
+	}
+}
+
+func TestDenylistCutoffSecond(t *testing.T) {
+	keys := NewHMACKeySet("secret")
+	userID := uuid.New()
+
+	// Issue times are whole seconds, so a token from the cutoff's second
+	// may be older than the cutoff, and is rejected.
+	tests := []struct {
+		name          string
+		dateAfter     bool
+		expectedValid bool
+	}{
+		{name: "Issued just before the cutoff", expectedValid: false},
+		{name: "Dated after the cutoff", dateAfter: true, expectedValid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			denylist := NewDenylist(time.Hour)
+			token, _ := MakeJWT(userID, keys, time.Hour)
+			cutoff := time.Now().UTC()
+			if tt.dateAfter {
+				token, _ = MakeJWT(userID, keys, time.Hour, WithIssuedAfter(cutoff))
+			}
+			denylist.RevokeIssuedBefore(userID, cutoff)
+			if _, err := ValidateJWT(token, keys, denylist); (err == nil) != tt.expectedValid {
+				t.Errorf("ValidateJWT() error = %v, expected valid %v", err, tt.expectedValid)
+			}
+		})
+	}
+}
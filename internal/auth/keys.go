@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is one key in a KeySet. A key without a private half can only
+// validate tokens; that is how retired keys are kept around during rotation.
+// HS256 keys use the shared secret for both halves and are never published.
+type SigningKey struct {
+	ID         string
+	Method     jwt.SigningMethod
+	PrivateKey crypto.PrivateKey
+	PublicKey  crypto.PublicKey
+}
+
+// KeySet holds every key that may validate a token, picked by the token's kid
+// header, and the one key currently used to sign new tokens.
+type KeySet struct {
+	current *SigningKey
+	keys    map[string]*SigningKey
+}
+
+func NewKeySet() *KeySet {
+	return &KeySet{keys: map[string]*SigningKey{}}
+}
+
+// NewHMACKeySet returns a key set that signs and validates HS256 tokens with
+// a single shared secret. Its key has no ID, so tokens carry no kid header.
+func NewHMACKeySet(secret string) *KeySet {
+	ks := NewKeySet()
+	ks.Add(NewHMACKey(secret))
+	ks.SetCurrent("")
+	return ks
+}
+
+func NewHMACKey(secret string) *SigningKey {
+	return &SigningKey{
+		Method:     jwt.SigningMethodHS256,
+		PrivateKey: []byte(secret),
+		PublicKey:  []byte(secret),
+	}
+}
+
+func (ks *KeySet) Add(key *SigningKey) error {
+	if _, ok := ks.keys[key.ID]; ok {
+		return fmt.Errorf("duplicate key id %q", key.ID)
+	}
+	ks.keys[key.ID] = key
+	return nil
+}
+
+func (ks *KeySet) SetCurrent(kid string) error {
+	key, ok := ks.keys[kid]
+	if !ok {
+		return fmt.Errorf("unknown key id %q", kid)
+	}
+	if key.PrivateKey == nil {
+		return fmt.Errorf("key %q has no private key", kid)
+	}
+	ks.current = key
+	return nil
+}
+
+// Current returns the key new tokens are signed with.
+func (ks *KeySet) Current() *SigningKey {
+	return ks.current
+}
+
+// Asymmetric reports whether the key can be checked by others without being
+// able to sign with it, which is to say it isn't an HS256 secret.
+func (k *SigningKey) Asymmetric() bool {
+	_, secret := k.PublicKey.([]byte)
+	return !secret
+}
+
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	if ks.current == nil {
+		return "", fmt.Errorf("no signing key configured")
+	}
+	token := jwt.NewWithClaims(ks.current.Method, claims)
+	if ks.current.ID != "" {
+		token.Header["kid"] = ks.current.ID
+	}
+	return token.SignedString(ks.current.PrivateKey)
+}
+
+// keyFunc finds the validation key named by the token's kid header. The
+// token's alg must match the key's, so an RSA public key can never be used
+// as an HMAC secret.
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %q", token.Method.Alg())
+	}
+	return key.PublicKey, nil
+}
+
+// JWK is the public half of a signing key in RFC 7517 form.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys other services need to validate our tokens.
+// Retired keys stay listed for as long as they are in the set.
+func (ks *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range ks.keys {
+		jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+		switch pub := key.PublicKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool {
+		return jwks.Keys[i].Kid < jwks.Keys[j].Kid
+	})
+	return jwks
+}
+
+// LoadKeySet reads every <kid>.pem file in dir. PRIVATE KEY blocks (PKCS #8,
+// RSA or Ed25519) can sign and validate; PUBLIC KEY blocks only validate.
+//
+// To rotate, generate a new key into dir, point currentKID at it and restart.
+// Leave the old file in place until every token it signed has expired: it
+// keeps validating and stays in the JWKS until it is removed.
+func LoadKeySet(dir, currentKID string) (*KeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	ks := NewKeySet()
+	for _, path := range paths {
+		dat, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		key, err := ParseSigningKey(kid, dat)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := ks.Add(key); err != nil {
+			return nil, err
+		}
+	}
+	if err := ks.SetCurrent(currentKID); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func ParseSigningKey(kid string, dat []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(dat)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	key := &SigningKey{ID: kid}
+	switch block.Type {
+	case "PRIVATE KEY":
+		priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key.PrivateKey = priv
+		key.PublicKey = priv.(crypto.Signer).Public()
+	case "PUBLIC KEY":
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key.PublicKey = pub
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+
+	switch pub := key.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA keys must be at least 2048 bits")
+		}
+		key.Method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+	return key, nil
+}
+
+// GenerateSigningKey creates a new RS256 or EdDSA key and returns its kid
+// together with the PKCS #8 PEM encoding LoadKeySet expects.
+func GenerateSigningKey(alg string) (string, []byte, error) {
+	var priv crypto.PrivateKey
+	var err error
+	switch alg {
+	case "RS256":
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "EdDSA":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return "", nil, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", nil, err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", nil, err
+	}
+	kid := time.Now().UTC().Format("20060102") + "-" + hex.EncodeToString(suffix)
+
+	return kid, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
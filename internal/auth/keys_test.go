@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestKeySetRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		alg  string
+	}{
+		{name: "RS256", alg: "RS256"},
+		{name: "EdDSA", alg: "EdDSA"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kid, dat, err := GenerateSigningKey(tt.alg)
+			if err != nil {
+				t.Fatalf("GenerateSigningKey() error = %v", err)
+			}
+			key, err := ParseSigningKey(kid, dat)
+			if err != nil {
+				t.Fatalf("ParseSigningKey() error = %v", err)
+			}
+			keys := NewKeySet()
+			keys.Add(key)
+			if err := keys.SetCurrent(kid); err != nil {
+				t.Fatalf("SetCurrent() error = %v", err)
+			}
+
+			userID := uuid.New()
+			token, err := MakeJWT(userID, keys, time.Hour)
+			if err != nil {
+				t.Fatalf("MakeJWT() error = %v", err)
+			}
+			got, err := ValidateJWT(token, keys, nil)
+			if err != nil {
+				t.Fatalf("ValidateJWT() error = %v", err)
+			}
+			if got.UserID != userID {
+				t.Errorf("ValidateJWT() = %v, expected %v", got.UserID, userID)
+			}
+
+			jwks := keys.JWKS()
+			if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != kid || jwks.Keys[0].Alg != tt.alg {
+				t.Errorf("JWKS() = %+v, expected one %v key %v", jwks, tt.alg, kid)
+			}
+		})
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldKID, oldPEM, err := GenerateSigningKey("EdDSA")
+	if err != nil {
+		t.Fatalf("GenerateSigningKey() error = %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, oldKID+".pem"), oldPEM, 0o600)
+
+	oldKeys, err := LoadKeySet(dir, oldKID)
+	if err != nil {
+		t.Fatalf("LoadKeySet() error = %v", err)
+	}
+	userID := uuid.New()
+	oldToken, _ := MakeJWT(userID, oldKeys, time.Hour)
+
+	newKID, newPEM, err := GenerateSigningKey("EdDSA")
+	if err != nil {
+		t.Fatalf("GenerateSigningKey() error = %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, newKID+".pem"), newPEM, 0o600)
+
+	newKeys, err := LoadKeySet(dir, newKID)
+	if err != nil {
+		t.Fatalf("LoadKeySet() error = %v", err)
+	}
+	if _, err := ValidateJWT(oldToken, newKeys, nil); err != nil {
+		t.Errorf("ValidateJWT() with retired key error = %v", err)
+	}
+	if len(newKeys.JWKS().Keys) != 2 {
+		t.Errorf("JWKS() has %d keys, expected 2", len(newKeys.JWKS().Keys))
+	}
+
+	newToken, _ := MakeJWT(userID, newKeys, time.Hour)
+	if _, err := ValidateJWT(newToken, oldKeys, nil); err == nil {
+		t.Errorf("ValidateJWT() accepted a token signed with an unknown key")
+	}
+}
+
+func TestValidateJWTRejectsAlgorithmMismatch(t *testing.T) {
+	kid, dat, _ := GenerateSigningKey("EdDSA")
+	key, _ := ParseSigningKey(kid, dat)
+	keys := NewKeySet()
+	keys.Add(key)
+	keys.SetCurrent(kid)
+
+	// An HS256 token that claims the EdDSA key's kid must not validate.
+	forged := NewKeySet()
+	hmacKey := NewHMACKey("secret")
+	hmacKey.ID = kid
+	forged.Add(hmacKey)
+	forged.SetCurrent(kid)
+	token, _ := MakeJWT(uuid.New(), forged, time.Hour)
+
+	if _, err := ValidateJWT(token, keys, nil); err == nil {
+		t.Errorf("ValidateJWT() accepted a token with the wrong algorithm")
+	}
+}
+
+func TestHMACKeySet(t *testing.T) {
+	keys := NewHMACKeySet("secret")
+	userID := uuid.New()
+	token, err := MakeJWT(userID, keys, time.Hour)
+	if err != nil {
+		t.Fatalf("MakeJWT() error = %v", err)
+	}
+	if _, err := ValidateJWT(token, NewHMACKeySet("other"), nil); err == nil {
+		t.Errorf("ValidateJWT() accepted a token signed with another secret")
+	}
+	if len(keys.JWKS().Keys) != 0 {
+		t.Errorf("JWKS() published an HMAC key")
+	}
+}
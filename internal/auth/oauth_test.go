@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestVerifyPKCE(t *testing.T) {
+	verifier, err := MakePKCEVerifier()
+	if err != nil {
+		t.Fatalf("MakePKCEVerifier() error = %v", err)
+	}
+	challenge := PKCEChallenge(verifier)
+
+	tests := []struct {
+		name      string
+		verifier  string
+		challenge string
+		expected  bool
+	}{
+		{"Matching verifier", verifier, challenge, true},
+		{"Other verifier", strings.Repeat("a", 43), challenge, false},
+		{"Verifier as plain challenge", verifier, verifier, false},
+		{"Too short", "abc", PKCEChallenge("abc"), false},
+		{"Reserved characters", strings.Repeat("a/", 22), PKCEChallenge(strings.Repeat("a/", 22)), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyPKCE(tt.verifier, tt.challenge); got != tt.expected {
+				t.Errorf("VerifyPKCE() = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPKCEChallengeRFCExample(t *testing.T) {
+	// From RFC 7636, appendix B.
+	got := PKCEChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	expected := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	if got != expected {
+		t.Errorf("PKCEChallenge() = %v, expected %v", got, expected)
+	}
+}
+
+func TestValidateRedirectURI(t *testing.T) {
+	tests := []struct {
+		name    string
+		uri     string
+		wantErr bool
+	}{
+		{"HTTPS", "https://app.example.com/callback", false},
+		{"Loopback IP", "http://127.0.0.1:8000/cb", false},
+		{"Localhost", "http://localhost:3000/cb", false},
+		{"Plain HTTP", "http://app.example.com/callback", true},
+		{"Relative", "/callback", true},
+		{"Fragment", "https://app.example.com/callback#x", true},
+		{"Other scheme", "javascript:alert(1)", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateRedirectURI(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateRedirectURI() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMakeJWTWithScopes(t *testing.T) {
+	keys := NewHMACKeySet("secret")
+	userID := uuid.New()
+	clientID := uuid.NewString()
+	token, err := MakeJWT(userID, keys, time.Hour, WithClientID(clientID), WithScopes([]string{ScopeChirpsRead, ScopeChirpsWrite}))
+	if err != nil {
+		t.Fatalf("MakeJWT() error = %v", err)
+	}
+	claims, err := ValidateJWT(token, keys, nil)
+	if err != nil {
+		t.Fatalf("ValidateJWT() error = %v", err)
+	}
+	if claims.ClientID != clientID {
+		t.Errorf("ValidateJWT() client_id = %v, expected %v", claims.ClientID, clientID)
+	}
+	scopes, err := ParseScope(claims.Scope)
+	if err != nil || !slices.Equal(scopes, []string{ScopeChirpsRead, ScopeChirpsWrite}) {
+		t.Errorf("ValidateJWT() scope = %q, expected %q", claims.Scope, "chirps:read chirps:write")
+	}
+}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMakeIDToken(t *testing.T) {
+	_, pem, err := GenerateSigningKey("EdDSA")
+	if err != nil {
+		t.Fatalf("GenerateSigningKey() error = %v", err)
+	}
+	key, _ := ParseSigningKey("test", pem)
+	keys := NewKeySet()
+	keys.Add(key)
+	keys.SetCurrent("test")
+
+	userID := uuid.New()
+	verified := true
+	token, err := MakeIDToken("https://chirpy.example.com", "client", userID, keys, time.Hour, IDTokenClaims{
+		Nonce:         "n-0S6_WzA2Mj",
+		Email:         "user@example.com",
+		EmailVerified: &verified,
+	})
+	if err != nil {
+		t.Fatalf("MakeIDToken() error = %v", err)
+	}
+
+	claims, err := ValidateIDToken(token, keys, "https://chirpy.example.com", "client")
+	if err != nil {
+		t.Fatalf("ValidateIDToken() error = %v", err)
+	}
+	if claims.Subject != userID.String() || claims.Nonce != "n-0S6_WzA2Mj" || claims.Email != "user@example.com" {
+		t.Errorf("ValidateIDToken() = %+v, expected subject %v with nonce and email", claims, userID)
+	}
+	if claims.EmailVerified == nil || !*claims.EmailVerified {
+		t.Errorf("ValidateIDToken() email_verified = %v, expected true", claims.EmailVerified)
+	}
+
+	if _, err := ValidateIDToken(token, keys, "https://chirpy.example.com", "other-client"); err == nil {
+		t.Errorf("ValidateIDToken() accepted a token for another client")
+	}
+	if _, err := ValidateJWT(token, keys, nil); err == nil {
+		t.Errorf("ValidateJWT() accepted an ID token as an access token")
+	}
+}
+
+func TestMakeIDTokenRequiresAsymmetricKey(t *testing.T) {
+	keys := NewHMACKeySet("secret")
+	_, err := MakeIDToken("https://chirpy.example.com", "client", uuid.New(), keys, time.Hour, IDTokenClaims{})
+	if !errors.Is(err, ErrIDTokenKeyRequired) {
+		t.Errorf("MakeIDToken() error = %v, expected %v", err, ErrIDTokenKeyRequired)
+	}
+}
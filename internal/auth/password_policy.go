@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxPasswordLength bounds the work a single login or signup can cause.
+const maxPasswordLength = 256
+
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule a rejected password broke.
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return "password rejected: " + strings.Join(messages, "; ")
+}
+
+type PasswordPolicy struct {
+	MinLength      int
+	MinEntropyBits float64
+	// Breached is checked when set.
+	Breached *BreachedPasswords
+}
+
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:      8,
+		MinEntropyBits: 50,
+	}
+}
+
+// Validate returns a *PasswordPolicyError if password breaks any rule, or
+// another error if the breached-password corpus couldn't be read.
+func (p PasswordPolicy) Validate(password string) error {
+	violations := []PasswordViolation{}
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		violations = append(violations, PasswordViolation{
+			Code:    "too_short",
+			Message: fmt.Sprintf("must be at least %d characters", p.MinLength),
+		})
+	}
+	if length > maxPasswordLength {
+		violations = append(violations, PasswordViolation{
+			Code:    "too_long",
+			Message: fmt.Sprintf("must be at most %d characters", maxPasswordLength),
+		})
+	}
+	if length > 0 && EstimateEntropy(password) < p.MinEntropyBits {
+		violations = append(violations, PasswordViolation{
+			Code:    "too_predictable",
+			Message: "is too easy to guess; use a longer password or mix in other kinds of characters",
+		})
+	}
+	if p.Breached != nil && length > 0 {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			violations = append(violations, PasswordViolation{
+				Code:    "breached",
+				Message: "appears in a list of passwords exposed in data breaches",
+			})
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// EstimateEntropy gives a rough strength in bits: the size of the character
+// classes used, raised to the password's length. Repeated characters only
+// count for half, so "aaaaaaaaaaaa" doesn't pass for strong.
+func EstimateEntropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	seen := map[rune]bool{}
+	effectiveLength := 0.0
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+		if seen[r] {
+			effectiveLength += 0.5
+		} else {
+			effectiveLength++
+			seen[r] = true
+		}
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	return effectiveLength * math.Log2(float64(pool))
+}
+
+// BreachedPasswords looks passwords up in a file of SHA-1 hashes, one per
+// line in hex and sorted, optionally followed by ":count" as in the Have I
+// Been Pwned downloads. The file is binary searched on disk, so it can be far
+// larger than memory.
+type BreachedPasswords struct {
+	r    io.ReaderAt
+	size int64
+}
+
+func OpenBreachedPasswords(path string) (*BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &BreachedPasswords{r: f, size: info.Size()}, nil
+}
+
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	target := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	// lo is always the start of a line; any line holding target starts in
+	// [lo, hi).
+	lo, hi := int64(0), b.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start := mid
+		if mid > lo {
+			newline, err := b.indexNewline(mid - 1)
+			if err != nil {
+				return false, err
+			}
+			start = newline + 1
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+
+		line, err := b.readLine(start)
+		if err != nil {
+			return false, err
+		}
+		hash, _, _ := strings.Cut(strings.TrimSpace(line), ":")
+		switch strings.Compare(strings.ToUpper(hash), target) {
+		case 0:
+			return true, nil
+		case -1:
+			lo = start + int64(len(line)) + 1
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
+
+// indexNewline returns the offset of the first '\n' at or after from, or the
+// file size if there is none.
+func (b *BreachedPasswords) indexNewline(from int64) (int64, error) {
+	buf := make([]byte, 128)
+	for from < b.size {
+		n, err := b.r.ReadAt(buf, from)
+		if i := strings.IndexByte(string(buf[:n]), '\n'); i >= 0 {
+			return from + int64(i), nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		from += int64(n)
+	}
+	return b.size, nil
+}
+
+// readLine returns the line starting at start, without its '\n'.
+func (b *BreachedPasswords) readLine(start int64) (string, error) {
+	end, err := b.indexNewline(start)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, end-start)
+	if _, err := b.r.ReadAt(buf, start); err != nil && err != io.EOF {
+		return "", err
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func writeBreachedFile(t *testing.T, passwords []string) string {
+	t.Helper()
+	lines := []string{}
+	for _, password := range passwords {
+		sum := sha1.Sum([]byte(password))
+		lines = append(lines, strings.ToUpper(hex.EncodeToString(sum[:]))+":42")
+	}
+	sort.Strings(lines)
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	return path
+}
+
+func TestBreachedPasswords(t *testing.T) {
+	breached := []string{"password", "123456", "qwerty", "letmein", "iloveyou", "dragon", "monkey", "football"}
+	b, err := OpenBreachedPasswords(writeBreachedFile(t, breached))
+	if err != nil {
+		t.Fatalf("OpenBreachedPasswords() error = %v", err)
+	}
+
+	for _, password := range breached {
+		found, err := b.Contains(password)
+		if err != nil || !found {
+			t.Errorf("Contains(%q) = %v, %v, expected true", password, found, err)
+		}
+	}
+	for _, password := range []string{"", "correct horse battery staple", "Password", "1234567"} {
+		found, err := b.Contains(password)
+		if err != nil || found {
+			t.Errorf("Contains(%q) = %v, %v, expected false", password, found, err)
+		}
+	}
+}
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	b, err := OpenBreachedPasswords(writeBreachedFile(t, []string{"password123"}))
+	if err != nil {
+		t.Fatalf("OpenBreachedPasswords() error = %v", err)
+	}
+	policy := PasswordPolicy{MinLength: 8, MinEntropyBits: 40, Breached: b}
+
+	tests := []struct {
+		name          string
+		password      string
+		expectedCodes []string
+	}{
+		{name: "Strong password", password: "correct horse battery staple", expectedCodes: nil},
+		{name: "Empty", password: "", expectedCodes: []string{"too_short"}},
+		{name: "Short", password: "aB3$", expectedCodes: []string{"too_short", "too_predictable"}},
+		{name: "Repetitive", password: "aaaaaaaaaaaa", expectedCodes: []string{"too_predictable"}},
+		{name: "Breached", password: "password123", expectedCodes: []string{"breached"}},
+		{name: "Too long", password: strings.Repeat("abcdefghij", 26), expectedCodes: []string{"too_long"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Validate(tt.password)
+			if tt.expectedCodes == nil {
+				if err != nil {
+					t.Errorf("Validate() error = %v, expected nil", err)
+				}
+				return
+			}
+			var policyErr *PasswordPolicyError
+			if !errors.As(err, &policyErr) {
+				t.Fatalf("Validate() error = %v, expected a *PasswordPolicyError", err)
+			}
+			codes := []string{}
+			for _, v := range policyErr.Violations {
+				codes = append(codes, v.Code)
+			}
+			if strings.Join(codes, ",") != strings.Join(tt.expectedCodes, ",") {
+				t.Errorf("Validate() violations = %v, expected %v", codes, tt.expectedCodes)
+			}
+		})
+	}
+}
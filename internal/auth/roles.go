@@ -0,0 +1,24 @@
+package auth
+
+import "slices"
+
+// Roles, from least to most privileged. Each role can do everything the
+// roles before it can.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+var roleOrder = []string{RoleUser, RoleAdmin}
+
+func ValidRole(role string) bool {
+	return slices.Contains(roleOrder, role)
+}
+
+// HasRole reports whether role grants at least the privileges of required.
+// Unknown roles grant nothing.
+func HasRole(role, required string) bool {
+	have := slices.Index(roleOrder, role)
+	need := slices.Index(roleOrder, required)
+	return have >= 0 && need >= 0 && have >= need
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestHasRole(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     string
+		required string
+		expected bool
+	}{
+		{"Admin can do what users can", RoleAdmin, RoleUser, true},
+		{"User is not admin", RoleUser, RoleAdmin, false},
+		{"Moderator is gone", "moderator", RoleUser, false},
+		{"User is user", RoleUser, RoleUser, true},
+		{"Empty role", "", RoleUser, false},
+		{"Unknown role", "superuser", RoleUser, false},
+		{"Unknown requirement", RoleAdmin, "root", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HasRole(tt.role, tt.required); got != tt.expected {
+				t.Errorf("HasRole() = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMakeJWTWithRole(t *testing.T) {
+	keys := NewHMACKeySet("secret")
+	userID := uuid.New()
+	token, err := MakeJWT(userID, keys, time.Hour, WithRole(RoleAdmin))
+	if err != nil {
+		t.Fatalf("MakeJWT() error = %v", err)
+	}
+	claims, err := ValidateJWT(token, keys, nil)
+	if err != nil {
+		t.Fatalf("ValidateJWT() error = %v", err)
+	}
+	if claims.UserID != userID || claims.Role != RoleAdmin {
+		t.Errorf("ValidateJWT() = %v %q, expected %v %q", claims.UserID, claims.Role, userID, RoleAdmin)
+	}
+}
+
+func TestMakeJWTWithActor(t *testing.T) {
+	keys := NewHMACKeySet("secret")
+	userID, adminID := uuid.New(), uuid.New()
+
+	token, err := MakeJWT(userID, keys, time.Hour, WithActor(adminID))
+	if err != nil {
+		t.Fatalf("MakeJWT() error = %v", err)
+	}
+	claims, err := ValidateJWT(token, keys, nil)
+	if err != nil {
+		t.Fatalf("ValidateJWT() error = %v", err)
+	}
+	if claims.UserID != userID || claims.ActorID != (uuid.NullUUID{UUID: adminID, Valid: true}) {
+		t.Errorf("ValidateJWT() = %v acting %v, expected %v acting %v", claims.UserID, claims.ActorID, userID, adminID)
+	}
+
+	token, err = MakeJWT(userID, keys, time.Hour)
+	if err != nil {
+		t.Fatalf("MakeJWT() error = %v", err)
+	}
+	claims, err = ValidateJWT(token, keys, nil)
+	if err != nil {
+		t.Fatalf("ValidateJWT() error = %v", err)
+	}
+	if claims.ActorID.Valid {
+		t.Errorf("ValidateJWT() ActorID = %v, expected none", claims.ActorID)
+	}
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Scopes limit what a token that isn't a full login session may do.
+const (
+	ScopeChirpsRead   = "chirps:read"
+	ScopeChirpsWrite  = "chirps:write"
+	ScopeProfileWrite = "profile:write"
+
+	// OpenID Connect scopes: openid asks for an ID token, and email adds
+	// the user's address to it and to the userinfo response.
+	ScopeOpenID = "openid"
+	ScopeEmail  = "email"
+)
+
+// PersonalAccessTokenPrefix marks personal access tokens so they can be told
+// apart from JWTs without a database lookup, and spotted by secret scanners.
+const PersonalAccessTokenPrefix = "chirpy_pat_"
+
+var knownScopes = []string{ScopeChirpsRead, ScopeChirpsWrite, ScopeProfileWrite}
+
+// oidcScopes only mean something to OAuth clients, so personal access tokens
+// can't be given them.
+var oidcScopes = []string{ScopeOpenID, ScopeEmail}
+
+// KnownScopes returns every scope a first-party token can be granted.
+func KnownScopes() []string {
+	return slices.Clone(knownScopes)
+}
+
+// OAuthScopes returns every scope an OAuth client can be granted.
+func OAuthScopes() []string {
+	return slices.Concat(knownScopes, oidcScopes)
+}
+
+// NormalizeScopes checks every requested scope is known and returns them
+// sorted with duplicates removed.
+func NormalizeScopes(requested []string) ([]string, error) {
+	return normalizeScopes(requested, knownScopes)
+}
+
+// NormalizeOAuthScopes is NormalizeScopes for OAuth clients, which can also
+// ask for the OpenID Connect scopes.
+func NormalizeOAuthScopes(requested []string) ([]string, error) {
+	return normalizeScopes(requested, OAuthScopes())
+}
+
+func normalizeScopes(requested, allowed []string) ([]string, error) {
+	scopes := []string{}
+	for _, scope := range requested {
+		scope = strings.TrimSpace(scope)
+		if !slices.Contains(allowed, scope) {
+			return nil, fmt.Errorf("unknown scope %q", scope)
+		}
+		scopes = append(scopes, scope)
+	}
+	slices.Sort(scopes)
+	return slices.Compact(scopes), nil
+}
+
+func MakePersonalAccessToken() (string, error) {
+	token, err := MakeOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	return PersonalAccessTokenPrefix + token, nil
+}
+
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, PersonalAccessTokenPrefix)
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNormalizeScopes(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested []string
+		expected  []string
+		wantErr   bool
+	}{
+		{
+			name:      "Sorted and deduplicated",
+			requested: []string{ScopeProfileWrite, ScopeChirpsRead, ScopeProfileWrite},
+			expected:  []string{ScopeChirpsRead, ScopeProfileWrite},
+		},
+		{
+			name:      "Empty",
+			requested: nil,
+			expected:  []string{},
+		},
+		{
+			name:      "Unknown scope",
+			requested: []string{ScopeChirpsRead, "admin"},
+			wantErr:   true,
+		},
+		{
+			name:      "OpenID Connect scope",
+			requested: []string{ScopeChirpsRead, ScopeOpenID},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeScopes(tt.requested)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NormalizeScopes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !slices.Equal(got, tt.expected) {
+				t.Errorf("NormalizeScopes() = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNormalizeOAuthScopes(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested []string
+		expected  []string
+		wantErr   bool
+	}{
+		{
+			name:      "OpenID Connect scopes",
+			requested: []string{ScopeOpenID, ScopeChirpsRead, ScopeEmail},
+			expected:  []string{ScopeChirpsRead, ScopeEmail, ScopeOpenID},
+		},
+		{
+			name:      "Unknown scope",
+			requested: []string{ScopeOpenID, "admin"},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeOAuthScopes(tt.requested)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NormalizeOAuthScopes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !slices.Equal(got, tt.expected) {
+				t.Errorf("NormalizeOAuthScopes() = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMakePersonalAccessToken(t *testing.T) {
+	token, err := MakePersonalAccessToken()
+	if err != nil {
+		t.Fatalf("MakePersonalAccessToken() error = %v", err)
+	}
+	if !IsPersonalAccessToken(token) {
+		t.Errorf("IsPersonalAccessToken(%q) = false, expected true", token)
+	}
+	if IsPersonalAccessToken("eyJhbGciOiJIUzI1NiJ9.e30.sig") {
+		t.Errorf("IsPersonalAccessToken() accepted a JWT")
+	}
+}
@@ -0,0 +1,58 @@
+package auth
+
+import "time"
+
+// LoginThrottle turns a count of recent failed logins for one key (an email
+// address or a client IP) into how long that key has to wait before its next
+// attempt. The first FreeAttempts failures cost nothing, later ones wait
+// BaseDelay doubling up to MaxDelay, and LockoutThreshold failures lock the
+// key for LockoutDuration. Failures older than LockoutDuration are forgotten.
+type LoginThrottle struct {
+	FreeAttempts     int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+}
+
+func DefaultLoginThrottle() LoginThrottle {
+	return LoginThrottle{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         time.Minute,
+		LockoutThreshold: 10,
+		LockoutDuration:  15 * time.Minute,
+	}
+}
+
+// Delay is how long after the last failure the next attempt is allowed.
+func (t LoginThrottle) Delay(failures int) time.Duration {
+	if t.Locked(failures) {
+		return t.LockoutDuration
+	}
+	if failures <= t.FreeAttempts {
+		return 0
+	}
+	delay := t.BaseDelay
+	for i := t.FreeAttempts + 1; i < failures; i++ {
+		delay *= 2
+		if delay >= t.MaxDelay {
+			return t.MaxDelay
+		}
+	}
+	return min(delay, t.MaxDelay)
+}
+
+func (t LoginThrottle) Locked(failures int) bool {
+	return t.LockoutThreshold > 0 && failures >= t.LockoutThreshold
+}
+
+// RetryAt is the earliest time the key may try again.
+func (t LoginThrottle) RetryAt(failures int, lastFailure time.Time) time.Time {
+	return lastFailure.Add(t.Delay(failures))
+}
+
+// WindowStart is the cut-off before which failures no longer count.
+func (t LoginThrottle) WindowStart(now time.Time) time.Time {
+	return now.Add(-t.LockoutDuration)
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleDelay(t *testing.T) {
+	throttle := LoginThrottle{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         10 * time.Second,
+		LockoutThreshold: 10,
+		LockoutDuration:  15 * time.Minute,
+	}
+
+	tests := []struct {
+		name          string
+		failures      int
+		expectedDelay time.Duration
+	}{
+		{name: "No failures", failures: 0, expectedDelay: 0},
+		{name: "Free attempts", failures: 3, expectedDelay: 0},
+		{name: "First delay", failures: 4, expectedDelay: time.Second},
+		{name: "Doubles", failures: 6, expectedDelay: 4 * time.Second},
+		{name: "Capped", failures: 9, expectedDelay: 10 * time.Second},
+		{name: "Locked out", failures: 10, expectedDelay: 15 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := throttle.Delay(tt.failures); got != tt.expectedDelay {
+				t.Errorf("Delay() = %v, expected %v", got, tt.expectedDelay)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// rfc6238Secret is the SHA-1 key from the RFC 6238 test vectors, base32 encoded.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestValidateTOTP(t *testing.T) {
+	tests := []struct {
+		name          string
+		unix          int64
+		code          string
+		expectedValid bool
+	}{
+		{name: "RFC 6238 at 59", unix: 59, code: "287082", expectedValid: true},
+		{name: "RFC 6238 at 1111111109", unix: 1111111109, code: "081804", expectedValid: true},
+		{name: "RFC 6238 at 1234567890", unix: 1234567890, code: "005924", expectedValid: true},
+		{name: "RFC 6238 at 2000000000", unix: 2000000000, code: "279037", expectedValid: true},
+		{name: "Previous period within skew", unix: 59 + 30, code: "287082", expectedValid: true},
+		{name: "Outside skew", unix: 59 + 90, code: "287082", expectedValid: false},
+		{name: "Wrong code", unix: 59, code: "123456", expectedValid: false},
+		{name: "Wrong length", unix: 59, code: "28708", expectedValid: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, valid := ValidateTOTP(rfc6238Secret, tt.code, time.Unix(tt.unix, 0))
+			if valid != tt.expectedValid {
+				t.Errorf("ValidateTOTP() = %v, expected %v", valid, tt.expectedValid)
+			}
+		})
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatalf("GenerateRecoveryCodes() error = %v", err)
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 19 {
+			t.Errorf("GenerateRecoveryCodes() code %q has length %d, expected 19", code, len(code))
+		}
+		if seen[code] {
+			t.Errorf("GenerateRecoveryCodes() returned %q twice", code)
+		}
+		seen[code] = true
+		if NormalizeRecoveryCode(strings.ToUpper(code)) != NormalizeRecoveryCode(code) {
+			t.Errorf("NormalizeRecoveryCode() is case sensitive for %q", code)
+		}
+	}
+}
+
+func TestMFAChallengeIsNotAnAccessToken(t *testing.T) {
+	keys := NewHMACKeySet("secret")
+	userID := uuid.New()
+	challenge, err := MakeMFAChallenge(userID, keys, time.Minute)
+	if err != nil {
+		t.Fatalf("MakeMFAChallenge() error = %v", err)
+	}
+	if _, err := ValidateJWT(challenge, keys, nil); err == nil {
+		t.Errorf("ValidateJWT() accepted an MFA challenge")
+	}
+	got, err := ValidateMFAChallenge(challenge, keys)
+	if err != nil || got != userID {
+		t.Errorf("ValidateMFAChallenge() = %v, %v, expected %v", got, err, userID)
+	}
+
+	access, _ := MakeJWT(userID, keys, time.Minute)
+	if _, err := ValidateMFAChallenge(access, keys); err == nil {
+		t.Errorf("ValidateMFAChallenge() accepted an access token")
+	}
+}
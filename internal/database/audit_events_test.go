@@ -0,0 +1,145 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func createTestAuditEvent(t *testing.T, q *Queries, eventType string, userID, actorID uuid.UUID, ip string) {
+	t.Helper()
+	err := q.CreateAuditEvent(context.Background(), CreateAuditEventParams{
+		EventType: eventType,
+		UserID:    uuid.NullUUID{UUID: userID, Valid: true},
+		ActorID:   uuid.NullUUID{UUID: actorID, Valid: true},
+		Ip:        ip,
+		UserAgent: "test",
+		Metadata:  json.RawMessage(`{}`),
+	})
+	if err != nil {
+		t.Fatalf("CreateAuditEvent() error = %v", err)
+	}
+}
+
+func TestAuditEventsAppendOnly(t *testing.T) {
+	q := newTestQueries(t)
+	user := createTestUser(t, q)
+	createTestAuditEvent(t, q, "login.succeeded", user.ID, user.ID, "192.0.2.1")
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{name: "Update", query: "UPDATE audit_events SET event_type = 'nothing.happened' WHERE user_id = $1"},
+		{name: "Delete", query: "DELETE FROM audit_events WHERE user_id = $1"},
+	}
+	for _, tt := range tests {
+		if _, err := testDB.Exec(tt.query, user.ID); err == nil {
+			t.Errorf("%s: error = nil, expected the trigger to reject it", tt.name)
+		}
+	}
+
+	events, err := q.ListAuditEventsAfter(context.Background(), ListAuditEventsAfterParams{
+		UserID:   uuid.NullUUID{UUID: user.ID, Valid: true},
+		RowLimit: 10,
+	})
+	if err != nil {
+		t.Fatalf("ListAuditEventsAfter() error = %v", err)
+	}
+	if len(events) != 1 || events[0].EventType != "login.succeeded" {
+		t.Errorf("ListAuditEventsAfter() = %+v, expected the event unchanged", events)
+	}
+}
+
+func TestListAuditEvents(t *testing.T) {
+	q := newTestQueries(t)
+	ctx := context.Background()
+	user := createTestUser(t, q)
+	admin := createTestUser(t, q)
+	createTestAuditEvent(t, q, "login.succeeded", user.ID, user.ID, "192.0.2.1")
+	createTestAuditEvent(t, q, "login.failed", user.ID, user.ID, "198.51.100.7")
+	createTestAuditEvent(t, q, "impersonation.started", user.ID, admin.ID, "192.0.2.1")
+	createTestAuditEvent(t, q, "login.succeeded", user.ID, user.ID, "192.0.2.1")
+	userID := uuid.NullUUID{UUID: user.ID, Valid: true}
+
+	tests := []struct {
+		name          string
+		arg           ListAuditEventsAfterParams
+		expectedTypes []string
+	}{
+		{
+			name:          "All of the user's events",
+			arg:           ListAuditEventsAfterParams{UserID: userID},
+			expectedTypes: []string{"login.succeeded", "login.failed", "impersonation.started", "login.succeeded"},
+		},
+		{
+			name:          "By actor",
+			arg:           ListAuditEventsAfterParams{UserID: userID, ActorID: uuid.NullUUID{UUID: admin.ID, Valid: true}},
+			expectedTypes: []string{"impersonation.started"},
+		},
+		{
+			name:          "By type",
+			arg:           ListAuditEventsAfterParams{UserID: userID, EventType: sql.NullString{String: "login.succeeded", Valid: true}},
+			expectedTypes: []string{"login.succeeded", "login.succeeded"},
+		},
+		{
+			name:          "By IP",
+			arg:           ListAuditEventsAfterParams{UserID: userID, Ip: sql.NullString{String: "198.51.100.7", Valid: true}},
+			expectedTypes: []string{"login.failed"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.arg.RowLimit = 10
+			events, err := q.ListAuditEventsAfter(ctx, tt.arg)
+			if err != nil {
+				t.Fatalf("ListAuditEventsAfter() error = %v", err)
+			}
+			types := []string{}
+			for _, event := range events {
+				types = append(types, event.EventType)
+			}
+			if len(types) != len(tt.expectedTypes) {
+				t.Fatalf("ListAuditEventsAfter() = %v, expected %v", types, tt.expectedTypes)
+			}
+			for i := range types {
+				if types[i] != tt.expectedTypes[i] {
+					t.Errorf("ListAuditEventsAfter() = %v, expected %v", types, tt.expectedTypes)
+					break
+				}
+			}
+		})
+	}
+
+	first, err := q.ListAuditEventsAfter(ctx, ListAuditEventsAfterParams{UserID: userID, RowLimit: 2})
+	if err != nil {
+		t.Fatalf("ListAuditEventsAfter() error = %v", err)
+	}
+	rest, err := q.ListAuditEventsAfter(ctx, ListAuditEventsAfterParams{
+		UserID:          userID,
+		CursorCreatedAt: nullTime(first[1].CreatedAt),
+		CursorID:        uuid.NullUUID{UUID: first[1].ID, Valid: true},
+		RowLimit:        10,
+	})
+	if err != nil {
+		t.Fatalf("ListAuditEventsAfter() from the cursor error = %v", err)
+	}
+	if len(rest) != 2 || rest[0].EventType != "impersonation.started" {
+		t.Errorf("ListAuditEventsAfter() from the cursor = %+v, expected the last two events", rest)
+	}
+	back, err := q.ListAuditEventsBefore(ctx, ListAuditEventsBeforeParams{
+		UserID:          userID,
+		CursorCreatedAt: nullTime(rest[0].CreatedAt),
+		CursorID:        uuid.NullUUID{UUID: rest[0].ID, Valid: true},
+		RowLimit:        10,
+	})
+	if err != nil {
+		t.Fatalf("ListAuditEventsBefore() error = %v", err)
+	}
+	if len(back) != 2 || back[0].ID != first[1].ID || back[1].ID != first[0].ID {
+		t.Errorf("ListAuditEventsBefore() = %+v, expected the first two events, newest first", back)
+	}
+}
@@ -7,29 +7,159 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
+const countChirpReferences = `-- name: CountChirpReferences :many
+SELECT referenced_chirp_id, kind, COUNT(*) AS reference_count FROM chirps
+WHERE referenced_chirp_id = ANY($1::uuid[])
+GROUP BY referenced_chirp_id, kind
+`
+
+type CountChirpReferencesRow struct {
+	ReferencedChirpID uuid.NullUUID
+	Kind              string
+	ReferenceCount    int64
+}
+
+func (q *Queries) CountChirpReferences(ctx context.Context, chirpIds []uuid.UUID) ([]CountChirpReferencesRow, error) {
+	rows, err := q.db.QueryContext(ctx, countChirpReferences, pq.Array(chirpIds))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []CountChirpReferencesRow
+	for rows.Next() {
+		var i CountChirpReferencesRow
+		if err := rows.Scan(&i.ReferencedChirpID, &i.Kind, &i.ReferenceCount); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const countChirpReplies = `-- name: CountChirpReplies :many
+SELECT parent_id, COUNT(*) AS reply_count FROM chirps
+WHERE parent_id = ANY($1::uuid[])
+GROUP BY parent_id
+`
+
+type CountChirpRepliesRow struct {
+	ParentID   uuid.NullUUID
+	ReplyCount int64
+}
+
+func (q *Queries) CountChirpReplies(ctx context.Context, chirpIds []uuid.UUID) ([]CountChirpRepliesRow, error) {
+	rows, err := q.db.QueryContext(ctx, countChirpReplies, pq.Array(chirpIds))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []CountChirpRepliesRow
+	for rows.Next() {
+		var i CountChirpRepliesRow
+		if err := rows.Scan(&i.ParentID, &i.ReplyCount); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const createChirp = `-- name: CreateChirp :one
-INSERT INTO chirps (id, created_at, updated_at, body, user_id)
-VALUES (
-    gen_random_uuid(),
+WITH new_chirp AS (
+    SELECT gen_random_uuid() AS id
+), tags AS (
+    INSERT INTO chirp_hashtags (chirp_id, tag, created_at)
+    SELECT new_chirp.id, tag, NOW()
+    FROM new_chirp, unnest($6::text[]) AS tag
+)
+INSERT INTO chirps (id, created_at, updated_at, body, user_id, parent_id, thread_id, kind, referenced_chirp_id)
+SELECT
+    new_chirp.id,
     NOW(),
     NOW(),
     $1,
-    $2
-)
-RETURNING id, created_at, updated_at, body, user_id
+    $2,
+    $3,
+    COALESCE((SELECT thread_id FROM chirps WHERE id = $3), new_chirp.id),
+    $4,
+    $5
+FROM new_chirp
+RETURNING id, created_at, updated_at, body, user_id, edited_at, parent_id, thread_id, kind, referenced_chirp_id
 `
 
 type CreateChirpParams struct {
-	Body   string
-	UserID uuid.UUID
+	Body              string
+	UserID            uuid.UUID
+	ParentID          uuid.NullUUID
+	Kind              string
+	ReferencedChirpID uuid.NullUUID
+	Hashtags          []string
 }
 
+// A reply joins its parent's thread; any other chirp starts its own.
 func (q *Queries) CreateChirp(ctx context.Context, arg CreateChirpParams) (Chirp, error) {
-	row := q.db.QueryRowContext(ctx, createChirp, arg.Body, arg.UserID)
+	row := q.db.QueryRowContext(ctx, createChirp,
+		arg.Body,
+		arg.UserID,
+		arg.ParentID,
+		arg.Kind,
+		arg.ReferencedChirpID,
+		pq.Array(arg.Hashtags),
+	)
+	var i Chirp
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Body,
+		&i.UserID,
+		&i.EditedAt,
+		&i.ParentID,
+		&i.ThreadID,
+		&i.Kind,
+		&i.ReferencedChirpID,
+	)
+	return i, err
+}
+
+const createRechirp = `-- name: CreateRechirp :one
+WITH new_chirp AS (
+    SELECT gen_random_uuid() AS id
+)
+INSERT INTO chirps (id, created_at, updated_at, body, user_id, parent_id, thread_id, kind, referenced_chirp_id)
+SELECT new_chirp.id, NOW(), NOW(), '', $1, NULL, new_chirp.id, 'rechirp', $2
+FROM new_chirp
+ON CONFLICT (user_id, referenced_chirp_id) WHERE kind = 'rechirp' DO NOTHING
+RETURNING id, created_at, updated_at, body, user_id, edited_at, parent_id, thread_id, kind, referenced_chirp_id
+`
+
+type CreateRechirpParams struct {
+	UserID            uuid.UUID
+	ReferencedChirpID uuid.NullUUID
+}
+
+// Returns no row if the user has already rechirped the chirp.
+func (q *Queries) CreateRechirp(ctx context.Context, arg CreateRechirpParams) (Chirp, error) {
+	row := q.db.QueryRowContext(ctx, createRechirp, arg.UserID, arg.ReferencedChirpID)
 	var i Chirp
 	err := row.Scan(
 		&i.ID,
@@ -37,12 +167,23 @@ func (q *Queries) CreateChirp(ctx context.Context, arg CreateChirpParams) (Chirp
 		&i.UpdatedAt,
 		&i.Body,
 		&i.UserID,
+		&i.EditedAt,
+		&i.ParentID,
+		&i.ThreadID,
+		&i.Kind,
+		&i.ReferencedChirpID,
 	)
 	return i, err
 }
 
 const deleteChirp = `-- name: DeleteChirp :exec
-DELETE FROM chirps WHERE id = $1 AND user_id = $2
+WITH rechirps AS (
+    DELETE FROM chirps r
+    WHERE r.referenced_chirp_id = $1
+    AND r.kind = 'rechirp'
+    AND EXISTS (SELECT 1 FROM chirps c WHERE c.id = $1 AND c.user_id = $2)
+)
+DELETE FROM chirps WHERE chirps.id = $1 AND chirps.user_id = $2
 `
 
 type DeleteChirpParams struct {
@@ -50,14 +191,89 @@ type DeleteChirpParams struct {
 	UserID uuid.UUID
 }
 
+// Rechirps go with the chirp they point at.
 func (q *Queries) DeleteChirp(ctx context.Context, arg DeleteChirpParams) error {
 	_, err := q.db.ExecContext(ctx, deleteChirp, arg.ID, arg.UserID)
 	return err
 }
 
+const deleteRechirp = `-- name: DeleteRechirp :execrows
+DELETE FROM chirps
+WHERE user_id = $1
+AND referenced_chirp_id = $2
+AND kind = 'rechirp'
+`
+
+type DeleteRechirpParams struct {
+	UserID            uuid.UUID
+	ReferencedChirpID uuid.NullUUID
+}
+
+func (q *Queries) DeleteRechirp(ctx context.Context, arg DeleteRechirpParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteRechirp, arg.UserID, arg.ReferencedChirpID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const editChirp = `-- name: EditChirp :one
+WITH current AS (
+    SELECT chirps.id, chirps.body, chirps.created_at, chirps.updated_at FROM chirps
+    WHERE chirps.id = $2
+    FOR UPDATE
+), revision AS (
+    INSERT INTO chirp_revisions (id, chirp_id, body, created_at, replaced_at)
+    SELECT gen_random_uuid(), id, body, updated_at, NOW() FROM current
+), old_tags AS (
+    DELETE FROM chirp_hashtags
+    WHERE chirp_id = (SELECT id FROM current)
+    AND tag <> ALL($3::text[])
+), new_tags AS (
+    INSERT INTO chirp_hashtags (chirp_id, tag, created_at)
+    SELECT current.id, tag, current.created_at
+    FROM current, unnest($3::text[]) AS tag
+    ON CONFLICT (chirp_id, tag) DO NOTHING
+)
+UPDATE chirps
+SET body = $1,
+    updated_at = NOW(),
+    edited_at = NOW()
+FROM current
+WHERE chirps.id = current.id
+RETURNING chirps.id, chirps.created_at, chirps.updated_at, chirps.body, chirps.user_id, chirps.edited_at, chirps.parent_id, chirps.thread_id, chirps.kind, chirps.referenced_chirp_id
+`
+
+type EditChirpParams struct {
+	Body     string
+	ID       uuid.UUID
+	Hashtags []string
+}
+
+// The row lock makes concurrent edits take turns, so each one saves the
+// body it actually replaced. Hashtags are swapped for the new body's, but
+// keep the chirp's created_at so editing doesn't bump them up trending.
+func (q *Queries) EditChirp(ctx context.Context, arg EditChirpParams) (Chirp, error) {
+	row := q.db.QueryRowContext(ctx, editChirp, arg.Body, arg.ID, pq.Array(arg.Hashtags))
+	var i Chirp
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Body,
+		&i.UserID,
+		&i.EditedAt,
+		&i.ParentID,
+		&i.ThreadID,
+		&i.Kind,
+		&i.ReferencedChirpID,
+	)
+	return i, err
+}
+
 const getChirp = `-- name: GetChirp :one
 
-SELECT id, created_at, updated_at, body, user_id FROM chirps
+SELECT id, created_at, updated_at, body, user_id, edited_at, parent_id, thread_id, kind, referenced_chirp_id FROM chirps
 WHERE id = $1
 `
 
@@ -70,17 +286,97 @@ func (q *Queries) GetChirp(ctx context.Context, id uuid.UUID) (Chirp, error) {
 		&i.UpdatedAt,
 		&i.Body,
 		&i.UserID,
+		&i.EditedAt,
+		&i.ParentID,
+		&i.ThreadID,
+		&i.Kind,
+		&i.ReferencedChirpID,
 	)
 	return i, err
 }
 
-const getChirps = `-- name: GetChirps :many
-SELECT id, created_at, updated_at, body, user_id FROM chirps
-ORDER BY created_at ASC
+const getChirpThread = `-- name: GetChirpThread :many
+WITH RECURSIVE thread AS (
+    SELECT c.id, c.created_at, c.updated_at, c.body, c.user_id, c.edited_at, c.parent_id, c.thread_id, c.kind, c.referenced_chirp_id, 0 AS depth, ARRAY[to_char(c.created_at, 'YYYYMMDDHH24MISSUS') || c.id::text] AS path
+    FROM chirps c
+    WHERE c.thread_id = (SELECT t.thread_id FROM chirps t WHERE t.id = $2)
+    AND c.parent_id IS NULL
+    UNION ALL
+    SELECT c.id, c.created_at, c.updated_at, c.body, c.user_id, c.edited_at, c.parent_id, c.thread_id, c.kind, c.referenced_chirp_id, thread.depth + 1, thread.path || (to_char(c.created_at, 'YYYYMMDDHH24MISSUS') || c.id::text)
+    FROM chirps c
+    JOIN thread ON c.parent_id = thread.id
+    WHERE thread.depth < $3::int
+)
+SELECT id, created_at, updated_at, body, user_id, edited_at, parent_id, thread_id, kind, referenced_chirp_id, depth FROM thread
+ORDER BY path
+LIMIT $1
+`
+
+type GetChirpThreadParams struct {
+	RowLimit int32
+	ChirpID  uuid.UUID
+	MaxDepth int32
+}
+
+type GetChirpThreadRow struct {
+	ID                uuid.UUID
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+	Body              string
+	UserID            uuid.UUID
+	EditedAt          sql.NullTime
+	ParentID          uuid.NullUUID
+	ThreadID          uuid.UUID
+	Kind              string
+	ReferencedChirpID uuid.NullUUID
+	Depth             int32
+}
+
+// Walks the thread holding chirp_id down from its top-level chirps: the one
+// that started it, and any whose parent has since been deleted. Sorting by
+// path lists each chirp's replies, oldest first, straight after it.
+func (q *Queries) GetChirpThread(ctx context.Context, arg GetChirpThreadParams) ([]GetChirpThreadRow, error) {
+	rows, err := q.db.QueryContext(ctx, getChirpThread, arg.RowLimit, arg.ChirpID, arg.MaxDepth)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetChirpThreadRow
+	for rows.Next() {
+		var i GetChirpThreadRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Body,
+			&i.UserID,
+			&i.EditedAt,
+			&i.ParentID,
+			&i.ThreadID,
+			&i.Kind,
+			&i.ReferencedChirpID,
+			&i.Depth,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getChirpsByIDs = `-- name: GetChirpsByIDs :many
+SELECT id, created_at, updated_at, body, user_id, edited_at, parent_id, thread_id, kind, referenced_chirp_id FROM chirps
+WHERE id = ANY($1::uuid[])
 `
 
-func (q *Queries) GetChirps(ctx context.Context) ([]Chirp, error) {
-	rows, err := q.db.QueryContext(ctx, getChirps)
+func (q *Queries) GetChirpsByIDs(ctx context.Context, chirpIds []uuid.UUID) ([]Chirp, error) {
+	rows, err := q.db.QueryContext(ctx, getChirpsByIDs, pq.Array(chirpIds))
 	if err != nil {
 		return nil, err
 	}
@@ -94,6 +390,11 @@ func (q *Queries) GetChirps(ctx context.Context) ([]Chirp, error) {
 			&i.UpdatedAt,
 			&i.Body,
 			&i.UserID,
+			&i.EditedAt,
+			&i.ParentID,
+			&i.ThreadID,
+			&i.Kind,
+			&i.ReferencedChirpID,
 		); err != nil {
 			return nil, err
 		}
@@ -108,14 +409,153 @@ func (q *Queries) GetChirps(ctx context.Context) ([]Chirp, error) {
 	return items, nil
 }
 
-const getChirpsByAuthorID = `-- name: GetChirpsByAuthorID :many
-SELECT * FROM chirps
+const getRechirp = `-- name: GetRechirp :one
+SELECT id, created_at, updated_at, body, user_id, edited_at, parent_id, thread_id, kind, referenced_chirp_id FROM chirps
 WHERE user_id = $1
+AND referenced_chirp_id = $2
+AND kind = 'rechirp'
+`
+
+type GetRechirpParams struct {
+	UserID            uuid.UUID
+	ReferencedChirpID uuid.NullUUID
+}
+
+func (q *Queries) GetRechirp(ctx context.Context, arg GetRechirpParams) (Chirp, error) {
+	row := q.db.QueryRowContext(ctx, getRechirp, arg.UserID, arg.ReferencedChirpID)
+	var i Chirp
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Body,
+		&i.UserID,
+		&i.EditedAt,
+		&i.ParentID,
+		&i.ThreadID,
+		&i.Kind,
+		&i.ReferencedChirpID,
+	)
+	return i, err
+}
+
+const listChirpRevisions = `-- name: ListChirpRevisions :many
+SELECT id, chirp_id, body, created_at, replaced_at FROM chirp_revisions
+WHERE chirp_id = $1
 ORDER BY created_at ASC
 `
 
-func (q *Queries) GetChirpsByAuthorID(ctx context.Context, authorID uuid.UUID) ([]Chirp, error) {
-	rows, err := q.db.QueryContext(ctx, getChirpsByAuthorID, authorID)
+func (q *Queries) ListChirpRevisions(ctx context.Context, chirpID uuid.UUID) ([]ChirpRevision, error) {
+	rows, err := q.db.QueryContext(ctx, listChirpRevisions, chirpID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ChirpRevision
+	for rows.Next() {
+		var i ChirpRevision
+		if err := rows.Scan(
+			&i.ID,
+			&i.ChirpID,
+			&i.Body,
+			&i.CreatedAt,
+			&i.ReplacedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listChirpsAfter = `-- name: ListChirpsAfter :many
+SELECT id, created_at, updated_at, body, user_id, edited_at, parent_id, thread_id, kind, referenced_chirp_id FROM chirps
+WHERE ($1::uuid IS NULL OR user_id = $1)
+AND (
+    $2::timestamp IS NULL
+    OR (created_at, id) > ($2::timestamp, $3::uuid)
+)
+ORDER BY created_at ASC, id ASC
+LIMIT $4
+`
+
+type ListChirpsAfterParams struct {
+	AuthorID        uuid.NullUUID
+	CursorCreatedAt sql.NullTime
+	CursorID        uuid.NullUUID
+	RowLimit        int32
+}
+
+func (q *Queries) ListChirpsAfter(ctx context.Context, arg ListChirpsAfterParams) ([]Chirp, error) {
+	rows, err := q.db.QueryContext(ctx, listChirpsAfter,
+		arg.AuthorID,
+		arg.CursorCreatedAt,
+		arg.CursorID,
+		arg.RowLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Chirp
+	for rows.Next() {
+		var i Chirp
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Body,
+			&i.UserID,
+			&i.EditedAt,
+			&i.ParentID,
+			&i.ThreadID,
+			&i.Kind,
+			&i.ReferencedChirpID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listChirpsBefore = `-- name: ListChirpsBefore :many
+SELECT id, created_at, updated_at, body, user_id, edited_at, parent_id, thread_id, kind, referenced_chirp_id FROM chirps
+WHERE ($1::uuid IS NULL OR user_id = $1)
+AND (
+    $2::timestamp IS NULL
+    OR (created_at, id) < ($2::timestamp, $3::uuid)
+)
+ORDER BY created_at DESC, id DESC
+LIMIT $4
+`
+
+type ListChirpsBeforeParams struct {
+	AuthorID        uuid.NullUUID
+	CursorCreatedAt sql.NullTime
+	CursorID        uuid.NullUUID
+	RowLimit        int32
+}
+
+func (q *Queries) ListChirpsBefore(ctx context.Context, arg ListChirpsBeforeParams) ([]Chirp, error) {
+	rows, err := q.db.QueryContext(ctx, listChirpsBefore,
+		arg.AuthorID,
+		arg.CursorCreatedAt,
+		arg.CursorID,
+		arg.RowLimit,
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -129,6 +569,11 @@ func (q *Queries) GetChirpsByAuthorID(ctx context.Context, authorID uuid.UUID) (
 			&i.UpdatedAt,
 			&i.Body,
 			&i.UserID,
+			&i.EditedAt,
+			&i.ParentID,
+			&i.ThreadID,
+			&i.Kind,
+			&i.ReferencedChirpID,
 		); err != nil {
 			return nil, err
 		}
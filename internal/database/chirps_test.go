@@ -0,0 +1,142 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func createTestQuote(t *testing.T, q *Queries, userID, referencedID uuid.UUID) Chirp {
+	t.Helper()
+	quote, err := q.CreateChirp(context.Background(), CreateChirpParams{
+		Body:              "Look at this",
+		UserID:            userID,
+		Kind:              "quote",
+		ReferencedChirpID: uuid.NullUUID{UUID: referencedID, Valid: true},
+		Hashtags:          []string{},
+	})
+	if err != nil {
+		t.Fatalf("CreateChirp() error = %v", err)
+	}
+	return quote
+}
+
+func createTestRechirp(t *testing.T, q *Queries, userID, referencedID uuid.UUID) Chirp {
+	t.Helper()
+	rechirp, err := q.CreateRechirp(context.Background(), CreateRechirpParams{
+		UserID:            userID,
+		ReferencedChirpID: uuid.NullUUID{UUID: referencedID, Valid: true},
+	})
+	if err != nil {
+		t.Fatalf("CreateRechirp() error = %v", err)
+	}
+	return rechirp
+}
+
+func TestDeleteChirp(t *testing.T) {
+	q := newTestQueries(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name            string
+		byAuthor        bool
+		expectedDeleted bool
+	}{
+		{name: "Author deletes", byAuthor: true, expectedDeleted: true},
+		{name: "Someone else tries", byAuthor: false, expectedDeleted: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			author := createTestUser(t, q)
+			fan := createTestUser(t, q)
+			chirp := createTestChirp(t, q, author.ID, "Delete me", nil)
+			rechirp := createTestRechirp(t, q, fan.ID, chirp.ID)
+			quote := createTestQuote(t, q, fan.ID, chirp.ID)
+			other := createTestChirp(t, q, author.ID, "Keep me", nil)
+			otherRechirp := createTestRechirp(t, q, fan.ID, other.ID)
+
+			deleter := fan.ID
+			if tt.byAuthor {
+				deleter = author.ID
+			}
+			if err := q.DeleteChirp(ctx, DeleteChirpParams{ID: chirp.ID, UserID: deleter}); err != nil {
+				t.Fatalf("DeleteChirp() error = %v", err)
+			}
+
+			for _, id := range []uuid.UUID{chirp.ID, rechirp.ID} {
+				_, err := q.GetChirp(ctx, id)
+				if deleted := errors.Is(err, sql.ErrNoRows); deleted != tt.expectedDeleted {
+					t.Errorf("GetChirp(%v) error = %v, expected deleted %v", id, err, tt.expectedDeleted)
+				}
+			}
+			for _, id := range []uuid.UUID{other.ID, otherRechirp.ID} {
+				if _, err := q.GetChirp(ctx, id); err != nil {
+					t.Errorf("GetChirp(%v) error = %v, expected it untouched", id, err)
+				}
+			}
+
+			// A quote keeps its own words when the chirp it quoted goes.
+			got, err := q.GetChirp(ctx, quote.ID)
+			if err != nil {
+				t.Fatalf("GetChirp(quote) error = %v", err)
+			}
+			if got.ReferencedChirpID.Valid == tt.expectedDeleted {
+				t.Errorf("quote references %v, expected a reference only while the chirp exists", got.ReferencedChirpID)
+			}
+		})
+	}
+}
+
+func TestCreateRechirpTwice(t *testing.T) {
+	q := newTestQueries(t)
+	ctx := context.Background()
+	author := createTestUser(t, q)
+	fan := createTestUser(t, q)
+	chirp := createTestChirp(t, q, author.ID, "Rechirp me", nil)
+	first := createTestRechirp(t, q, fan.ID, chirp.ID)
+	arg := CreateRechirpParams{UserID: fan.ID, ReferencedChirpID: uuid.NullUUID{UUID: chirp.ID, Valid: true}}
+
+	if _, err := q.CreateRechirp(ctx, arg); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("CreateRechirp() again error = %v, expected sql.ErrNoRows", err)
+	}
+	existing, err := q.GetRechirp(ctx, GetRechirpParams(arg))
+	if err != nil {
+		t.Fatalf("GetRechirp() error = %v", err)
+	}
+	if existing.ID != first.ID {
+		t.Errorf("GetRechirp() = %v, expected the first rechirp %v", existing.ID, first.ID)
+	}
+}
+
+func TestCountChirpReferences(t *testing.T) {
+	q := newTestQueries(t)
+	ctx := context.Background()
+	author := createTestUser(t, q)
+	chirp := createTestChirp(t, q, author.ID, "Popular", nil)
+	quiet := createTestChirp(t, q, author.ID, "Quiet", nil)
+	for range 2 {
+		fan := createTestUser(t, q)
+		createTestRechirp(t, q, fan.ID, chirp.ID)
+		createTestQuote(t, q, fan.ID, chirp.ID)
+	}
+	createTestQuote(t, q, author.ID, chirp.ID)
+
+	rows, err := q.CountChirpReferences(ctx, []uuid.UUID{chirp.ID, quiet.ID})
+	if err != nil {
+		t.Fatalf("CountChirpReferences() error = %v", err)
+	}
+	got := map[string]int64{}
+	for _, row := range rows {
+		if row.ReferencedChirpID.UUID != chirp.ID {
+			t.Errorf("CountChirpReferences() counted %v, expected only %v", row.ReferencedChirpID, chirp.ID)
+		}
+		got[row.Kind] = row.ReferenceCount
+	}
+	if len(got) != 2 || got["rechirp"] != 2 || got["quote"] != 3 {
+		t.Errorf("CountChirpReferences() = %v, expected rechirp:2 quote:3", got)
+	}
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+)
+
+// These tests run the queries against Postgres. TEST_DB_URL must point at a
+// throwaway database: its public schema is dropped and rebuilt from
+// sql/schema before the tests start. Without it they are skipped.
+var testDB *sql.DB
+
+func TestMain(m *testing.M) {
+	if dbURL := os.Getenv("TEST_DB_URL"); dbURL != "" {
+		db, err := sql.Open("postgres", dbURL)
+		if err != nil {
+			log.Fatalf("Couldn't open test database: %v", err)
+		}
+		if err := migrate(db, filepath.Join("..", "..", "sql", "schema")); err != nil {
+			log.Fatalf("Couldn't migrate test database: %v", err)
+		}
+		testDB = db
+	}
+	os.Exit(m.Run())
+}
+
+// migrate recreates the public schema and runs the Up half of every goose
+// migration in dir, in version order.
+func migrate(db *sql.DB, dir string) error {
+	if _, err := db.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public"); err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		dat, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		up, _, _ := strings.Cut(string(dat), "-- +goose Down")
+		if _, err := db.Exec(up); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(file), err)
+		}
+	}
+	return nil
+}
+
+func newTestQueries(t *testing.T) *Queries {
+	t.Helper()
+	if testDB == nil {
+		t.Skip("TEST_DB_URL is not set")
+	}
+	return New(testDB)
+}
+
+func createTestUser(t *testing.T, q *Queries) User {
+	t.Helper()
+	user, err := q.CreateUser(context.Background(), CreateUserParams{
+		Email:          uuid.NewString() + "@example.com",
+		HashedPassword: "unset",
+	})
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	return user
+}
+
+func createTestChirp(t *testing.T, q *Queries, userID uuid.UUID, body string, hashtags []string) Chirp {
+	t.Helper()
+	if hashtags == nil {
+		hashtags = []string{}
+	}
+	chirp, err := q.CreateChirp(context.Background(), CreateChirpParams{
+		Body:     body,
+		UserID:   userID,
+		Kind:     "post",
+		Hashtags: hashtags,
+	})
+	if err != nil {
+		t.Fatalf("CreateChirp() error = %v", err)
+	}
+	return chirp
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: true}
+}
@@ -0,0 +1,122 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func createTestVerification(t *testing.T, q *Queries, userID uuid.UUID, email string) string {
+	t.Helper()
+	tokenHash := uuid.NewString()
+	err := q.CreateEmailVerification(context.Background(), CreateEmailVerificationParams{
+		TokenHash: tokenHash,
+		UserID:    userID,
+		Email:     email,
+		ExpiresAt: time.Now().UTC().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("CreateEmailVerification() error = %v", err)
+	}
+	return tokenHash
+}
+
+func TestEmailVerificationCancelled(t *testing.T) {
+	q := newTestQueries(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// cancel runs after the first link is sent, and may send another.
+		cancel func(t *testing.T, user User)
+	}{
+		{
+			name: "New link requested",
+			cancel: func(t *testing.T, user User) {
+				createTestVerification(t, q, user.ID, "second@example.com")
+			},
+		},
+		{
+			name: "Credentials changed",
+			cancel: func(t *testing.T, user User) {
+				if err := q.InvalidateEmailVerifications(ctx, user.ID); err != nil {
+					t.Fatalf("InvalidateEmailVerifications() error = %v", err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := createTestUser(t, q)
+			other := createTestUser(t, q)
+			first := createTestVerification(t, q, user.ID, "first@example.com")
+			untouched := createTestVerification(t, q, other.ID, "other@example.com")
+
+			tt.cancel(t, user)
+
+			if _, err := q.UseEmailVerification(ctx, first); !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("UseEmailVerification() on the old link error = %v, expected sql.ErrNoRows", err)
+			}
+			if _, err := q.UseEmailVerification(ctx, untouched); err != nil {
+				t.Errorf("UseEmailVerification() on another user's link error = %v", err)
+			}
+		})
+	}
+}
+
+func TestEmailVerificationLatestLinkWorks(t *testing.T) {
+	q := newTestQueries(t)
+	ctx := context.Background()
+	user := createTestUser(t, q)
+	createTestVerification(t, q, user.ID, "first@example.com")
+	latest := createTestVerification(t, q, user.ID, "second@example.com")
+
+	verification, err := q.UseEmailVerification(ctx, latest)
+	if err != nil {
+		t.Fatalf("UseEmailVerification() error = %v", err)
+	}
+	if verification.Email != "second@example.com" {
+		t.Errorf("UseEmailVerification() email = %q, expected second@example.com", verification.Email)
+	}
+	if _, err := q.UseEmailVerification(ctx, latest); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("UseEmailVerification() twice error = %v, expected sql.ErrNoRows", err)
+	}
+}
+
+func TestVerifyUserEmailAfterCredentialChange(t *testing.T) {
+	q := newTestQueries(t)
+	ctx := context.Background()
+	changedAt := time.Now().UTC().Truncate(time.Second)
+
+	tests := []struct {
+		name          string
+		requestedAt   time.Time
+		expectedError error
+	}{
+		{name: "Sent before the change", requestedAt: changedAt.Add(-time.Minute), expectedError: sql.ErrNoRows},
+		{name: "Sent after the change", requestedAt: changedAt.Add(time.Millisecond)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := createTestUser(t, q)
+			err := q.InvalidateUserTokens(ctx, InvalidateUserTokensParams{ID: user.ID, TokensValidAfter: nullTime(changedAt)})
+			if err != nil {
+				t.Fatalf("InvalidateUserTokens() error = %v", err)
+			}
+			email := uuid.NewString() + "@example.com"
+			verified, err := q.VerifyUserEmail(ctx, VerifyUserEmailParams{ID: user.ID, Email: email, RequestedAt: tt.requestedAt})
+			if !errors.Is(err, tt.expectedError) {
+				t.Fatalf("VerifyUserEmail() error = %v, expected %v", err, tt.expectedError)
+			}
+			if err == nil && (verified.Email != email || !verified.EmailVerified) {
+				t.Errorf("VerifyUserEmail() = %+v, expected %s verified", verified, email)
+			}
+		})
+	}
+}
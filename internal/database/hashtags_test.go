@@ -0,0 +1,197 @@
+package database
+
+import (
+	"context"
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// testTag returns a tag no other test uses.
+func testTag() string {
+	return "t" + uuid.NewString()[:8]
+}
+
+// ageHashtag backdates every use of tag by hours.
+func ageHashtag(t *testing.T, tag string, hours int) {
+	t.Helper()
+	_, err := testDB.Exec("UPDATE chirp_hashtags SET created_at = created_at - make_interval(hours => $2) WHERE tag = $1", tag, hours)
+	if err != nil {
+		t.Fatalf("ageHashtag() error = %v", err)
+	}
+}
+
+func TestListTrendingHashtags(t *testing.T) {
+	q := newTestQueries(t)
+	user := createTestUser(t, q)
+	steady, burst, stale := testTag(), testTag(), testTag()
+	for range 3 {
+		createTestChirp(t, q, user.ID, "#"+steady, []string{steady})
+	}
+	for range 2 {
+		createTestChirp(t, q, user.ID, "#"+burst, []string{burst})
+	}
+	createTestChirp(t, q, user.ID, "#"+stale, []string{stale})
+	ageHashtag(t, steady, 10)
+	ageHashtag(t, stale, 48)
+
+	rows, err := q.ListTrendingHashtags(context.Background(), ListTrendingHashtagsParams{
+		HalfLifeSeconds: 3600,
+		WindowSeconds:   24 * 3600,
+		RowLimit:        1000,
+	})
+	if err != nil {
+		t.Fatalf("ListTrendingHashtags() error = %v", err)
+	}
+	got := map[string]ListTrendingHashtagsRow{}
+	order := []string{}
+	for _, row := range rows {
+		if row.Tag == steady || row.Tag == burst || row.Tag == stale {
+			got[row.Tag] = row
+			order = append(order, row.Tag)
+		}
+	}
+
+	if !slices.Equal(order, []string{burst, steady}) {
+		t.Fatalf("ListTrendingHashtags() order = %v, expected %v then %v, and %v outside the window", order, burst, steady, stale)
+	}
+	tests := []struct {
+		tag           string
+		expectedCount int64
+		expectedScore float64
+	}{
+		{tag: burst, expectedCount: 2, expectedScore: 2},
+		// Ten half-lives old.
+		{tag: steady, expectedCount: 3, expectedScore: 3.0 / 1024},
+	}
+	for _, tt := range tests {
+		row := got[tt.tag]
+		if row.ChirpCount != tt.expectedCount || math.Abs(row.Score-tt.expectedScore) > tt.expectedScore/100 {
+			t.Errorf("ListTrendingHashtags() %s = %d chirps scoring %f, expected %d scoring %f",
+				tt.tag, row.ChirpCount, row.Score, tt.expectedCount, tt.expectedScore)
+		}
+	}
+}
+
+func TestListHashtagChirps(t *testing.T) {
+	q := newTestQueries(t)
+	ctx := context.Background()
+	user := createTestUser(t, q)
+	tag := testTag()
+	chirps := []Chirp{}
+	for range 3 {
+		chirps = append(chirps, createTestChirp(t, q, user.ID, "#"+tag, []string{tag}))
+	}
+	other := testTag()
+	createTestChirp(t, q, user.ID, "#"+other, []string{other})
+
+	first, err := q.ListHashtagChirpsAfter(ctx, ListHashtagChirpsAfterParams{Tag: tag, RowLimit: 2})
+	if err != nil {
+		t.Fatalf("ListHashtagChirpsAfter() error = %v", err)
+	}
+	if len(first) != 2 || first[0].ID != chirps[0].ID || first[1].ID != chirps[1].ID {
+		t.Fatalf("ListHashtagChirpsAfter() = %+v, expected the first two chirps", first)
+	}
+	rest, err := q.ListHashtagChirpsAfter(ctx, ListHashtagChirpsAfterParams{
+		Tag:             tag,
+		CursorCreatedAt: nullTime(first[1].CreatedAt),
+		CursorID:        uuid.NullUUID{UUID: first[1].ID, Valid: true},
+		RowLimit:        2,
+	})
+	if err != nil {
+		t.Fatalf("ListHashtagChirpsAfter() error = %v", err)
+	}
+	if len(rest) != 1 || rest[0].ID != chirps[2].ID {
+		t.Errorf("ListHashtagChirpsAfter() from the cursor = %+v, expected the last chirp", rest)
+	}
+
+	back, err := q.ListHashtagChirpsBefore(ctx, ListHashtagChirpsBeforeParams{
+		Tag:             tag,
+		CursorCreatedAt: nullTime(chirps[2].CreatedAt),
+		CursorID:        uuid.NullUUID{UUID: chirps[2].ID, Valid: true},
+		RowLimit:        5,
+	})
+	if err != nil {
+		t.Fatalf("ListHashtagChirpsBefore() error = %v", err)
+	}
+	if len(back) != 2 || back[0].ID != chirps[1].ID || back[1].ID != chirps[0].ID {
+		t.Errorf("ListHashtagChirpsBefore() = %+v, expected the first two chirps, newest first", back)
+	}
+}
+
+// chirpTags returns the tags stored for a chirp, sorted.
+func chirpTags(t *testing.T, chirpID uuid.UUID) []string {
+	t.Helper()
+	rows, err := testDB.Query("SELECT tag FROM chirp_hashtags WHERE chirp_id = $1 ORDER BY tag", chirpID)
+	if err != nil {
+		t.Fatalf("chirpTags() error = %v", err)
+	}
+	defer rows.Close()
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			t.Fatalf("chirpTags() error = %v", err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+func TestEditChirpHashtags(t *testing.T) {
+	q := newTestQueries(t)
+	ctx := context.Background()
+	user := createTestUser(t, q)
+	kept, dropped, added := testTag(), testTag(), testTag()
+	chirp := createTestChirp(t, q, user.ID, "#"+kept+" #"+dropped, []string{kept, dropped})
+	ageHashtag(t, kept, 1)
+
+	_, err := q.EditChirp(ctx, EditChirpParams{ID: chirp.ID, Body: "#" + kept + " #" + added, Hashtags: []string{kept, added}})
+	if err != nil {
+		t.Fatalf("EditChirp() error = %v", err)
+	}
+	expected := []string{kept, added}
+	slices.Sort(expected)
+	if got := chirpTags(t, chirp.ID); !slices.Equal(got, expected) {
+		t.Errorf("tags after the edit = %v, expected %v", got, expected)
+	}
+
+	// A new tag is dated by the chirp and a kept one isn't touched, so an
+	// edit can't push either up trending.
+	var dated []string
+	rows, err := testDB.Query("SELECT tag FROM chirp_hashtags WHERE chirp_id = $1 AND created_at = $2", chirp.ID, chirp.CreatedAt)
+	if err != nil {
+		t.Fatalf("listing tag dates error = %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			t.Fatalf("listing tag dates error = %v", err)
+		}
+		dated = append(dated, tag)
+	}
+	if !slices.Equal(dated, []string{added}) {
+		t.Errorf("tags dated by the chirp = %v, expected [%s]", dated, added)
+	}
+}
+
+func TestAddChirpHashtags(t *testing.T) {
+	q := newTestQueries(t)
+	ctx := context.Background()
+	user := createTestUser(t, q)
+	tag := testTag()
+	chirp := createTestChirp(t, q, user.ID, "#"+tag+" posted before tags were stored", nil)
+
+	// The backfill may run more than once.
+	for range 2 {
+		if err := q.AddChirpHashtags(ctx, AddChirpHashtagsParams{ChirpID: chirp.ID, Hashtags: []string{tag}}); err != nil {
+			t.Fatalf("AddChirpHashtags() error = %v", err)
+		}
+	}
+	if got := chirpTags(t, chirp.ID); !slices.Equal(got, []string{tag}) {
+		t.Errorf("tags = %v, expected [%s]", got, tag)
+	}
+}
@@ -0,0 +1,116 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestLikes(t *testing.T) {
+	q := newTestQueries(t)
+	ctx := context.Background()
+	alice := createTestUser(t, q)
+	bob := createTestUser(t, q)
+	liked := createTestChirp(t, q, alice.ID, "Like me", nil)
+	ignored := createTestChirp(t, q, alice.ID, "Nobody likes me", nil)
+	ids := []uuid.UUID{liked.ID, ignored.ID}
+
+	for _, user := range []User{alice, bob, bob} {
+		if err := q.LikeChirp(ctx, LikeChirpParams{UserID: user.ID, ChirpID: liked.ID}); err != nil {
+			t.Fatalf("LikeChirp() error = %v", err)
+		}
+	}
+	counts, err := q.CountChirpLikes(ctx, ids)
+	if err != nil {
+		t.Fatalf("CountChirpLikes() error = %v", err)
+	}
+	if len(counts) != 1 || counts[0].ChirpID != liked.ID || counts[0].LikeCount != 2 {
+		t.Errorf("CountChirpLikes() = %+v, expected 2 likes on %v only", counts, liked.ID)
+	}
+
+	likedIDs, err := q.ListLikedChirpIDs(ctx, ListLikedChirpIDsParams{UserID: bob.ID, ChirpIds: ids})
+	if err != nil {
+		t.Fatalf("ListLikedChirpIDs() error = %v", err)
+	}
+	if len(likedIDs) != 1 || likedIDs[0] != liked.ID {
+		t.Errorf("ListLikedChirpIDs() = %v, expected [%v]", likedIDs, liked.ID)
+	}
+
+	tests := []struct {
+		name            string
+		chirpID         uuid.UUID
+		expectedDeleted int64
+	}{
+		{name: "Liked chirp", chirpID: liked.ID, expectedDeleted: 1},
+		{name: "Already unliked", chirpID: liked.ID, expectedDeleted: 0},
+		{name: "Never liked", chirpID: ignored.ID, expectedDeleted: 0},
+	}
+	for _, tt := range tests {
+		deleted, err := q.UnlikeChirp(ctx, UnlikeChirpParams{UserID: bob.ID, ChirpID: tt.chirpID})
+		if err != nil {
+			t.Fatalf("%s: UnlikeChirp() error = %v", tt.name, err)
+		}
+		if deleted != tt.expectedDeleted {
+			t.Errorf("%s: UnlikeChirp() = %d, expected %d", tt.name, deleted, tt.expectedDeleted)
+		}
+	}
+	likedIDs, err = q.ListLikedChirpIDs(ctx, ListLikedChirpIDsParams{UserID: bob.ID, ChirpIds: ids})
+	if err != nil {
+		t.Fatalf("ListLikedChirpIDs() error = %v", err)
+	}
+	if len(likedIDs) != 0 {
+		t.Errorf("ListLikedChirpIDs() after unliking = %v, expected none", likedIDs)
+	}
+}
+
+func TestListUserLikes(t *testing.T) {
+	q := newTestQueries(t)
+	ctx := context.Background()
+	author := createTestUser(t, q)
+	reader := createTestUser(t, q)
+	chirps := []Chirp{
+		createTestChirp(t, q, author.ID, "First", nil),
+		createTestChirp(t, q, author.ID, "Second", nil),
+		createTestChirp(t, q, author.ID, "Third", nil),
+	}
+	// Liked in reverse, so the order must come from the likes.
+	for i := len(chirps) - 1; i >= 0; i-- {
+		if err := q.LikeChirp(ctx, LikeChirpParams{UserID: reader.ID, ChirpID: chirps[i].ID}); err != nil {
+			t.Fatalf("LikeChirp() error = %v", err)
+		}
+	}
+
+	first, err := q.ListUserLikesAfter(ctx, ListUserLikesAfterParams{UserID: reader.ID, RowLimit: 2})
+	if err != nil {
+		t.Fatalf("ListUserLikesAfter() error = %v", err)
+	}
+	if len(first) != 2 || first[0].ID != chirps[2].ID || first[1].ID != chirps[1].ID {
+		t.Fatalf("ListUserLikesAfter() = %+v, expected the last two chirps, in the order they were liked", first)
+	}
+	rest, err := q.ListUserLikesAfter(ctx, ListUserLikesAfterParams{
+		UserID:          reader.ID,
+		CursorCreatedAt: nullTime(first[1].LikedAt),
+		CursorID:        uuid.NullUUID{UUID: first[1].ID, Valid: true},
+		RowLimit:        2,
+	})
+	if err != nil {
+		t.Fatalf("ListUserLikesAfter() error = %v", err)
+	}
+	if len(rest) != 1 || rest[0].ID != chirps[0].ID {
+		t.Errorf("ListUserLikesAfter() from the cursor = %+v, expected the first chirp", rest)
+	}
+
+	back, err := q.ListUserLikesBefore(ctx, ListUserLikesBeforeParams{
+		UserID:          reader.ID,
+		CursorCreatedAt: nullTime(rest[0].LikedAt),
+		CursorID:        uuid.NullUUID{UUID: rest[0].ID, Valid: true},
+		RowLimit:        5,
+	})
+	if err != nil {
+		t.Fatalf("ListUserLikesBefore() error = %v", err)
+	}
+	if len(back) != 2 || back[0].ID != chirps[1].ID || back[1].ID != chirps[2].ID {
+		t.Errorf("ListUserLikesBefore() = %+v, expected the last two chirps, newest first", back)
+	}
+}
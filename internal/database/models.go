@@ -6,33 +6,171 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-type Chirp struct {
+type AuditEvent struct {
 	ID        uuid.UUID
 	CreatedAt time.Time
-	UpdatedAt time.Time
-	Body      string
+	EventType string
+	UserID    uuid.NullUUID
+	ActorID   uuid.NullUUID
+	Metadata  json.RawMessage
+	Ip        string
+	UserAgent string
+}
+
+type Chirp struct {
+	ID                uuid.UUID
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+	Body              string
+	UserID            uuid.UUID
+	EditedAt          sql.NullTime
+	ParentID          uuid.NullUUID
+	ThreadID          uuid.UUID
+	Kind              string
+	ReferencedChirpID uuid.NullUUID
+}
+
+type ChirpHashtag struct {
+	ChirpID   uuid.UUID
+	Tag       string
+	CreatedAt time.Time
+}
+
+type ChirpReaction struct {
 	UserID    uuid.UUID
+	ChirpID   uuid.UUID
+	Emoji     string
+	CreatedAt time.Time
 }
 
-type RefreshToken struct {
-	Token     string
+type ChirpRevision struct {
+	ID         uuid.UUID
+	ChirpID    uuid.UUID
+	Body       string
+	CreatedAt  time.Time
+	ReplacedAt time.Time
+}
+
+type EmailVerification struct {
+	TokenHash string
+	CreatedAt time.Time
+	UserID    uuid.UUID
+	Email     string
+	ExpiresAt time.Time
+	UsedAt    sql.NullTime
+}
+
+type Like struct {
+	UserID    uuid.UUID
+	ChirpID   uuid.UUID
+	CreatedAt time.Time
+}
+
+type LoginThrottle struct {
+	ThrottleKey   string
+	Failures      int32
+	LastFailureAt time.Time
+}
+
+type OauthAuthorizationCode struct {
+	CodeHash      string
+	CreatedAt     time.Time
+	ClientID      uuid.UUID
+	UserID        uuid.UUID
+	RedirectUri   string
+	Scopes        []string
+	CodeChallenge string
+	FamilyID      uuid.UUID
+	ExpiresAt     time.Time
+	UsedAt        sql.NullTime
+	Nonce         string
+}
+
+type OauthClient struct {
+	ID            uuid.UUID
+	CreatedAt     time.Time
+	OwnerID       uuid.UUID
+	Name          string
+	SecretHash    sql.NullString
+	RedirectUris  []string
+	Scopes        []string
+	CanIntrospect bool
+}
+
+type PasswordResetToken struct {
+	TokenHash string
 	CreatedAt time.Time
-	UpdatedAt time.Time
 	UserID    uuid.UUID
 	ExpiresAt time.Time
-	RevokedAt sql.NullTime
+	UsedAt    sql.NullTime
+}
+
+type PersonalAccessToken struct {
+	ID         uuid.UUID
+	CreatedAt  time.Time
+	UserID     uuid.UUID
+	Name       string
+	TokenHash  string
+	Scopes     []string
+	ExpiresAt  sql.NullTime
+	LastUsedAt sql.NullTime
+	RevokedAt  sql.NullTime
+}
+
+type ReactionSetting struct {
+	ID                   bool
+	AllowedEmoji         []string
+	MaxDistinctReactions int32
+	UpdatedAt            time.Time
+}
+
+type RefreshToken struct {
+	TokenHash  string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	UserID     uuid.UUID
+	ExpiresAt  time.Time
+	RevokedAt  sql.NullTime
+	FamilyID   uuid.UUID
+	CreatedIp  string
+	UserAgent  string
+	LastUsedAt time.Time
+	ClientID   uuid.NullUUID
+	Scopes     []string
+}
+
+type RevokedAccessToken struct {
+	Jti       string
+	UserID    uuid.UUID
+	RevokedAt time.Time
+	ExpiresAt time.Time
+}
+
+type TotpRecoveryCode struct {
+	ID        uuid.UUID
+	CreatedAt time.Time
+	UserID    uuid.UUID
+	CodeHash  string
+	UsedAt    sql.NullTime
 }
 
 type User struct {
-	ID             uuid.UUID
-	CreatedAt      time.Time
-	UpdatedAt      time.Time
-	Email          string
-	IsChirpyRed    bool
-	HashedPassword string
+	ID               uuid.UUID
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	Email            string
+	HashedPassword   string
+	IsChirpyRed      bool
+	EmailVerified    bool
+	TotpSecret       sql.NullString
+	TotpEnabled      bool
+	TotpLastStep     sql.NullInt64
+	Role             string
+	TokensValidAfter sql.NullTime
 }
@@ -0,0 +1,148 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// setReactionLimit changes the shared reaction settings for one test.
+func setReactionLimit(t *testing.T, q *Queries, maxDistinct int32) {
+	t.Helper()
+	ctx := context.Background()
+	old, err := q.GetReactionSettings(ctx)
+	if err != nil {
+		t.Fatalf("GetReactionSettings() error = %v", err)
+	}
+	_, err = q.UpdateReactionSettings(ctx, UpdateReactionSettingsParams{
+		AllowedEmoji:         old.AllowedEmoji,
+		MaxDistinctReactions: maxDistinct,
+	})
+	if err != nil {
+		t.Fatalf("UpdateReactionSettings() error = %v", err)
+	}
+	t.Cleanup(func() {
+		q.UpdateReactionSettings(ctx, UpdateReactionSettingsParams{
+			AllowedEmoji:         old.AllowedEmoji,
+			MaxDistinctReactions: old.MaxDistinctReactions,
+		})
+	})
+}
+
+func TestAddChirpReactionLimit(t *testing.T) {
+	q := newTestQueries(t)
+	ctx := context.Background()
+	setReactionLimit(t, q, 2)
+	alice := createTestUser(t, q)
+	bob := createTestUser(t, q)
+	chirp := createTestChirp(t, q, alice.ID, "React to me", nil)
+
+	tests := []struct {
+		name          string
+		user          User
+		emoji         string
+		expectedAdded int64
+	}{
+		{name: "First emoji", user: alice, emoji: "👍", expectedAdded: 1},
+		{name: "Second emoji", user: alice, emoji: "❤️", expectedAdded: 1},
+		{name: "Third emoji over the limit", user: bob, emoji: "😂", expectedAdded: 0},
+		{name: "Emoji the chirp already has", user: bob, emoji: "👍", expectedAdded: 1},
+		{name: "Same reaction again", user: alice, emoji: "👍", expectedAdded: 1},
+	}
+	for _, tt := range tests {
+		added, err := q.AddChirpReaction(ctx, AddChirpReactionParams{UserID: tt.user.ID, ChirpID: chirp.ID, Emoji: tt.emoji})
+		if err != nil {
+			t.Fatalf("%s: AddChirpReaction() error = %v", tt.name, err)
+		}
+		if added != tt.expectedAdded {
+			t.Errorf("%s: AddChirpReaction() = %d, expected %d", tt.name, added, tt.expectedAdded)
+		}
+	}
+
+	counts, err := q.CountChirpReactions(ctx, []uuid.UUID{chirp.ID})
+	if err != nil {
+		t.Fatalf("CountChirpReactions() error = %v", err)
+	}
+	got := map[string]int64{}
+	for _, row := range counts {
+		got[row.Emoji] = row.ReactionCount
+	}
+	if len(got) != 2 || got["👍"] != 2 || got["❤️"] != 1 {
+		t.Errorf("CountChirpReactions() = %v, expected 👍:2 ❤️:1", got)
+	}
+}
+
+func TestAddChirpReactionLimitConcurrent(t *testing.T) {
+	q := newTestQueries(t)
+	ctx := context.Background()
+	setReactionLimit(t, q, 1)
+	author := createTestUser(t, q)
+	chirp := createTestChirp(t, q, author.ID, "Only one kind of reaction", nil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := range 20 {
+		user := createTestUser(t, q)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := q.AddChirpReaction(ctx, AddChirpReactionParams{
+				UserID:  user.ID,
+				ChirpID: chirp.ID,
+				Emoji:   fmt.Sprintf("emoji-%d", i),
+			})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("AddChirpReaction() error = %v", err)
+		}
+	}
+
+	counts, err := q.CountChirpReactions(ctx, []uuid.UUID{chirp.ID})
+	if err != nil {
+		t.Fatalf("CountChirpReactions() error = %v", err)
+	}
+	if len(counts) != 1 {
+		t.Errorf("CountChirpReactions() = %v, expected a single emoji", counts)
+	}
+}
+
+func TestUpdateReactionSettings(t *testing.T) {
+	q := newTestQueries(t)
+	ctx := context.Background()
+	setReactionLimit(t, q, 3)
+
+	updated, err := q.UpdateReactionSettings(ctx, UpdateReactionSettingsParams{
+		AllowedEmoji:         []string{"🦀", "🐹"},
+		MaxDistinctReactions: 1,
+	})
+	if err != nil {
+		t.Fatalf("UpdateReactionSettings() error = %v", err)
+	}
+	settings, err := q.GetReactionSettings(ctx)
+	if err != nil {
+		t.Fatalf("GetReactionSettings() error = %v", err)
+	}
+	if !slices.Equal(settings.AllowedEmoji, []string{"🦀", "🐹"}) || settings.MaxDistinctReactions != 1 {
+		t.Errorf("GetReactionSettings() = %+v, expected the update", settings)
+	}
+	if !settings.UpdatedAt.Equal(updated.UpdatedAt) {
+		t.Errorf("GetReactionSettings() updated at %v, expected %v", settings.UpdatedAt, updated.UpdatedAt)
+	}
+
+	_, err = q.UpdateReactionSettings(ctx, UpdateReactionSettingsParams{
+		AllowedEmoji:         []string{"🦀"},
+		MaxDistinctReactions: 0,
+	})
+	if err == nil {
+		t.Errorf("UpdateReactionSettings() with no room for reactions succeeded")
+	}
+}
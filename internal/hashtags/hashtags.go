@@ -0,0 +1,59 @@
+package hashtags
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxLength is the longest tag, in runes. Longer ones aren't tags at all
+// rather than being cut short.
+const MaxLength = 100
+
+// Extract returns the tags in a chirp body, normalized and without repeats,
+// in the order they first appear. A tag is a # followed by letters, digits
+// and underscores, with at least one letter, and not glued to the end of a
+// word: "#Go" and "(#go)" are both "go", but "C#" and "#2024" aren't tags.
+func Extract(body string) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	prev := ' '
+	for i, r := range body {
+		if r == '#' && !isTagRune(prev) {
+			end := i + 1 + strings.IndexFunc(body[i+1:], func(r rune) bool { return !isTagRune(r) })
+			if end == i {
+				end = len(body)
+			}
+			if tag, ok := Normalize(body[i+1 : end]); ok && !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+		prev = r
+	}
+	return tags
+}
+
+// Normalize returns tag, with or without its leading #, in the form it's
+// stored and looked up by, and whether it is a valid tag at all.
+func Normalize(tag string) (string, bool) {
+	tag = strings.ToLower(strings.TrimPrefix(tag, "#"))
+	if tag == "" || utf8.RuneCountInString(tag) > MaxLength {
+		return "", false
+	}
+	hasLetter := false
+	for _, r := range tag {
+		if !isTagRune(r) {
+			return "", false
+		}
+		hasLetter = hasLetter || unicode.IsLetter(r)
+	}
+	if !hasLetter {
+		return "", false
+	}
+	return tag, true
+}
+
+func isTagRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,63 @@
+package hashtags
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected []string
+	}{
+		{"No tags", "just a chirp", []string{}},
+		{"Single tag", "learning #golang today", []string{"golang"}},
+		{"Lowercased", "#GoLang", []string{"golang"}},
+		{"Repeats dropped", "#go and #Go and #go", []string{"go"}},
+		{"Order kept", "#b #a #b #c", []string{"b", "a", "c"}},
+		{"Punctuation ends tag", "(#go), #rust!", []string{"go", "rust"}},
+		{"Underscores and digits", "#web_dev #go2", []string{"web_dev", "go2"}},
+		{"Unicode letters", "#Café #日本語", []string{"café", "日本語"}},
+		{"Digits only", "#2024 #1", []string{}},
+		{"Glued to word", "C# and foo#bar", []string{}},
+		{"Lone hash", "# #", []string{}},
+		{"Double hash", "##go", []string{"go"}},
+		{"Too long", "#" + strings.Repeat("a", MaxLength+1), []string{}},
+		{"Longest allowed", "#" + strings.Repeat("a", MaxLength), []string{strings.Repeat("a", MaxLength)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Extract(tt.body); !slices.Equal(got, tt.expected) {
+				t.Errorf("Extract(%q) = %q, expected %q", tt.body, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		tag      string
+		expected string
+		valid    bool
+	}{
+		{"Plain", "go", "go", true},
+		{"Leading hash", "#Go", "go", true},
+		{"Empty", "", "", false},
+		{"Just hash", "#", "", false},
+		{"Space", "go lang", "", false},
+		{"Digits only", "42", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, valid := Normalize(tt.tag)
+			if got != tt.expected || valid != tt.valid {
+				t.Errorf("Normalize(%q) = %q, %v, expected %q, %v", tt.tag, got, valid, tt.expected, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogMailer(t *testing.T) {
+	tests := []struct {
+		name          string
+		msg           Message
+		expectedError bool
+	}{
+		{
+			name:          "Valid message",
+			msg:           Message{To: "user@example.com", Subject: "Hello", Body: "Line one\nLine two"},
+			expectedError: false,
+		},
+		{
+			name:          "Header injection in subject",
+			msg:           Message{To: "user@example.com", Subject: "Hello\r\nBcc: evil@example.com", Body: "Hi"},
+			expectedError: true,
+		},
+		{
+			name:          "Header injection in recipient",
+			msg:           Message{To: "user@example.com\nBcc: evil@example.com", Subject: "Hello", Body: "Hi"},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			m := NewLogMailer(&buf, "chirpy@example.com")
+			err := m.Send(context.Background(), tt.msg)
+			if (err != nil) != tt.expectedError {
+				t.Errorf("Send() error = %v, expectedError %v", err, tt.expectedError)
+				return
+			}
+			if tt.expectedError {
+				if buf.Len() != 0 {
+					t.Errorf("Send() wrote %q for a rejected message", buf.String())
+				}
+				return
+			}
+			out := buf.String()
+			for _, want := range []string{"From: chirpy@example.com\r\n", "To: user@example.com\r\n", "Subject: Hello\r\n", "Line one\r\nLine two"} {
+				if !strings.Contains(out, want) {
+					t.Errorf("Send() output %q missing %q", out, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSMTPMailerTimeout(t *testing.T) {
+	// A server that accepts connections but never says hello.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	m := &SMTPMailer{Addr: ln.Addr().String(), From: "chirpy@example.com"}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = m.Send(ctx, Message{To: "user@example.com", Subject: "Hello", Body: "Hi"})
+	if err == nil {
+		t.Fatalf("Send() to a stalled server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Send() took %v, expected it to stop at the context deadline", elapsed)
+	}
+}
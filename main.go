@@ -1,52 +1,243 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
-	"sort"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/Numpkens/chirpy/internal/auth"
 	"github.com/Numpkens/chirpy/internal/database"
+	"github.com/Numpkens/chirpy/internal/hashtags"
+	"github.com/Numpkens/chirpy/internal/mailer"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
-type Chirp struct {
-	ID        uuid.UUID `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-	Body      string    `json:"body"`
-	UserID    uuid.UUID `json:"user_id"`
-}
-
 type User struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	Email        string    `json:"email"`
-	Token        string    `json:"token,omitempty"`
-	RefreshToken string    `json:"refresh_token,omitempty"`
-	IsChirpyRed  bool      `json:"is_chirpy_red"`
+	ID            uuid.UUID `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	Email         string    `json:"email"`
+	Token         string    `json:"token,omitempty"`
+	RefreshToken  string    `json:"refresh_token,omitempty"`
+	IsChirpyRed   bool      `json:"is_chirpy_red"`
+	EmailVerified bool      `json:"email_verified"`
+	PendingEmail  string    `json:"pending_email,omitempty"`
+	Role          string    `json:"role"`
 }
 
 type apiConfig struct {
 	fileserverHits atomic.Int32
-	db             *database.Queries
+	db             database.Querier
 	platform       string
-	jwtSecret      string
+	jwtKeys        *auth.KeySet
 	polkaKey       string
+	mailer         mailer.Mailer
+	publicURL      string
+	loginThrottle  auth.LoginThrottle
+	dummyHash      string
+	passwordParams auth.PasswordParams
+	passwordPolicy auth.PasswordPolicy
+	denylist       *auth.Denylist
+	// chirpEditWindow is how long after posting a chirp can be edited; zero
+	// means forever.
+	chirpEditWindow time.Duration
+}
+
+// Session is a login as seen by the user: one refresh token family, named by
+// its family ID.
+type Session struct {
+	ID         uuid.UUID `json:"id"`
+	StartedAt  time.Time `json:"started_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+}
+
+type Lockout struct {
+	Key           string    `json:"key"`
+	Failures      int32     `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	RetryAt       time.Time `json:"retry_at"`
+	Locked        bool      `json:"locked"`
+}
+
+// PersonalAccessToken is a long-lived token for scripts. Token is only set in
+// the response that creates it.
+type PersonalAccessToken struct {
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Token      string     `json:"token,omitempty"`
+}
+
+// principal is who a request is authenticated as. Access tokens from a login
+// carry every scope and have nil scopes; anything else is limited to the
+// scopes it lists.
+type principal struct {
+	UserID uuid.UUID
+	role   string
+	scopes []string
+	// tokenID and expiresAt identify the access token, if the request was
+	// made with one, so it can be revoked.
+	tokenID   string
+	expiresAt time.Time
+	// actorID is the admin acting as UserID, if the token is for
+	// impersonation.
+	actorID uuid.NullUUID
+}
+
+func (p principal) hasScope(scope string) bool {
+	return p.scopes == nil || slices.Contains(p.scopes, scope)
+}
+
+// isSession reports whether the request came from an interactive login, as
+// required for managing credentials and other tokens. An admin impersonating
+// the user isn't one.
+func (p principal) isSession() bool {
+	return p.scopes == nil && !p.actorID.Valid
+}
+
+func (p principal) impersonated() bool {
+	return p.actorID.Valid
+}
+
+// hasRole reports whether p may act with role's privileges. Only login
+// sessions carry a role; personal access tokens act as plain users.
+func (p principal) hasRole(role string) bool {
+	return p.isSession() && auth.HasRole(p.role, role)
+}
+
+type impersonationResponse struct {
+	UserID    uuid.UUID `json:"user_id"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type principalContextKey struct{}
+
+func principalFromContext(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalContextKey{}).(principal)
+	return p, ok
+}
+
+type mfaChallenge struct {
+	MFARequired    bool   `json:"mfa_required"`
+	ChallengeToken string `json:"challenge_token"`
 }
 
 type errorResponse struct {
-	Error string `json:"error"`
+	Error      string                   `json:"error"`
+	Violations []auth.PasswordViolation `json:"violations,omitempty"`
+}
+
+// AuditEvent is an entry in the security audit log. UserID is who the event
+// concerns and ActorID who caused it; either may be unknown.
+type AuditEvent struct {
+	ID        uuid.UUID       `json:"id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Type      string          `json:"type"`
+	UserID    *uuid.UUID      `json:"user_id"`
+	ActorID   *uuid.UUID      `json:"actor_id"`
+	IP        string          `json:"ip"`
+	UserAgent string          `json:"user_agent"`
+	Metadata  json.RawMessage `json:"metadata"`
+}
+
+type auditEventPage struct {
+	Events     []AuditEvent `json:"events"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+	PrevCursor string       `json:"prev_cursor,omitempty"`
+}
+
+// auditEvent is an event to be recorded by apiConfig.audit.
+type auditEvent struct {
+	Type     string
+	UserID   uuid.UUID
+	ActorID  uuid.UUID
+	Metadata map[string]any
+}
+
+// Audit event types.
+const (
+	auditLoginSucceeded       = "login.succeeded"
+	auditLoginFailed          = "login.failed"
+	auditLogout               = "logout"
+	auditTokenRefreshed       = "token.refreshed"
+	auditTokenReused          = "token.reuse_detected"
+	auditTokenRevoked         = "token.revoked"
+	auditSessionsRevoked      = "sessions.revoked"
+	auditPasswordChanged      = "password.changed"
+	auditPasswordReset        = "password.reset"
+	auditTOTPEnabled          = "totp.enabled"
+	auditTOTPDisabled         = "totp.disabled"
+	auditRoleChanged          = "role.changed"
+	auditChirpyRedUpgraded    = "chirpy_red.upgraded"
+	auditImpersonationStarted = "impersonation.started"
+	auditImpersonationWrite   = "impersonation.write"
+)
+
+const (
+	accessTokenTTL        = time.Hour
+	refreshTokenTTL       = 60 * 24 * time.Hour
+	passwordResetTTL      = time.Hour
+	emailVerificationTTL  = 24 * time.Hour
+	mfaChallengeTTL       = 5 * time.Minute
+	oauthCodeTTL          = 5 * time.Minute
+	impersonationTokenTTL = 15 * time.Minute
+	recoveryCodeCount     = 10
+	mailSendTimeout       = 30 * time.Second
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+	// A thread is cut off below maxThreadDepth levels of replies, and after
+	// maxThreadSize chirps.
+	maxThreadDepth = 20
+	maxThreadSize  = 500
+	// Admins can allow up to maxAllowedEmoji reactions, each a short
+	// sequence like a flag or a skin-toned emoji.
+	maxAllowedEmoji = 50
+	maxEmojiLength  = 32
+)
+
+// pageCursor is the position of a row in a (created_at, id) keyset. It is
+// handed to clients as an opaque base64 string.
+type pageCursor struct {
+	CreatedAt time.Time `json:"t"`
+	ID        uuid.UUID `json:"id"`
+	// Prev marks a cursor that pages backwards from this position.
+	Prev bool `json:"p,omitempty"`
+}
+
+type pageQuery struct {
+	cursor *pageCursor
+	limit  int
+	desc   bool
+	// all asks for every row in one go, for clients from before paging.
+	all bool
 }
 
 func (cfg *apiConfig) handlerWebhook(w http.ResponseWriter, r *http.Request) {
@@ -95,6 +286,11 @@ func (cfg *apiConfig) handlerWebhook(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't update user")
 		return
 	}
+	cfg.audit(r, auditEvent{
+		Type:     auditChirpyRedUpgraded,
+		UserID:   userID,
+		Metadata: map[string]any{"source": "polka"},
+	})
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -110,7 +306,11 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
 		return
 	}
-	hashedPassword, err := auth.HashPassword(params.Password)
+	if err := cfg.passwordPolicy.Validate(params.Password); err != nil {
+		respondWithPasswordError(w, err)
+		return
+	}
+	hashedPassword, err := auth.HashPassword(params.Password, cfg.passwordParams)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password")
 		return
@@ -123,12 +323,18 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create user")
 		return
 	}
+	if err := cfg.sendEmailVerification(r.Context(), user.ID, user.Email); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't send verification email")
+		return
+	}
 	respondWithJSON(w, http.StatusCreated, User{
-		ID:          user.ID,
-		CreatedAt:   user.CreatedAt,
-		UpdatedAt:   user.UpdatedAt,
-		Email:       user.Email,
-		IsChirpyRed: user.IsChirpyRed,
+		ID:            user.ID,
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+		Email:         user.Email,
+		IsChirpyRed:   user.IsChirpyRed,
+		EmailVerified: user.EmailVerified,
+		Role:          user.Role,
 	})
 }
 
@@ -143,45 +349,238 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
 		return
 	}
+	// Throttling is keyed on the email whether or not an account exists, so
+	// neither the delays nor the 401 reveal which addresses are registered.
+	throttleKeys := loginThrottleKeys(params.Email, r)
+	if !cfg.checkLoginThrottle(w, r, throttleKeys) {
+		return
+	}
 	user, err := cfg.db.GetUserByEmail(r.Context(), params.Email)
 	if err != nil {
+		// Hash anyway so a missing account takes as long as a wrong password.
+		auth.CheckPasswordHash(params.Password, cfg.dummyHash)
+		cfg.recordLoginFailure(r.Context(), throttleKeys)
+		// The log is append-only, so it never holds an address that may not
+		// belong to anyone; the IP still ties attempts together.
+		cfg.audit(r, auditEvent{
+			Type:     auditLoginFailed,
+			Metadata: map[string]any{"reason": "unknown_email"},
+		})
 		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password")
 		return
 	}
 	match, err := auth.CheckPasswordHash(params.Password, user.HashedPassword)
 	if err != nil || !match {
+		cfg.recordLoginFailure(r.Context(), throttleKeys)
+		cfg.audit(r, auditEvent{
+			Type:     auditLoginFailed,
+			UserID:   user.ID,
+			Metadata: map[string]any{"reason": "wrong_password"},
+		})
 		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password")
 		return
 	}
-	accessToken, _ := auth.MakeJWT(user.ID, cfg.jwtSecret, time.Hour)
-	refreshToken, _ := auth.MakeRefreshToken()
-	cfg.db.CreateRefreshToken(r.Context(), database.CreateRefreshTokenParams{
-		Token:     refreshToken,
-		UserID:    user.ID,
-		ExpiresAt: time.Now().UTC().AddDate(0, 0, 60),
+	cfg.db.ClearLoginThrottle(r.Context(), throttleKeys[0])
+	cfg.rehashPasswordIfNeeded(r.Context(), user, params.Password)
+	if user.TotpEnabled {
+		challenge, err := auth.MakeMFAChallenge(user.ID, cfg.jwtKeys, mfaChallengeTTL)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create challenge token")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, mfaChallenge{
+			MFARequired:    true,
+			ChallengeToken: challenge,
+		})
+		return
+	}
+	cfg.audit(r, auditEvent{
+		Type:     auditLoginSucceeded,
+		UserID:   user.ID,
+		ActorID:  user.ID,
+		Metadata: map[string]any{"method": "password"},
+	})
+	cfg.respondWithLogin(w, r, user)
+}
+
+// handlerLoginTOTP is the second step of a login for accounts with two-factor
+// authentication: the challenge token from handlerLogin plus a TOTP code or a
+// recovery code.
+func (cfg *apiConfig) handlerLoginTOTP(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	userID, err := auth.ValidateMFAChallenge(params.ChallengeToken, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid challenge token")
+		return
+	}
+	user, err := cfg.db.GetUserByID(r.Context(), userID)
+	if err != nil || !user.TotpEnabled {
+		respondWithError(w, http.StatusUnauthorized, "Invalid challenge token")
+		return
+	}
+	throttleKeys := loginThrottleKeys(user.Email, r)
+	if !cfg.checkLoginThrottle(w, r, throttleKeys) {
+		return
+	}
+	ok, err := cfg.checkSecondFactor(r.Context(), user, params.Code, params.RecoveryCode)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check code")
+		return
+	}
+	if !ok {
+		cfg.recordLoginFailure(r.Context(), throttleKeys)
+		cfg.audit(r, auditEvent{
+			Type:     auditLoginFailed,
+			UserID:   user.ID,
+			Metadata: map[string]any{"reason": "wrong_code"},
+		})
+		respondWithError(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+	cfg.db.ClearLoginThrottle(r.Context(), throttleKeys[0])
+	cfg.audit(r, auditEvent{
+		Type:     auditLoginSucceeded,
+		UserID:   user.ID,
+		ActorID:  user.ID,
+		Metadata: map[string]any{"method": secondFactorMethod(params.RecoveryCode)},
+	})
+	cfg.respondWithLogin(w, r, user)
+}
+
+// rehashPasswordIfNeeded upgrades a stored hash made with weaker argon2id
+// parameters than the configured ones. It runs after a successful login, the
+// only time we have the plaintext. Failures are logged and the login goes on.
+func (cfg *apiConfig) rehashPasswordIfNeeded(ctx context.Context, user database.User, password string) {
+	needsRehash, err := auth.NeedsRehash(user.HashedPassword, cfg.passwordParams)
+	if err != nil || !needsRehash {
+		return
+	}
+	hashedPassword, err := auth.HashPassword(password, cfg.passwordParams)
+	if err != nil {
+		log.Printf("Couldn't rehash password for %s: %v", user.ID, err)
+		return
+	}
+	err = cfg.db.UpdateUserPassword(ctx, database.UpdateUserPasswordParams{
+		ID:             user.ID,
+		HashedPassword: hashedPassword,
 	})
+	if err != nil {
+		log.Printf("Couldn't save rehashed password for %s: %v", user.ID, err)
+	}
+}
+
+// loginThrottleKeys returns the throttle keys for a login attempt: the email
+// first, then the client IP. Only the email key is cleared by a successful
+// login; the IP key has to age out, or an attacker could reset it with an
+// account of their own.
+func loginThrottleKeys(email string, r *http.Request) []string {
+	return []string{
+		"email:" + strings.ToLower(strings.TrimSpace(email)),
+		"ip:" + clientIP(r),
+	}
+}
+
+// loginRetryAt returns when the next login attempt for keys is allowed. It
+// is no later than now if one is allowed already.
+func (cfg *apiConfig) loginRetryAt(ctx context.Context, keys []string) (time.Time, error) {
+	throttles, err := cfg.db.GetLoginThrottles(ctx, keys)
+	if err != nil {
+		return time.Time{}, err
+	}
+	now := time.Now().UTC()
+	retryAt := now
+	for _, throttle := range throttles {
+		if throttle.LastFailureAt.Before(cfg.loginThrottle.WindowStart(now)) {
+			continue
+		}
+		if t := cfg.loginThrottle.RetryAt(int(throttle.Failures), throttle.LastFailureAt); t.After(retryAt) {
+			retryAt = t
+		}
+	}
+	return retryAt, nil
+}
+
+// checkLoginThrottle answers 429 and returns false if any of keys has to wait
+// before trying again.
+func (cfg *apiConfig) checkLoginThrottle(w http.ResponseWriter, r *http.Request, keys []string) bool {
+	retryAt, err := cfg.loginRetryAt(r.Context(), keys)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check login attempts")
+		return false
+	}
+	now := time.Now().UTC()
+	if !retryAt.After(now) {
+		return true
+	}
+	seconds := int(math.Ceil(retryAt.Sub(now).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	respondWithError(w, http.StatusTooManyRequests, "Too many login attempts, try again later")
+	return false
+}
+
+func (cfg *apiConfig) recordLoginFailure(ctx context.Context, keys []string) {
+	windowStart := cfg.loginThrottle.WindowStart(time.Now().UTC())
+	for _, key := range keys {
+		_, err := cfg.db.RecordLoginFailure(ctx, database.RecordLoginFailureParams{
+			ThrottleKey: key,
+			WindowStart: windowStart,
+		})
+		if err != nil {
+			log.Printf("Couldn't record login failure for %s: %v", key, err)
+		}
+	}
+}
+
+// respondWithLogin starts a new session for user and returns its tokens.
+func (cfg *apiConfig) respondWithLogin(w http.ResponseWriter, r *http.Request, user database.User) {
+	accessToken, err := auth.MakeJWT(user.ID, cfg.jwtKeys, accessTokenTTL, auth.WithRole(user.Role))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create access token")
+		return
+	}
+	refreshToken, err := cfg.createRefreshToken(r, user.ID, uuid.New())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token")
+		return
+	}
 	respondWithJSON(w, http.StatusOK, User{
-		ID:           user.ID,
-		CreatedAt:    user.CreatedAt,
-		UpdatedAt:    user.UpdatedAt,
-		Email:        user.Email,
-		Token:        accessToken,
-		RefreshToken: refreshToken,
-		IsChirpyRed:  user.IsChirpyRed,
+		ID:            user.ID,
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+		Email:         user.Email,
+		Token:         accessToken,
+		RefreshToken:  refreshToken,
+		IsChirpyRed:   user.IsChirpyRed,
+		EmailVerified: user.EmailVerified,
+		Role:          user.Role,
 	})
 }
 
 func (cfg *apiConfig) handlerUsersUpdate(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
+	caller, err := cfg.authenticate(r)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+	if !caller.hasScope(auth.ScopeProfileWrite) {
+		respondWithError(w, http.StatusForbidden, "Insufficient scope")
 		return
 	}
+	if caller.impersonated() {
+		respondWithError(w, http.StatusForbidden, "Not allowed while impersonating")
+		return
+	}
+	userID := caller.UserID
 	type parameters struct {
 		Password string `json:"password"`
 		Email    string `json:"email"`
@@ -192,38 +591,177 @@ func (cfg *apiConfig) handlerUsersUpdate(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
 		return
 	}
-	hashed, _ := auth.HashPassword(params.Password)
+	current, err := cfg.db.GetUserByID(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if err := cfg.passwordPolicy.Validate(params.Password); err != nil {
+		respondWithPasswordError(w, err)
+		return
+	}
+	samePassword, err := auth.CheckPasswordHash(params.Password, current.HashedPassword)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check password")
+		return
+	}
+	hashed, err := auth.HashPassword(params.Password, cfg.passwordParams)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password")
+		return
+	}
+	// The email only changes once the new address is confirmed.
 	user, err := cfg.db.UpdateUser(r.Context(), database.UpdateUserParams{
 		ID:             userID,
-		Email:          params.Email,
+		Email:          current.Email,
 		HashedPassword: hashed,
 	})
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error updating user")
 		return
 	}
+	// A new password logs out every session, including this one. A login
+	// session gets fresh tokens back so it can carry on.
+	accessToken, refreshToken := "", ""
+	if !samePassword {
+		if err := cfg.db.RevokeUserSessions(r.Context(), user.ID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions")
+			return
+		}
+		cutoff, err := cfg.invalidateUserTokens(r.Context(), user.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions")
+			return
+		}
+		if err := cfg.db.InvalidateEmailVerifications(r.Context(), user.ID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions")
+			return
+		}
+		cfg.audit(r, auditEvent{Type: auditPasswordChanged, UserID: user.ID, ActorID: user.ID})
+		if caller.isSession() {
+			accessToken, err = auth.MakeJWT(user.ID, cfg.jwtKeys, accessTokenTTL,
+				auth.WithRole(user.Role), auth.WithIssuedAfter(cutoff))
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't create access token")
+				return
+			}
+			refreshToken, err = cfg.createRefreshToken(r, user.ID, uuid.New())
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token")
+				return
+			}
+		}
+	}
+
+	// Sent after any password change, which would otherwise cancel it.
+	pendingEmail := ""
+	if params.Email != "" && params.Email != user.Email {
+		if err := cfg.sendEmailVerification(r.Context(), user.ID, params.Email); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't send verification email")
+			return
+		}
+		pendingEmail = params.Email
+	}
 	respondWithJSON(w, http.StatusOK, User{
-		ID:          user.ID,
-		CreatedAt:   user.CreatedAt,
-		UpdatedAt:   user.UpdatedAt,
-		Email:       user.Email,
-		IsChirpyRed: user.IsChirpyRed,
+		ID:            user.ID,
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+		Email:         user.Email,
+		Token:         accessToken,
+		RefreshToken:  refreshToken,
+		IsChirpyRed:   user.IsChirpyRed,
+		EmailVerified: user.EmailVerified,
+		Role:          user.Role,
+		PendingEmail:  pendingEmail,
 	})
 }
 
-func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
+// handlerVerifyEmail takes the token from the query string, so the link in the
+// verification email works when clicked, or from a JSON body.
+func (cfg *apiConfig) handlerVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+	params := parameters{Token: r.URL.Query().Get("token")}
+	if params.Token == "" {
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&params); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+	}
+	verification, err := cfg.db.UseEmailVerification(r.Context(), auth.HashToken(params.Token))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check verification token")
+		return
+	}
+	// A link sent before the user's credentials last changed does nothing,
+	// since whoever asked for it may have lost access since.
+	user, err := cfg.db.VerifyUserEmail(r.Context(), database.VerifyUserEmailParams{
+		ID:          verification.UserID,
+		Email:       verification.Email,
+		RequestedAt: verification.CreatedAt,
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+			return
+		}
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			respondWithError(w, http.StatusConflict, "Email already in use")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't verify email")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, User{
+		ID:            user.ID,
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+		Email:         user.Email,
+		IsChirpyRed:   user.IsChirpyRed,
+		EmailVerified: user.EmailVerified,
+		Role:          user.Role,
+	})
+}
+
+func (cfg *apiConfig) handlerVerifyEmailResend(w http.ResponseWriter, r *http.Request) {
+	caller, err := cfg.authenticate(r)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if !caller.hasScope(auth.ScopeProfileWrite) {
+		respondWithError(w, http.StatusForbidden, "Insufficient scope")
+		return
+	}
+	userID := caller.UserID
+	user, err := cfg.db.GetUserByID(r.Context(), userID)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
+	if user.EmailVerified {
+		respondWithError(w, http.StatusBadRequest, "Email already verified")
+		return
+	}
+	if err := cfg.sendEmailVerification(r.Context(), user.ID, user.Email); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't send verification email")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlerPasswordResetRequest always answers 202 so the endpoint can't be used
+// to find out which emails have accounts.
+func (cfg *apiConfig) handlerPasswordResetRequest(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
-		Body string `json:"body"`
+		Email string `json:"email"`
 	}
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
@@ -231,101 +769,88 @@ func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request
 		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
 		return
 	}
-	dbChirp, err := cfg.db.CreateChirp(r.Context(), database.CreateChirpParams{
-		Body:   getCleanedBody(params.Body),
-		UserID: userID,
+	// Everything after the lookup happens in the background, so the response
+	// time is the same whether or not the account exists.
+	if user, err := cfg.db.GetUserByEmail(r.Context(), params.Email); err == nil {
+		go cfg.sendPasswordReset(user.ID, user.Email)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (cfg *apiConfig) sendPasswordReset(userID uuid.UUID, email string) {
+	token, err := auth.MakeOpaqueToken()
+	if err != nil {
+		log.Printf("Couldn't create reset token: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mailSendTimeout)
+	defer cancel()
+	err = cfg.db.CreatePasswordResetToken(ctx, database.CreatePasswordResetTokenParams{
+		TokenHash: auth.HashToken(token),
+		UserID:    userID,
+		ExpiresAt: time.Now().UTC().Add(passwordResetTTL),
 	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error creating chirp")
+		log.Printf("Couldn't create reset token: %v", err)
 		return
 	}
-	respondWithJSON(w, http.StatusCreated, Chirp{
-		ID:        dbChirp.ID,
-		CreatedAt: dbChirp.CreatedAt,
-		UpdatedAt: dbChirp.UpdatedAt,
-		Body:      dbChirp.Body,
-		UserID:    dbChirp.UserID,
+	cfg.sendMail(mailer.Message{
+		To:      email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf("Someone asked to reset the password for your Chirpy account.\n\n"+
+			"To choose a new password, send this token with your new password to %s/api/password-reset/confirm:\n\n"+
+			"%s\n\nThe token expires in one hour. If you didn't ask for this, you can ignore this email.\n",
+			cfg.publicURL, token),
 	})
 }
 
-func (cfg *apiConfig) handlerChirpsGet(w http.ResponseWriter, r *http.Request) {
-	authorIDStr := r.URL.Query().Get("author_id")
-	sortOrder := r.URL.Query().Get("sort")
-
-	var dbChirps []database.Chirp
-	var err error
-
-	if authorIDStr != "" {
-		authorID, err := uuid.Parse(authorIDStr)
-		if err != nil {
-			respondWithError(w, http.StatusBadRequest, "Invalid author ID")
-			return
-		}
-		dbChirps, err = cfg.db.GetChirpsByAuthorID(r.Context(), authorID)
-	} else {
-		dbChirps, err = cfg.db.GetChirps(r.Context())
+func (cfg *apiConfig) handlerPasswordResetConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
 	}
-
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error fetching chirps")
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
 		return
 	}
-
-	chirps := []Chirp{}
-	for _, dbChirp := range dbChirps {
-		chirps = append(chirps, Chirp{
-			ID:        dbChirp.ID,
-			CreatedAt: dbChirp.CreatedAt,
-			UpdatedAt: dbChirp.UpdatedAt,
-			Body:      dbChirp.Body,
-			UserID:    dbChirp.UserID,
-		})
+	// Checked before the token is spent, so a rejected password can be retried.
+	if err := cfg.passwordPolicy.Validate(params.Password); err != nil {
+		respondWithPasswordError(w, err)
+		return
 	}
-
-	sort.Slice(chirps, func(i, j int) bool {
-		if sortOrder == "desc" {
-			return chirps[i].CreatedAt.After(chirps[j].CreatedAt)
-		}
-		return chirps[i].CreatedAt.Before(chirps[j].CreatedAt)
-	})
-
-	respondWithJSON(w, http.StatusOK, chirps)
-}
-
-func (cfg *apiConfig) handlerChirpsGetOne(w http.ResponseWriter, r *http.Request) {
-	id, err := uuid.Parse(r.PathValue("chirpID"))
+	userID, err := cfg.db.UsePasswordResetToken(r.Context(), auth.HashToken(params.Token))
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID")
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check reset token")
 		return
 	}
-	dbChirp, err := cfg.db.GetChirp(r.Context(), id)
+	hashedPassword, err := auth.HashPassword(params.Password, cfg.passwordParams)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Not found")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password")
 		return
 	}
-	respondWithJSON(w, http.StatusOK, Chirp{
-		ID:        dbChirp.ID,
-		CreatedAt: dbChirp.CreatedAt,
-		UpdatedAt: dbChirp.UpdatedAt,
-		Body:      dbChirp.Body,
-		UserID:    dbChirp.UserID,
+	err = cfg.db.UpdateUserPassword(r.Context(), database.UpdateUserPasswordParams{
+		ID:             userID,
+		HashedPassword: hashedPassword,
 	})
-}
-
-func (cfg *apiConfig) handlerChirpsDelete(w http.ResponseWriter, r *http.Request) {
-	id, _ := uuid.Parse(r.PathValue("chirpID"))
-	token, _ := auth.GetBearerToken(r.Header)
-	userID, _ := auth.ValidateJWT(token, cfg.jwtSecret)
-	chirp, err := cfg.db.GetChirp(r.Context(), id)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Not found")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update password")
 		return
 	}
-	if chirp.UserID != userID {
-		respondWithError(w, http.StatusForbidden, "Forbidden")
-		return
+	// Whoever asked for the reset may not be the only one with access to the
+	// account, so every other way in is closed.
+	cfg.db.InvalidatePasswordResetTokens(r.Context(), userID)
+	cfg.db.InvalidateEmailVerifications(r.Context(), userID)
+	cfg.db.RevokeUserSessions(r.Context(), userID)
+	if _, err := cfg.invalidateUserTokens(r.Context(), userID); err != nil {
+		log.Printf("Couldn't invalidate access tokens for %s: %v", userID, err)
 	}
-	cfg.db.DeleteChirp(r.Context(), database.DeleteChirpParams{ID: id, UserID: userID})
+	cfg.audit(r, auditEvent{Type: auditPasswordReset, UserID: userID})
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -335,37 +860,1181 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Missing token")
 		return
 	}
-	user, err := cfg.db.GetUserFromRefreshToken(r.Context(), token)
+	storedToken, err := cfg.useRefreshToken(r, token, uuid.NullUUID{})
+	if err != nil {
+		if errors.Is(err, errInvalidRefreshToken) {
+			respondWithError(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't rotate refresh token")
+		return
+	}
+
+	// The role is read again on every refresh, so role changes reach the
+	// user within an access token's lifetime.
+	user, err := cfg.db.GetUserByID(r.Context(), storedToken.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user")
+		return
+	}
+	accessToken, err := auth.MakeJWT(user.ID, cfg.jwtKeys, accessTokenTTL, auth.WithRole(user.Role))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create access token")
+		return
+	}
+	refreshToken, err := cfg.createRefreshToken(r, storedToken.UserID, storedToken.FamilyID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid token")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token")
 		return
 	}
-	accessToken, _ := auth.MakeJWT(user.ID, cfg.jwtSecret, time.Hour)
+	cfg.audit(r, auditEvent{
+		Type:     auditTokenRefreshed,
+		UserID:   user.ID,
+		ActorID:  user.ID,
+		Metadata: map[string]any{"family_id": storedToken.FamilyID},
+	})
 	respondWithJSON(w, http.StatusOK, struct {
-		Token string `json:"token"`
-	}{Token: accessToken})
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{Token: accessToken, RefreshToken: refreshToken})
 }
 
-func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
-	token, _ := auth.GetBearerToken(r.Header)
-	cfg.db.RevokeRefreshToken(r.Context(), token)
-	w.WriteHeader(http.StatusNoContent)
-}
+var errInvalidRefreshToken = errors.New("invalid refresh token")
 
-func (cfg *apiConfig) handlerMetrics(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Content-Type", "text/html")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "<html><body><h1>Welcome, Chirpy Admin</h1><p>Chirpy has been visited %d times!</p></body></html>", cfg.fileserverHits.Load())
+// useRefreshToken spends a refresh token issued to clientID, or to a
+// first-party login if clientID is null, and returns it so a replacement can
+// be issued in the same family.
+func (cfg *apiConfig) useRefreshToken(r *http.Request, token string, clientID uuid.NullUUID) (database.RefreshToken, error) {
+	ctx := r.Context()
+	tokenHash := auth.HashToken(token)
+	storedToken, err := cfg.db.GetRefreshToken(ctx, tokenHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return database.RefreshToken{}, errInvalidRefreshToken
+		}
+		return database.RefreshToken{}, err
+	}
+	if storedToken.ClientID != clientID {
+		return database.RefreshToken{}, errInvalidRefreshToken
+	}
+	if storedToken.RevokedAt.Valid {
+		// A rotated token should never come back. If it does, someone else
+		// holds a copy, so shut down every token descended from the login.
+		cfg.db.RevokeRefreshTokenFamily(ctx, storedToken.FamilyID)
+		cfg.auditRefreshTokenReuse(r, storedToken)
+		return database.RefreshToken{}, errInvalidRefreshToken
+	}
+	if storedToken.ExpiresAt.Before(time.Now().UTC()) {
+		return database.RefreshToken{}, errInvalidRefreshToken
+	}
+
+	// Another request may have rotated the token since we read it; that is
+	// reuse as well.
+	if _, err := cfg.db.RotateRefreshToken(ctx, tokenHash); err != nil {
+		if err == sql.ErrNoRows {
+			cfg.db.RevokeRefreshTokenFamily(ctx, storedToken.FamilyID)
+			cfg.auditRefreshTokenReuse(r, storedToken)
+			return database.RefreshToken{}, errInvalidRefreshToken
+		}
+		return database.RefreshToken{}, err
+	}
+	return storedToken, nil
+}
+
+func (cfg *apiConfig) auditRefreshTokenReuse(r *http.Request, storedToken database.RefreshToken) {
+	metadata := map[string]any{"family_id": storedToken.FamilyID}
+	if storedToken.ClientID.Valid {
+		metadata["client_id"] = storedToken.ClientID.UUID
+	}
+	cfg.audit(r, auditEvent{Type: auditTokenReused, UserID: storedToken.UserID, Metadata: metadata})
+}
+
+func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
+	token, _ := auth.GetBearerToken(r.Header)
+	storedToken, err := cfg.db.RevokeRefreshToken(r.Context(), auth.HashToken(token))
+	if err == nil {
+		cfg.audit(r, auditEvent{
+			Type:     auditTokenRevoked,
+			UserID:   storedToken.UserID,
+			ActorID:  storedToken.UserID,
+			Metadata: map[string]any{"family_id": storedToken.FamilyID},
+		})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createRefreshToken issues a new refresh token in the given family. Logins
+// start a new family; rotations continue the family of the token they replace.
+// The request's IP and user agent are recorded for the session list.
+func (cfg *apiConfig) createRefreshToken(r *http.Request, userID, familyID uuid.UUID) (string, error) {
+	return cfg.issueRefreshToken(r, database.CreateRefreshTokenParams{
+		UserID:   userID,
+		FamilyID: familyID,
+	})
+}
+
+// issueRefreshToken stores a new refresh token for the user, family and, for
+// OAuth grants, client and scopes in params. The token itself, its expiry and
+// the request details are filled in here.
+func (cfg *apiConfig) issueRefreshToken(r *http.Request, params database.CreateRefreshTokenParams) (string, error) {
+	refreshToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	params.TokenHash = auth.HashToken(refreshToken)
+	params.ExpiresAt = time.Now().UTC().Add(refreshTokenTTL)
+	params.CreatedIp = clientIP(r)
+	params.UserAgent = r.UserAgent()
+	if _, err := cfg.db.CreateRefreshToken(r.Context(), params); err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
+
+func (cfg *apiConfig) handlerTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	caller, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !caller.isSession() {
+		respondWithError(w, http.StatusForbidden, "Requires a login session")
+		return
+	}
+	userID := caller.UserID
+	user, err := cfg.db.GetUserByID(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create secret")
+		return
+	}
+	updated, err := cfg.db.SetTOTPSecret(r.Context(), database.SetTOTPSecretParams{
+		ID:         user.ID,
+		TotpSecret: sql.NullString{String: secret, Valid: true},
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save secret")
+		return
+	}
+	if updated == 0 {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication already enabled")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+	}{
+		Secret:     secret,
+		OTPAuthURI: auth.TOTPURI("Chirpy", user.Email, secret),
+	})
+}
+
+// handlerTOTPConfirm turns two-factor authentication on once the user proves
+// their authenticator works, and hands out the recovery codes. They are only
+// ever shown here.
+func (cfg *apiConfig) handlerTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	caller, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !caller.isSession() {
+		respondWithError(w, http.StatusForbidden, "Requires a login session")
+		return
+	}
+	userID := caller.UserID
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	user, err := cfg.db.GetUserByID(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if user.TotpEnabled {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication already enabled")
+		return
+	}
+	if !user.TotpSecret.Valid {
+		respondWithError(w, http.StatusBadRequest, "No enrollment in progress")
+		return
+	}
+	ok, err := cfg.checkSecondFactor(r.Context(), user, params.Code, "")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check code")
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid code")
+		return
+	}
+
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create recovery codes")
+		return
+	}
+	if err := cfg.db.DeleteRecoveryCodes(r.Context(), user.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save recovery codes")
+		return
+	}
+	for _, code := range codes {
+		err := cfg.db.CreateRecoveryCode(r.Context(), database.CreateRecoveryCodeParams{
+			UserID:   user.ID,
+			CodeHash: auth.HashToken(auth.NormalizeRecoveryCode(code)),
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't save recovery codes")
+			return
+		}
+	}
+	if err := cfg.db.EnableTOTP(r.Context(), user.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't enable two-factor authentication")
+		return
+	}
+	cfg.audit(r, auditEvent{Type: auditTOTPEnabled, UserID: user.ID, ActorID: user.ID})
+	respondWithJSON(w, http.StatusOK, struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{RecoveryCodes: codes})
+}
+
+func (cfg *apiConfig) handlerTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	caller, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !caller.isSession() {
+		respondWithError(w, http.StatusForbidden, "Requires a login session")
+		return
+	}
+	userID := caller.UserID
+	type parameters struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	user, err := cfg.db.GetUserByID(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !user.TotpEnabled {
+		respondWithError(w, http.StatusBadRequest, "Two-factor authentication not enabled")
+		return
+	}
+	ok, err := cfg.checkSecondFactor(r.Context(), user, params.Code, params.RecoveryCode)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check code")
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid code")
+		return
+	}
+	if err := cfg.db.DisableTOTP(r.Context(), user.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't disable two-factor authentication")
+		return
+	}
+	cfg.db.DeleteRecoveryCodes(r.Context(), user.ID)
+	cfg.audit(r, auditEvent{Type: auditTOTPDisabled, UserID: user.ID, ActorID: user.ID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery
+// code. Both are single use: a TOTP time step can't be used twice.
+func (cfg *apiConfig) checkSecondFactor(ctx context.Context, user database.User, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		step, ok := auth.ValidateTOTP(user.TotpSecret.String, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		updated, err := cfg.db.UseTOTPStep(ctx, database.UseTOTPStepParams{
+			ID:           user.ID,
+			TotpLastStep: sql.NullInt64{Int64: step, Valid: true},
+		})
+		if err != nil {
+			return false, err
+		}
+		return updated == 1, nil
+	}
+	if recoveryCode != "" {
+		updated, err := cfg.db.UseRecoveryCode(ctx, database.UseRecoveryCodeParams{
+			UserID:   user.ID,
+			CodeHash: auth.HashToken(auth.NormalizeRecoveryCode(recoveryCode)),
+		})
+		if err != nil {
+			return false, err
+		}
+		return updated == 1, nil
+	}
+	return false, nil
+}
+
+func (cfg *apiConfig) handlerSessionsList(w http.ResponseWriter, r *http.Request) {
+	caller, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !caller.isSession() {
+		respondWithError(w, http.StatusForbidden, "Requires a login session")
+		return
+	}
+	userID := caller.UserID
+	dbSessions, err := cfg.db.ListUserSessions(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching sessions")
+		return
+	}
+	sessions := []Session{}
+	for _, dbSession := range dbSessions {
+		sessions = append(sessions, Session{
+			ID:         dbSession.FamilyID,
+			StartedAt:  dbSession.StartedAt,
+			LastUsedAt: dbSession.LastUsedAt,
+			ExpiresAt:  dbSession.ExpiresAt,
+			IP:         dbSession.CreatedIp,
+			UserAgent:  dbSession.UserAgent,
+		})
+	}
+	respondWithJSON(w, http.StatusOK, sessions)
+}
+
+func (cfg *apiConfig) handlerSessionsDelete(w http.ResponseWriter, r *http.Request) {
+	caller, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !caller.isSession() {
+		respondWithError(w, http.StatusForbidden, "Requires a login session")
+		return
+	}
+	userID := caller.UserID
+	sessionID, err := uuid.Parse(r.PathValue("sessionID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	revoked, err := cfg.db.RevokeUserSession(r.Context(), database.RevokeUserSessionParams{
+		FamilyID: sessionID,
+		UserID:   userID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session")
+		return
+	}
+	if revoked == 0 {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	cfg.audit(r, auditEvent{
+		Type:     auditSessionsRevoked,
+		UserID:   userID,
+		ActorID:  userID,
+		Metadata: map[string]any{"family_id": sessionID},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerSessionsDeleteAll logs the user out everywhere by revoking every
+// refresh token they hold.
+func (cfg *apiConfig) handlerSessionsDeleteAll(w http.ResponseWriter, r *http.Request) {
+	caller, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !caller.isSession() {
+		respondWithError(w, http.StatusForbidden, "Requires a login session")
+		return
+	}
+	userID := caller.UserID
+	if err := cfg.db.RevokeUserSessions(r.Context(), userID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions")
+		return
+	}
+	if _, err := cfg.invalidateUserTokens(r.Context(), userID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions")
+		return
+	}
+	cfg.audit(r, auditEvent{
+		Type:     auditSessionsRevoked,
+		UserID:   userID,
+		ActorID:  userID,
+		Metadata: map[string]any{"all": true},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerLogout revokes the access token it is called with, and the login
+// behind the refresh token if one is given.
+func (cfg *apiConfig) handlerLogout(w http.ResponseWriter, r *http.Request) {
+	caller, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if caller.tokenID == "" {
+		respondWithError(w, http.StatusBadRequest, "Not an access token; revoke personal access tokens through /api/tokens")
+		return
+	}
+	type parameters struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil && err != io.EOF {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	if err := cfg.revokeAccessToken(r.Context(), caller.UserID, caller.tokenID, caller.expiresAt); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke token")
+		return
+	}
+	metadata := map[string]any{"token_id": caller.tokenID}
+	if params.RefreshToken != "" {
+		storedToken, err := cfg.db.GetRefreshToken(r.Context(), auth.HashToken(params.RefreshToken))
+		if err == nil && storedToken.UserID == caller.UserID {
+			if err := cfg.db.RevokeRefreshTokenFamily(r.Context(), storedToken.FamilyID); err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't revoke refresh token")
+				return
+			}
+			metadata["family_id"] = storedToken.FamilyID
+		}
+	}
+	cfg.audit(r, auditEvent{Type: auditLogout, UserID: caller.UserID, ActorID: caller.UserID, Metadata: metadata})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) revokeAccessToken(ctx context.Context, userID uuid.UUID, jti string, expiresAt time.Time) error {
+	err := cfg.db.RevokeAccessToken(ctx, database.RevokeAccessTokenParams{
+		Jti:       jti,
+		UserID:    userID,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	cfg.denylist.Revoke(jti, expiresAt)
+	return nil
+}
+
+// invalidateUserTokens rejects every access token issued to the user so far,
+// and returns the cutoff; tokens issued in reply to the same request must be
+// made with auth.WithIssuedAfter(cutoff). Refresh tokens are not touched;
+// revoke them separately where needed.
+func (cfg *apiConfig) invalidateUserTokens(ctx context.Context, userID uuid.UUID) (time.Time, error) {
+	// Token issue times are whole seconds, so tokens issued later in the
+	// cutoff's second are rejected too. Better that than letting one issued
+	// earlier in it survive.
+	cutoff := time.Now().UTC()
+	err := cfg.db.InvalidateUserTokens(ctx, database.InvalidateUserTokensParams{
+		ID:               userID,
+		TokensValidAfter: sql.NullTime{Time: cutoff, Valid: true},
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	cfg.denylist.RevokeIssuedBefore(userID, cutoff)
+	return cutoff, nil
+}
+
+// refreshDenylist loads revocations from the database into the in-memory
+// denylist, picking up those made by other instances, and deletes the ones
+// that have expired.
+func (cfg *apiConfig) refreshDenylist(ctx context.Context) error {
+	now := time.Now().UTC()
+	revoked, err := cfg.db.ListRevokedAccessTokens(ctx, now)
+	if err != nil {
+		return err
+	}
+	cutoffs, err := cfg.db.ListTokenCutoffs(ctx, sql.NullTime{Time: now.Add(-accessTokenTTL), Valid: true})
+	if err != nil {
+		return err
+	}
+	tokens := map[string]time.Time{}
+	for _, token := range revoked {
+		tokens[token.Jti] = token.ExpiresAt
+	}
+	users := map[uuid.UUID]time.Time{}
+	for _, cutoff := range cutoffs {
+		users[cutoff.ID] = cutoff.TokensValidAfter.Time
+	}
+	cfg.denylist.Load(tokens, users, now)
+	return cfg.db.DeleteExpiredRevokedAccessTokens(ctx, now)
+}
+
+// audit appends event to the security audit log, with the IP and user agent
+// of r. A zero UserID or ActorID is recorded as unknown. Failures are logged
+// and returned, but most callers carry on regardless.
+func (cfg *apiConfig) audit(r *http.Request, event auditEvent) error {
+	metadata := json.RawMessage("{}")
+	if event.Metadata != nil {
+		var err error
+		metadata, err = json.Marshal(event.Metadata)
+		if err != nil {
+			log.Printf("Couldn't encode %s audit event: %v", event.Type, err)
+			return err
+		}
+	}
+	err := cfg.db.CreateAuditEvent(r.Context(), database.CreateAuditEventParams{
+		EventType: event.Type,
+		UserID:    uuid.NullUUID{UUID: event.UserID, Valid: event.UserID != uuid.Nil},
+		ActorID:   uuid.NullUUID{UUID: event.ActorID, Valid: event.ActorID != uuid.Nil},
+		Ip:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Metadata:  metadata,
+	})
+	if err != nil {
+		log.Printf("Couldn't record %s audit event: %v", event.Type, err)
+	}
+	return err
+}
+
+// secondFactorMethod names the second factor used for the audit log.
+func secondFactorMethod(recoveryCode string) string {
+	if recoveryCode != "" {
+		return "recovery_code"
+	}
+	return "totp"
+}
+
+// authenticate accepts an access token from a login or an OAuth client, or a
+// personal access token, as the bearer token.
+func (cfg *apiConfig) authenticate(r *http.Request) (principal, error) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return principal{}, err
+	}
+	if auth.IsPersonalAccessToken(token) {
+		pat, err := cfg.db.GetActivePersonalAccessToken(r.Context(), auth.HashToken(token))
+		if err != nil {
+			return principal{}, err
+		}
+		if err := cfg.db.TouchPersonalAccessToken(r.Context(), pat.ID); err != nil {
+			log.Printf("Error recording token use: %s", err)
+		}
+		scopes := pat.Scopes
+		if scopes == nil {
+			scopes = []string{}
+		}
+		return principal{UserID: pat.UserID, role: auth.RoleUser, scopes: scopes}, nil
+	}
+	claims, err := auth.ValidateJWT(token, cfg.jwtKeys, cfg.denylist)
+	if err != nil {
+		return principal{}, err
+	}
+	caller := principal{
+		UserID:    claims.UserID,
+		role:      claims.Role,
+		tokenID:   claims.ID,
+		expiresAt: claims.ExpiresAt.Time,
+		actorID:   claims.ActorID,
+	}
+	if claims.ClientID != "" {
+		caller.role = auth.RoleUser
+		caller.scopes = strings.Fields(claims.Scope)
+		if caller.scopes == nil {
+			caller.scopes = []string{}
+		}
+	}
+	return caller, nil
+}
+
+func (cfg *apiConfig) handlerTokensCreate(w http.ResponseWriter, r *http.Request) {
+	caller, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !caller.isSession() {
+		respondWithError(w, http.StatusForbidden, "Requires a login session")
+		return
+	}
+
+	type parameters struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	name := strings.TrimSpace(params.Name)
+	if name == "" || len(name) > 100 {
+		respondWithError(w, http.StatusBadRequest, "Name must be between 1 and 100 characters")
+		return
+	}
+	scopes, err := auth.NormalizeScopes(params.Scopes)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(scopes) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one scope is required")
+		return
+	}
+	if params.ExpiresInDays < 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid expiry")
+		return
+	}
+	expiresAt := sql.NullTime{}
+	if params.ExpiresInDays > 0 {
+		expiresAt = sql.NullTime{
+			Time:  time.Now().UTC().AddDate(0, 0, params.ExpiresInDays),
+			Valid: true,
+		}
+	}
+
+	token, err := auth.MakePersonalAccessToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create token")
+		return
+	}
+	dbToken, err := cfg.db.CreatePersonalAccessToken(r.Context(), database.CreatePersonalAccessTokenParams{
+		UserID:    caller.UserID,
+		Name:      name,
+		TokenHash: auth.HashToken(token),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create token")
+		return
+	}
+	resp := personalAccessTokenFromDB(dbToken)
+	resp.Token = token
+	respondWithJSON(w, http.StatusCreated, resp)
+}
+
+func (cfg *apiConfig) handlerTokensList(w http.ResponseWriter, r *http.Request) {
+	caller, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !caller.isSession() {
+		respondWithError(w, http.StatusForbidden, "Requires a login session")
+		return
+	}
+	dbTokens, err := cfg.db.ListPersonalAccessTokens(r.Context(), caller.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching tokens")
+		return
+	}
+	tokens := []PersonalAccessToken{}
+	for _, dbToken := range dbTokens {
+		tokens = append(tokens, personalAccessTokenFromDB(dbToken))
+	}
+	respondWithJSON(w, http.StatusOK, tokens)
+}
+
+func (cfg *apiConfig) handlerTokensDelete(w http.ResponseWriter, r *http.Request) {
+	caller, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !caller.isSession() {
+		respondWithError(w, http.StatusForbidden, "Requires a login session")
+		return
+	}
+	tokenID, err := uuid.Parse(r.PathValue("tokenID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	revoked, err := cfg.db.RevokePersonalAccessToken(r.Context(), database.RevokePersonalAccessTokenParams{
+		ID:     tokenID,
+		UserID: caller.UserID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke token")
+		return
+	}
+	if revoked == 0 {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func personalAccessTokenFromDB(t database.PersonalAccessToken) PersonalAccessToken {
+	return PersonalAccessToken{
+		ID:         t.ID,
+		Name:       t.Name,
+		Scopes:     t.Scopes,
+		CreatedAt:  t.CreatedAt,
+		ExpiresAt:  nullTimePtr(t.ExpiresAt),
+		LastUsedAt: nullTimePtr(t.LastUsedAt),
+	}
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// sendEmailVerification mails a confirmation link for email. The user's
+// address is set to it, and marked verified, once the token comes back.
+// Links sent earlier that haven't been used stop working.
+func (cfg *apiConfig) sendEmailVerification(ctx context.Context, userID uuid.UUID, email string) error {
+	token, err := auth.MakeOpaqueToken()
+	if err != nil {
+		return err
+	}
+	err = cfg.db.CreateEmailVerification(ctx, database.CreateEmailVerificationParams{
+		TokenHash: auth.HashToken(token),
+		UserID:    userID,
+		Email:     email,
+		ExpiresAt: time.Now().UTC().Add(emailVerificationTTL),
+	})
+	if err != nil {
+		return err
+	}
+	go cfg.sendMail(mailer.Message{
+		To:      email,
+		Subject: "Confirm your Chirpy email address",
+		Body: fmt.Sprintf("Please confirm this email address for your Chirpy account by opening this link:\n\n"+
+			"%s/api/users/verify-email?token=%s\n\nThe link expires in 24 hours. If you didn't ask for this, you can ignore this email.\n",
+			cfg.publicURL, token),
+	})
+	return nil
+}
+
+func (cfg *apiConfig) sendMail(msg mailer.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), mailSendTimeout)
+	defer cancel()
+	if err := cfg.mailer.Send(ctx, msg); err != nil {
+		log.Printf("Couldn't send mail to %s: %v", msg.To, err)
+	}
+}
+
+func (cfg *apiConfig) handlerMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/html")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "<html><body><h1>Welcome, Chirpy Admin</h1><p>Chirpy has been visited %d times!</p></body></html>", cfg.fileserverHits.Load())
+}
+
+func (cfg *apiConfig) handlerReset(w http.ResponseWriter, r *http.Request) {
+	if cfg.platform != "dev" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	cfg.db.ResetUsers(r.Context())
+	cfg.fileserverHits.Store(0)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (cfg *apiConfig) handlerJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, cfg.jwtKeys.JWKS())
+}
+
+// handlerLockoutsList shows every email and IP with recent failed logins and
+// whether it is currently delayed or locked out.
+func (cfg *apiConfig) handlerLockoutsList(w http.ResponseWriter, r *http.Request) {
+	windowStart := cfg.loginThrottle.WindowStart(time.Now().UTC())
+	throttles, err := cfg.db.ListLoginThrottles(r.Context(), windowStart)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching lockouts")
+		return
+	}
+	lockouts := []Lockout{}
+	for _, throttle := range throttles {
+		lockouts = append(lockouts, Lockout{
+			Key:           throttle.ThrottleKey,
+			Failures:      throttle.Failures,
+			LastFailureAt: throttle.LastFailureAt,
+			RetryAt:       cfg.loginThrottle.RetryAt(int(throttle.Failures), throttle.LastFailureAt),
+			Locked:        cfg.loginThrottle.Locked(int(throttle.Failures)),
+		})
+	}
+	respondWithJSON(w, http.StatusOK, lockouts)
+}
+
+func (cfg *apiConfig) handlerLockoutsDelete(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.db.ClearLoginThrottle(r.Context(), r.PathValue("key")); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't clear lockout")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerUserRoleUpdate sets another user's role. Admins can't change their
+// own, so there is always at least one admin left to undo a mistake.
+func (cfg *apiConfig) handlerUserRoleUpdate(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	if userID == caller.UserID {
+		respondWithError(w, http.StatusBadRequest, "Can't change your own role")
+		return
+	}
+
+	type parameters struct {
+		Role string `json:"role"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if !auth.ValidRole(params.Role) {
+		respondWithError(w, http.StatusBadRequest, "Invalid role")
+		return
+	}
+
+	user, err := cfg.db.UpdateUserRole(r.Context(), database.UpdateUserRoleParams{
+		ID:   userID,
+		Role: params.Role,
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update role")
+		return
+	}
+	// Access tokens carry the role, so ones with the old role must go.
+	if _, err := cfg.invalidateUserTokens(r.Context(), user.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke old tokens")
+		return
+	}
+	cfg.audit(r, auditEvent{
+		Type:     auditRoleChanged,
+		UserID:   user.ID,
+		ActorID:  caller.UserID,
+		Metadata: map[string]any{"role": user.Role},
+	})
+	respondWithJSON(w, http.StatusOK, User{
+		ID:            user.ID,
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+		Email:         user.Email,
+		IsChirpyRed:   user.IsChirpyRed,
+		EmailVerified: user.EmailVerified,
+		Role:          user.Role,
+	})
+}
+
+// handlerAuditEventsList lets admins search the audit log by user_id,
+// actor_id, type and ip.
+func (cfg *apiConfig) handlerAuditEventsList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userID, actorID := uuid.NullUUID{}, uuid.NullUUID{}
+	for _, filter := range []struct {
+		name string
+		dest *uuid.NullUUID
+	}{{"user_id", &userID}, {"actor_id", &actorID}} {
+		if str := query.Get(filter.name); str != "" {
+			id, err := uuid.Parse(str)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid "+filter.name)
+				return
+			}
+			*filter.dest = uuid.NullUUID{UUID: id, Valid: true}
+		}
+	}
+	cfg.respondWithAuditEvents(w, r, userID, actorID, query.Get("ip"))
+}
+
+// handlerAuditEventsListOwn returns the caller's security history: events
+// concerning their account, whoever caused them.
+func (cfg *apiConfig) handlerAuditEventsListOwn(w http.ResponseWriter, r *http.Request) {
+	caller, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !caller.isSession() {
+		respondWithError(w, http.StatusForbidden, "Requires a login session")
+		return
+	}
+	cfg.respondWithAuditEvents(w, r, uuid.NullUUID{UUID: caller.UserID, Valid: true}, uuid.NullUUID{}, "")
+}
+
+// respondWithAuditEvents answers with a page of audit events matching the
+// given filters and the request's type filter.
+func (cfg *apiConfig) respondWithAuditEvents(w http.ResponseWriter, r *http.Request, userID, actorID uuid.NullUUID, ip string) {
+	page, err := parsePageQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	eventType := r.URL.Query().Get("type")
+
+	cursorCreatedAt, cursorID := page.cursorParams()
+	var dbEvents []database.AuditEvent
+	if page.ascending() {
+		dbEvents, err = cfg.db.ListAuditEventsAfter(r.Context(), database.ListAuditEventsAfterParams{
+			UserID:          userID,
+			ActorID:         actorID,
+			EventType:       sql.NullString{String: eventType, Valid: eventType != ""},
+			Ip:              sql.NullString{String: ip, Valid: ip != ""},
+			CursorCreatedAt: cursorCreatedAt,
+			CursorID:        cursorID,
+			RowLimit:        page.fetchLimit(),
+		})
+	} else {
+		dbEvents, err = cfg.db.ListAuditEventsBefore(r.Context(), database.ListAuditEventsBeforeParams{
+			UserID:          userID,
+			ActorID:         actorID,
+			EventType:       sql.NullString{String: eventType, Valid: eventType != ""},
+			Ip:              sql.NullString{String: ip, Valid: ip != ""},
+			CursorCreatedAt: cursorCreatedAt,
+			CursorID:        cursorID,
+			RowLimit:        page.fetchLimit(),
+		})
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching audit events")
+		return
+	}
+
+	dbEvents, next, prev := buildPage(page, dbEvents, func(e database.AuditEvent) pageCursor {
+		return pageCursor{CreatedAt: e.CreatedAt, ID: e.ID}
+	})
+	events := []AuditEvent{}
+	for _, e := range dbEvents {
+		events = append(events, AuditEvent{
+			ID:        e.ID,
+			CreatedAt: e.CreatedAt,
+			Type:      e.EventType,
+			UserID:    nullUUIDPtr(e.UserID),
+			ActorID:   nullUUIDPtr(e.ActorID),
+			IP:        e.Ip,
+			UserAgent: e.UserAgent,
+			Metadata:  e.Metadata,
+		})
+	}
+	respondWithJSON(w, http.StatusOK, auditEventPage{
+		Events:     events,
+		NextCursor: next,
+		PrevCursor: prev,
+	})
+}
+
+func nullUUIDPtr(id uuid.NullUUID) *uuid.UUID {
+	if !id.Valid {
+		return nil
+	}
+	return &id.UUID
+}
+
+// handlerServiceClientsCreate registers a confidential client for another
+// service. It can't take part in authorization flows, having no redirect
+// URIs, but may introspect tokens.
+func (cfg *apiConfig) handlerServiceClientsCreate(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+	type parameters struct {
+		Name string `json:"name"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	name := strings.TrimSpace(params.Name)
+	if name == "" || len(name) > 100 {
+		respondWithError(w, http.StatusBadRequest, "Name must be between 1 and 100 characters")
+		return
+	}
+	secret, err := auth.MakeOpaqueToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create client")
+		return
+	}
+	client, err := cfg.db.CreateOAuthClient(r.Context(), database.CreateOAuthClientParams{
+		OwnerID:       caller.UserID,
+		Name:          name,
+		SecretHash:    sql.NullString{String: auth.HashToken(secret), Valid: true},
+		RedirectUris:  []string{},
+		Scopes:        []string{},
+		CanIntrospect: true,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create client")
+		return
+	}
+	resp := oauthClientFromDB(client)
+	resp.ClientSecret = secret
+	respondWithJSON(w, http.StatusCreated, resp)
 }
 
-func (cfg *apiConfig) handlerReset(w http.ResponseWriter, r *http.Request) {
-	if cfg.platform != "dev" {
-		w.WriteHeader(http.StatusForbidden)
+// handlerImpersonate issues the admin a short-lived access token for another
+// user. Its act claim names the admin, and every write made with it is
+// recorded by middlewareAuditImpersonation.
+func (cfg *apiConfig) handlerImpersonate(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+	type parameters struct {
+		UserID uuid.UUID `json:"user_id"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
 		return
 	}
-	cfg.db.ResetUsers(r.Context())
-	cfg.fileserverHits.Store(0)
-	w.WriteHeader(http.StatusOK)
+	if params.UserID == caller.UserID {
+		respondWithError(w, http.StatusBadRequest, "Can't impersonate yourself")
+		return
+	}
+	user, err := cfg.db.GetUserByID(r.Context(), params.UserID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find user")
+		return
+	}
+
+	token, err := auth.MakeJWT(user.ID, cfg.jwtKeys, impersonationTokenTTL, auth.WithActor(caller.UserID))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create token")
+		return
+	}
+	claims, err := auth.ValidateJWT(token, cfg.jwtKeys, nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create token")
+		return
+	}
+	err = cfg.audit(r, auditEvent{
+		Type:     auditImpersonationStarted,
+		UserID:   user.ID,
+		ActorID:  caller.UserID,
+		Metadata: map[string]any{"token_id": claims.ID},
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record impersonation")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, impersonationResponse{
+		UserID:    user.ID,
+		Token:     token,
+		ExpiresAt: claims.ExpiresAt.Time,
+	})
+}
+
+// middlewareAuditImpersonation records every write made with an
+// impersonation token before letting it through. A write that can't be
+// recorded isn't made.
+func (cfg *apiConfig) middlewareAuditImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil || auth.IsPersonalAccessToken(token) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Invalid tokens are left for the handler to reject.
+		claims, err := auth.ValidateJWT(token, cfg.jwtKeys, cfg.denylist)
+		if err != nil || !claims.ActorID.Valid {
+			next.ServeHTTP(w, r)
+			return
+		}
+		err = cfg.audit(r, auditEvent{
+			Type:     auditImpersonationWrite,
+			UserID:   claims.UserID,
+			ActorID:  claims.ActorID.UUID,
+			Metadata: map[string]any{"token_id": claims.ID, "method": r.Method, "path": r.URL.Path},
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't record impersonation")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// middlewareRequireRole only lets requests through from a login session with
+// at least the given role. The handler can get the caller from the request
+// context with principalFromContext.
+func (cfg *apiConfig) middlewareRequireRole(role string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, err := cfg.authenticate(r)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		if !caller.hasRole(role) {
+			respondWithError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+		ctx := context.WithValue(r.Context(), principalContextKey{}, caller)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// middlewareRequireScope only lets requests through from callers granted the
+// given scope. The handler can get the caller from the request context with
+// principalFromContext.
+func (cfg *apiConfig) middlewareRequireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, err := cfg.authenticate(r)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		if !caller.hasScope(scope) {
+			respondWithError(w, http.StatusForbidden, "Insufficient scope")
+			return
+		}
+		ctx := context.WithValue(r.Context(), principalContextKey{}, caller)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// middlewareRequireVerified only lets requests through from callers who have
+// verified their email. It goes inside middlewareRequireScope, which puts the
+// caller in the request context.
+func (cfg *apiConfig) middlewareRequireVerified(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := principalFromContext(r.Context())
+		if !ok {
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		user, err := cfg.db.GetUserByID(r.Context(), caller.UserID)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		if !user.EmailVerified {
+			respondWithError(w, http.StatusForbidden, "Email not verified")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
@@ -384,6 +2053,18 @@ func respondWithError(w http.ResponseWriter, code int, msg string) {
 	respondWithJSON(w, code, errorResponse{Error: msg})
 }
 
+func respondWithPasswordError(w http.ResponseWriter, err error) {
+	var policyErr *auth.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		respondWithJSON(w, http.StatusBadRequest, errorResponse{
+			Error:      "Password does not meet requirements",
+			Violations: policyErr.Violations,
+		})
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, "Couldn't check password")
+}
+
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	dat, _ := json.Marshal(payload)
 	w.Header().Set("Content-Type", "application/json")
@@ -391,53 +2072,584 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Write(dat)
 }
 
-func getCleanedBody(body string) string {
-	badWords := map[string]struct{}{"kerfuffle": {}, "sharbert": {}, "fornax": {}}
-	words := strings.Split(body, " ")
-	for i, word := range words {
-		if _, ok := badWords[strings.ToLower(word)]; ok {
-			words[i] = "****"
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func encodeCursor(c pageCursor) string {
+	dat, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(dat)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	c := pageCursor{}
+	dat, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(dat, &c); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+func parsePageQuery(r *http.Request) (pageQuery, error) {
+	query := r.URL.Query()
+	page := pageQuery{limit: defaultPageLimit}
+
+	switch query.Get("sort") {
+	case "", "asc":
+	case "desc":
+		page.desc = true
+	default:
+		return page, fmt.Errorf("invalid sort order")
+	}
+
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			return page, fmt.Errorf("invalid limit")
+		}
+		page.limit = min(limit, maxPageLimit)
+	}
+
+	if cursorStr := query.Get("cursor"); cursorStr != "" {
+		cursor, err := decodeCursor(cursorStr)
+		if err != nil {
+			return page, fmt.Errorf("invalid cursor")
+		}
+		page.cursor = &cursor
+	}
+
+	return page, nil
+}
+
+// ascending reports whether rows should be fetched in ascending keyset order.
+// Paging backwards through a descending list walks forwards through the
+// table, and vice versa.
+func (p pageQuery) ascending() bool {
+	prev := p.cursor != nil && p.cursor.Prev
+	return p.desc == prev
+}
+
+// fetchLimit asks for one extra row so we can tell whether another page exists.
+func (p pageQuery) fetchLimit() int32 {
+	if p.all {
+		return math.MaxInt32
+	}
+	return int32(p.limit + 1)
+}
+
+func (p pageQuery) cursorParams() (sql.NullTime, uuid.NullUUID) {
+	if p.cursor == nil {
+		return sql.NullTime{}, uuid.NullUUID{}
+	}
+	return sql.NullTime{Time: p.cursor.CreatedAt, Valid: true},
+		uuid.NullUUID{UUID: p.cursor.ID, Valid: true}
+}
+
+// buildPage trims the extra row fetched by fetchLimit, puts the rows back in
+// display order and works out the cursors for the neighbouring pages.
+func buildPage[T any](p pageQuery, rows []T, key func(T) pageCursor) ([]T, string, string) {
+	prev := p.cursor != nil && p.cursor.Prev
+	hasMore := !p.all && len(rows) > p.limit
+	if hasMore {
+		rows = rows[:p.limit]
+	}
+	if prev {
+		slices.Reverse(rows)
+	}
+	if len(rows) == 0 {
+		return rows, "", ""
+	}
+
+	first := key(rows[0])
+	first.Prev = true
+	last := key(rows[len(rows)-1])
+
+	nextCursor, prevCursor := "", ""
+	if prev {
+		nextCursor = encodeCursor(last)
+		if hasMore {
+			prevCursor = encodeCursor(first)
+		}
+	} else {
+		if hasMore {
+			nextCursor = encodeCursor(last)
+		}
+		if p.cursor != nil {
+			prevCursor = encodeCursor(first)
+		}
+	}
+	return rows, nextCursor, prevCursor
+}
+
+// setPageLinks points the Link header at the next and previous pages of r,
+// where there are any.
+func setPageLinks(w http.ResponseWriter, r *http.Request, nextCursor, prevCursor string) {
+	for _, link := range []struct{ rel, cursor string }{{"next", nextCursor}, {"prev", prevCursor}} {
+		if link.cursor == "" {
+			continue
+		}
+		query := r.URL.Query()
+		query.Set("cursor", link.cursor)
+		w.Header().Add("Link", fmt.Sprintf(`<%s?%s>; rel="%s"`, r.URL.Path, query.Encode(), link.rel))
+	}
+}
+
+// loadJWTKeys signs with HS256 and JWT_SECRET unless a key directory is
+// configured. When both are set the secret still validates tokens that were
+// issued before the switch, which carry no kid.
+func loadJWTKeys(secret, keysDir, signingKeyID string) (*auth.KeySet, error) {
+	if keysDir == "" {
+		return auth.NewHMACKeySet(secret), nil
+	}
+	keys, err := auth.LoadKeySet(keysDir, signingKeyID)
+	if err != nil {
+		return nil, err
+	}
+	if secret != "" {
+		if err := keys.Add(auth.NewHMACKey(secret)); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// newMailer picks the mail transport from MAILER. Anything other than "smtp"
+// writes messages to MAIL_LOG_FILE, or to stdout if that is unset.
+func newMailer() (mailer.Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if os.Getenv("MAILER") == "smtp" {
+		return &mailer.SMTPMailer{
+			Addr:     os.Getenv("SMTP_ADDR"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}, nil
+	}
+	path := os.Getenv("MAIL_LOG_FILE")
+	if path == "" {
+		return mailer.NewLogMailer(os.Stdout, from), nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return mailer.NewLogMailer(f, from), nil
+}
+
+// loginThrottleFromEnv reads the LOGIN_* settings, falling back to
+// auth.DefaultLoginThrottle for anything unset.
+func loginThrottleFromEnv() (auth.LoginThrottle, error) {
+	throttle := auth.DefaultLoginThrottle()
+	var err error
+	if throttle.FreeAttempts, err = envInt("LOGIN_FREE_ATTEMPTS", throttle.FreeAttempts); err != nil {
+		return throttle, err
+	}
+	if throttle.BaseDelay, err = envDuration("LOGIN_BASE_DELAY", throttle.BaseDelay); err != nil {
+		return throttle, err
+	}
+	if throttle.MaxDelay, err = envDuration("LOGIN_MAX_DELAY", throttle.MaxDelay); err != nil {
+		return throttle, err
+	}
+	if throttle.LockoutThreshold, err = envInt("LOGIN_LOCKOUT_THRESHOLD", throttle.LockoutThreshold); err != nil {
+		return throttle, err
+	}
+	if throttle.LockoutDuration, err = envDuration("LOGIN_LOCKOUT_DURATION", throttle.LockoutDuration); err != nil {
+		return throttle, err
+	}
+	return throttle, nil
+}
+
+// passwordParamsFromEnv reads ARGON2_MEMORY (KiB), ARGON2_ITERATIONS and
+// ARGON2_PARALLELISM, falling back to auth.DefaultPasswordParams.
+func passwordParamsFromEnv() (auth.PasswordParams, error) {
+	params := auth.DefaultPasswordParams()
+	memory, err := envInt("ARGON2_MEMORY", int(params.Memory))
+	if err != nil {
+		return params, err
+	}
+	iterations, err := envInt("ARGON2_ITERATIONS", int(params.Iterations))
+	if err != nil {
+		return params, err
+	}
+	parallelism, err := envInt("ARGON2_PARALLELISM", int(params.Parallelism))
+	if err != nil {
+		return params, err
+	}
+	if memory < 1 || iterations < 1 || parallelism < 1 || parallelism > math.MaxUint8 {
+		return params, fmt.Errorf("argon2id parameters out of range")
+	}
+	params.Memory = uint32(memory)
+	params.Iterations = uint32(iterations)
+	params.Parallelism = uint8(parallelism)
+	return params, nil
+}
+
+// passwordPolicyFromEnv reads PASSWORD_MIN_LENGTH, PASSWORD_MIN_ENTROPY and
+// BREACHED_PASSWORDS_FILE. Outside dev the breach check is required: the
+// file must be set, and can only be skipped by setting it to "off".
+func passwordPolicyFromEnv(platform string) (auth.PasswordPolicy, error) {
+	policy := auth.DefaultPasswordPolicy()
+	var err error
+	if policy.MinLength, err = envInt("PASSWORD_MIN_LENGTH", policy.MinLength); err != nil {
+		return policy, err
+	}
+	if minEntropy := os.Getenv("PASSWORD_MIN_ENTROPY"); minEntropy != "" {
+		if policy.MinEntropyBits, err = strconv.ParseFloat(minEntropy, 64); err != nil {
+			return policy, fmt.Errorf("PASSWORD_MIN_ENTROPY: %w", err)
+		}
+	}
+	switch path := os.Getenv("BREACHED_PASSWORDS_FILE"); path {
+	case "off":
+		log.Printf("Breached password check is off")
+	case "":
+		if platform != "dev" {
+			return policy, fmt.Errorf(`BREACHED_PASSWORDS_FILE: not set; point it at a hash file, or set it to "off"`)
+		}
+	default:
+		if policy.Breached, err = auth.OpenBreachedPasswords(path); err != nil {
+			return policy, fmt.Errorf("BREACHED_PASSWORDS_FILE: %w", err)
+		}
+	}
+	return policy, nil
+}
+
+func envInt(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return n, nil
+}
+
+func envDuration(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return d, nil
+}
+
+func runCommand(args []string) error {
+	switch args[0] {
+	case "keygen":
+		return commandKeygen(args[1:])
+	case "set-role":
+		return commandSetRole(args[1:])
+	case "backfill-hashtags":
+		return commandBackfillHashtags(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// commandKeygen writes a new signing key into the key directory. Point
+// JWT_SIGNING_KEY_ID at it and restart to start signing with it; delete the
+// previous key once the tokens it signed have expired.
+func commandKeygen(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	alg := flags.String("alg", "EdDSA", "signing algorithm: EdDSA or RS256")
+	dir := flags.String("dir", os.Getenv("JWT_KEYS_DIR"), "key directory")
+	flags.Parse(args)
+
+	if *dir == "" {
+		return fmt.Errorf("no key directory: pass -dir or set JWT_KEYS_DIR")
+	}
+	kid, dat, err := auth.GenerateSigningKey(*alg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*dir, 0o700); err != nil {
+		return err
+	}
+	path := filepath.Join(*dir, kid+".pem")
+	if err := os.WriteFile(path, dat, 0o600); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\nSet JWT_SIGNING_KEY_ID=%s to sign with it.\n", path, kid)
+	return nil
+}
+
+// commandSetRole changes the role of an existing user. It is how the first
+// admin is created: sign up as usual, then run
+//
+//	chirpy set-role -email you@example.com -role admin
+func commandSetRole(args []string) error {
+	flags := flag.NewFlagSet("set-role", flag.ExitOnError)
+	email := flags.String("email", "", "email of the user to change")
+	role := flags.String("role", auth.RoleAdmin, "new role: user or admin")
+	flags.Parse(args)
+
+	if *email == "" {
+		return fmt.Errorf("no user: pass -email")
+	}
+	if !auth.ValidRole(*role) {
+		return fmt.Errorf("unknown role %q", *role)
+	}
+	db, err := sql.Open("postgres", os.Getenv("DB_URL"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	dbQueries := database.New(db)
+
+	ctx := context.Background()
+	user, err := dbQueries.GetUserByEmail(ctx, *email)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("no user with email %q", *email)
+		}
+		return err
+	}
+	if _, err := dbQueries.UpdateUserRole(ctx, database.UpdateUserRoleParams{
+		ID:   user.ID,
+		Role: *role,
+	}); err != nil {
+		return err
+	}
+	// Running servers pick this up on their next denylist refresh.
+	err = dbQueries.InvalidateUserTokens(ctx, database.InvalidateUserTokensParams{
+		ID:               user.ID,
+		TokensValidAfter: sql.NullTime{Time: time.Now().UTC(), Valid: true},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is now %s. The new role applies from their next login or token refresh.\n", *email, *role)
+	return nil
+}
+
+// commandBackfillHashtags tags the chirps posted before hashtags were
+// stored. It is safe to run more than once, and while the server is up.
+func commandBackfillHashtags(args []string) error {
+	flags := flag.NewFlagSet("backfill-hashtags", flag.ExitOnError)
+	batchSize := flags.Int("batch", 500, "chirps to read at a time")
+	flags.Parse(args)
+
+	if *batchSize < 1 {
+		return fmt.Errorf("batch size must be at least 1")
+	}
+	db, err := sql.Open("postgres", os.Getenv("DB_URL"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	dbQueries := database.New(db)
+
+	ctx := context.Background()
+	params := database.ListChirpsAfterParams{RowLimit: int32(*batchSize)}
+	tagged := 0
+	for {
+		chirps, err := dbQueries.ListChirpsAfter(ctx, params)
+		if err != nil {
+			return err
+		}
+		for _, chirp := range chirps {
+			tags := hashtags.Extract(chirp.Body)
+			if len(tags) == 0 {
+				continue
+			}
+			err := dbQueries.AddChirpHashtags(ctx, database.AddChirpHashtagsParams{
+				ChirpID:  chirp.ID,
+				Hashtags: tags,
+			})
+			if err != nil {
+				return err
+			}
+			tagged++
 		}
+		if len(chirps) < *batchSize {
+			break
+		}
+		last := chirps[len(chirps)-1]
+		params.CursorCreatedAt = sql.NullTime{Time: last.CreatedAt, Valid: true}
+		params.CursorID = uuid.NullUUID{UUID: last.ID, Valid: true}
+	}
+	fmt.Printf("Tagged %d chirps.\n", tagged)
+	return nil
+}
+
+// routes builds the server's handler, with every endpoint behind the
+// impersonation audit.
+func (cfg *apiConfig) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/healthz", handlerReadiness)
+	mux.HandleFunc("GET /.well-known/jwks.json", cfg.handlerJWKS)
+	mux.HandleFunc("GET /.well-known/openid-configuration", cfg.handlerOIDCConfiguration)
+
+	admin := http.NewServeMux()
+	admin.HandleFunc("GET /admin/metrics", cfg.handlerMetrics)
+	admin.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	admin.HandleFunc("GET /admin/lockouts", cfg.handlerLockoutsList)
+	admin.HandleFunc("DELETE /admin/lockouts/{key}", cfg.handlerLockoutsDelete)
+	admin.HandleFunc("PUT /admin/users/{userID}/role", cfg.handlerUserRoleUpdate)
+	admin.HandleFunc("POST /admin/oauth/clients", cfg.handlerServiceClientsCreate)
+	admin.HandleFunc("POST /admin/impersonate", cfg.handlerImpersonate)
+	admin.HandleFunc("GET /admin/audit-events", cfg.handlerAuditEventsList)
+	admin.HandleFunc("PUT /admin/reactions", cfg.handlerReactionSettingsUpdate)
+	mux.Handle("/admin/", cfg.middlewareRequireRole(auth.RoleAdmin, admin))
+
+	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.HandleFunc("PUT /api/users", cfg.handlerUsersUpdate)
+	mux.HandleFunc("GET /api/users/verify-email", cfg.handlerVerifyEmail)
+	mux.HandleFunc("POST /api/users/verify-email", cfg.handlerVerifyEmail)
+	mux.HandleFunc("POST /api/users/verify-email/resend", cfg.handlerVerifyEmailResend)
+	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
+	mux.HandleFunc("POST /api/login/2fa", cfg.handlerLoginTOTP)
+	mux.HandleFunc("POST /api/2fa/enroll", cfg.handlerTOTPEnroll)
+	mux.HandleFunc("POST /api/2fa/confirm", cfg.handlerTOTPConfirm)
+	mux.HandleFunc("DELETE /api/2fa", cfg.handlerTOTPDisable)
+	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
+	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
+	mux.HandleFunc("POST /api/logout", cfg.handlerLogout)
+	mux.HandleFunc("POST /api/password-reset/request", cfg.handlerPasswordResetRequest)
+	mux.HandleFunc("POST /api/password-reset/confirm", cfg.handlerPasswordResetConfirm)
+	mux.HandleFunc("GET /api/sessions", cfg.handlerSessionsList)
+	mux.HandleFunc("DELETE /api/sessions", cfg.handlerSessionsDeleteAll)
+	mux.HandleFunc("DELETE /api/sessions/{sessionID}", cfg.handlerSessionsDelete)
+	mux.HandleFunc("GET /api/audit-events", cfg.handlerAuditEventsListOwn)
+	mux.HandleFunc("POST /api/tokens", cfg.handlerTokensCreate)
+	mux.HandleFunc("GET /api/tokens", cfg.handlerTokensList)
+	mux.HandleFunc("DELETE /api/tokens/{tokenID}", cfg.handlerTokensDelete)
+	mux.HandleFunc("POST /api/oauth/clients", cfg.handlerOAuthClientsCreate)
+	mux.HandleFunc("GET /api/oauth/clients", cfg.handlerOAuthClientsList)
+	mux.HandleFunc("DELETE /api/oauth/clients/{clientID}", cfg.handlerOAuthClientsDelete)
+	mux.HandleFunc("GET /api/oauth/authorize", cfg.handlerOAuthAuthorize)
+	mux.HandleFunc("POST /api/oauth/authorize", cfg.handlerOAuthAuthorizeSubmit)
+	mux.HandleFunc("POST /api/oauth/token", cfg.handlerOAuthToken)
+	mux.HandleFunc("POST /api/oauth/revoke", cfg.handlerOAuthRevoke)
+	mux.HandleFunc("POST /api/oauth/introspect", cfg.handlerOAuthIntrospect)
+	mux.HandleFunc("GET /api/oauth/userinfo", cfg.handlerUserInfo)
+	mux.HandleFunc("POST /api/oauth/userinfo", cfg.handlerUserInfo)
+	chirpsWrite := func(h http.HandlerFunc) http.Handler {
+		return cfg.middlewareRequireScope(auth.ScopeChirpsWrite, h)
 	}
-	return strings.Join(words, " ")
+	verifiedChirpsWrite := func(h http.HandlerFunc) http.Handler {
+		return cfg.middlewareRequireScope(auth.ScopeChirpsWrite, cfg.middlewareRequireVerified(h))
+	}
+	mux.Handle("POST /api/chirps", verifiedChirpsWrite(cfg.handlerChirpsCreate))
+	mux.HandleFunc("GET /api/chirps", cfg.handlerChirpsGet)
+	mux.HandleFunc("GET /api/chirps/{chirpID}", cfg.handlerChirpsGetOne)
+	mux.Handle("PATCH /api/chirps/{chirpID}", chirpsWrite(cfg.handlerChirpsUpdate))
+	mux.Handle("DELETE /api/chirps/{chirpID}", chirpsWrite(cfg.handlerChirpsDelete))
+	mux.HandleFunc("GET /api/chirps/{chirpID}/revisions", cfg.handlerChirpRevisionsList)
+	mux.HandleFunc("GET /api/chirps/{chirpID}/thread", cfg.handlerChirpThread)
+	mux.Handle("POST /api/chirps/{chirpID}/rechirp", verifiedChirpsWrite(cfg.handlerRechirpCreate))
+	mux.Handle("DELETE /api/chirps/{chirpID}/rechirp", chirpsWrite(cfg.handlerRechirpDelete))
+	mux.Handle("POST /api/chirps/{chirpID}/likes", chirpsWrite(cfg.handlerLikeCreate))
+	mux.Handle("DELETE /api/chirps/{chirpID}/likes", chirpsWrite(cfg.handlerLikeDelete))
+	mux.HandleFunc("GET /api/users/{userID}/likes", cfg.handlerUserLikesList)
+	mux.Handle("POST /api/chirps/{chirpID}/reactions", chirpsWrite(cfg.handlerReactionCreate))
+	mux.Handle("DELETE /api/chirps/{chirpID}/reactions/{emoji}", chirpsWrite(cfg.handlerReactionDelete))
+	mux.HandleFunc("GET /api/reactions", cfg.handlerReactionSettingsGet)
+	mux.HandleFunc("GET /api/hashtags/trending", cfg.handlerHashtagsTrending)
+	mux.HandleFunc("GET /api/hashtags/{tag}/chirps", cfg.handlerHashtagChirpsList)
+	mux.HandleFunc("POST /api/polka/webhooks", cfg.handlerWebhook)
+
+	fsHandler := http.StripPrefix("/app", http.FileServer(http.Dir(".")))
+	mux.Handle("/app/", cfg.middlewareMetricsInc(fsHandler))
+	return cfg.middlewareAuditImpersonation(mux)
 }
 
 func main() {
 	godotenv.Load()
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	dbURL := os.Getenv("DB_URL")
 	platform := os.Getenv("PLATFORM")
 	jwtSecret := os.Getenv("JWT_SECRET")
 	polkaKey := os.Getenv("POLKA_KEY")
 
+	jwtKeys, err := loadJWTKeys(jwtSecret, os.Getenv("JWT_KEYS_DIR"), os.Getenv("JWT_SIGNING_KEY_ID"))
+	if err != nil {
+		log.Fatalf("Couldn't load JWT keys: %v", err)
+	}
+
+	mail, err := newMailer()
+	if err != nil {
+		log.Fatalf("Couldn't set up mailer: %v", err)
+	}
+	publicURL := os.Getenv("PUBLIC_URL")
+	if publicURL == "" {
+		publicURL = "http://localhost:8080"
+	}
+
+	loginThrottle, err := loginThrottleFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid login throttle settings: %v", err)
+	}
+	passwordParams, err := passwordParamsFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid password hashing settings: %v", err)
+	}
+	passwordPolicy, err := passwordPolicyFromEnv(platform)
+	if err != nil {
+		log.Fatalf("Invalid password policy settings: %v", err)
+	}
+	denylistRefresh, err := envDuration("DENYLIST_REFRESH_INTERVAL", 30*time.Second)
+	if err != nil {
+		log.Fatalf("Invalid denylist settings: %v", err)
+	}
+	chirpEditWindow, err := envDuration("CHIRP_EDIT_WINDOW", 0)
+	if err != nil {
+		log.Fatalf("Invalid chirp settings: %v", err)
+	}
+	dummyHash, err := auth.HashPassword("chirpy-dummy-password", passwordParams)
+	if err != nil {
+		log.Fatalf("Couldn't hash dummy password: %v", err)
+	}
+
 	db, _ := sql.Open("postgres", dbURL)
 	dbQueries := database.New(db)
 
 	apiCfg := &apiConfig{
-		db:        dbQueries,
-		platform:  platform,
-		jwtSecret: jwtSecret,
-		polkaKey:  polkaKey,
+		db:              dbQueries,
+		platform:        platform,
+		jwtKeys:         jwtKeys,
+		polkaKey:        polkaKey,
+		mailer:          mail,
+		publicURL:       strings.TrimSuffix(publicURL, "/"),
+		loginThrottle:   loginThrottle,
+		dummyHash:       dummyHash,
+		passwordParams:  passwordParams,
+		passwordPolicy:  passwordPolicy,
+		denylist:        auth.NewDenylist(accessTokenTTL),
+		chirpEditWindow: chirpEditWindow,
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("GET /api/healthz", handlerReadiness)
-	mux.HandleFunc("GET /admin/metrics", apiCfg.handlerMetrics)
-	mux.HandleFunc("POST /admin/reset", apiCfg.handlerReset)
-	mux.HandleFunc("POST /api/users", apiCfg.handlerUsersCreate)
-	mux.HandleFunc("PUT /api/users", apiCfg.handlerUsersUpdate)
-	mux.HandleFunc("POST /api/login", apiCfg.handlerLogin)
-	mux.HandleFunc("POST /api/refresh", apiCfg.handlerRefresh)
-	mux.HandleFunc("POST /api/revoke", apiCfg.handlerRevoke)
-	mux.HandleFunc("POST /api/chirps", apiCfg.handlerChirpsCreate)
-	mux.HandleFunc("GET /api/chirps", apiCfg.handlerChirpsGet)
-	mux.HandleFunc("GET /api/chirps/{chirpID}", apiCfg.handlerChirpsGetOne)
-	mux.HandleFunc("DELETE /api/chirps/{chirpID}", apiCfg.handlerChirpsDelete)
-	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.handlerWebhook)
-
-	fsHandler := http.StripPrefix("/app", http.FileServer(http.Dir(".")))
-	mux.Handle("/app/", apiCfg.middlewareMetricsInc(fsHandler))
+	// Revocations made by other instances reach this one within
+	// denylistRefresh.
+	if err := apiCfg.refreshDenylist(context.Background()); err != nil {
+		log.Printf("Couldn't load token denylist: %v", err)
+	}
+	go func() {
+		for range time.Tick(denylistRefresh) {
+			if err := apiCfg.refreshDenylist(context.Background()); err != nil {
+				log.Printf("Couldn't refresh token denylist: %v", err)
+			}
+		}
+	}()
 
-	srv := &http.Server{Addr: ":8080", Handler: mux}
+	srv := &http.Server{Addr: ":8080", Handler: apiCfg.routes()}
 	log.Printf("Starting server on %s", srv.Addr)
 	log.Fatal(srv.ListenAndServe())
-}
\ No newline at end of file
+}
@@ -0,0 +1,1668 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Numpkens/chirpy/internal/auth"
+	"github.com/Numpkens/chirpy/internal/database"
+	"github.com/Numpkens/chirpy/internal/mailer"
+	"github.com/google/uuid"
+)
+
+// memDB keeps just enough state in memory for the handlers under test. It
+// embeds the interface so a query a test didn't expect panics instead of
+// quietly returning zero values.
+type memDB struct {
+	database.Querier
+
+	mu            sync.Mutex
+	users         map[uuid.UUID]database.User
+	clients       map[uuid.UUID]database.OauthClient
+	codes         map[string]database.OauthAuthorizationCode
+	refreshTokens map[string]database.RefreshToken
+	chirps        map[uuid.UUID]database.Chirp
+	likes         map[database.LikeChirpParams]bool
+	auditEvents   []database.CreateAuditEventParams
+	// auditErr, when set, is returned by CreateAuditEvent.
+	auditErr error
+	// verificationLog records sent and cancelled email verification
+	// links, in order.
+	verificationLog []string
+
+	reactionSettings database.ReactionSetting
+	reactions        []database.AddChirpReactionParams
+	// reactionsFull makes AddChirpReaction add nothing, as it does when
+	// the chirp has no room for another emoji.
+	reactionsFull bool
+
+	deletedChirps []database.DeleteChirpParams
+	// deleteChirpErr, when set, is returned by DeleteChirp.
+	deleteChirpErr error
+}
+
+func newMemDB() *memDB {
+	return &memDB{
+		users:         map[uuid.UUID]database.User{},
+		clients:       map[uuid.UUID]database.OauthClient{},
+		codes:         map[string]database.OauthAuthorizationCode{},
+		refreshTokens: map[string]database.RefreshToken{},
+		chirps:        map[uuid.UUID]database.Chirp{},
+		likes:         map[database.LikeChirpParams]bool{},
+		reactionSettings: database.ReactionSetting{
+			ID:                   true,
+			AllowedEmoji:         []string{"👍", "❤️"},
+			MaxDistinctReactions: 2,
+			UpdatedAt:            time.Now().UTC(),
+		},
+	}
+}
+
+func (db *memDB) auditEventTypes() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	types := []string{}
+	for _, event := range db.auditEvents {
+		types = append(types, event.EventType)
+	}
+	return types
+}
+
+func (db *memDB) CreateAuditEvent(ctx context.Context, arg database.CreateAuditEventParams) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.auditErr != nil {
+		return db.auditErr
+	}
+	db.auditEvents = append(db.auditEvents, arg)
+	return nil
+}
+
+func (db *memDB) GetUserByID(ctx context.Context, id uuid.UUID) (database.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	user, ok := db.users[id]
+	if !ok {
+		return database.User{}, sql.ErrNoRows
+	}
+	return user, nil
+}
+
+func (db *memDB) GetUserByEmail(ctx context.Context, email string) (database.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, user := range db.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return database.User{}, sql.ErrNoRows
+}
+
+func (db *memDB) UpdateUserPassword(ctx context.Context, arg database.UpdateUserPasswordParams) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	user := db.users[arg.ID]
+	user.HashedPassword = arg.HashedPassword
+	db.users[arg.ID] = user
+	return nil
+}
+
+func (db *memDB) UpdateUser(ctx context.Context, arg database.UpdateUserParams) (database.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	user, ok := db.users[arg.ID]
+	if !ok {
+		return database.User{}, sql.ErrNoRows
+	}
+	user.Email = arg.Email
+	user.HashedPassword = arg.HashedPassword
+	user.UpdatedAt = time.Now().UTC()
+	db.users[arg.ID] = user
+	return user, nil
+}
+
+func (db *memDB) InvalidateUserTokens(ctx context.Context, arg database.InvalidateUserTokensParams) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	user := db.users[arg.ID]
+	user.TokensValidAfter = arg.TokensValidAfter
+	db.users[arg.ID] = user
+	return nil
+}
+
+func (db *memDB) RevokeUserSessions(ctx context.Context, userID uuid.UUID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for hash, token := range db.refreshTokens {
+		if token.UserID == userID && !token.RevokedAt.Valid {
+			token.RevokedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+			db.refreshTokens[hash] = token
+		}
+	}
+	return nil
+}
+
+func (db *memDB) RevokeUserSession(ctx context.Context, arg database.RevokeUserSessionParams) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	revoked := int64(0)
+	for hash, token := range db.refreshTokens {
+		if token.FamilyID == arg.FamilyID && token.UserID == arg.UserID && !token.RevokedAt.Valid {
+			token.RevokedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+			db.refreshTokens[hash] = token
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+func (db *memDB) ListUserSessions(ctx context.Context, userID uuid.UUID) ([]database.ListUserSessionsRow, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	sessions := []database.ListUserSessionsRow{}
+	for _, token := range db.refreshTokens {
+		if token.UserID == userID && !token.RevokedAt.Valid {
+			sessions = append(sessions, database.ListUserSessionsRow{
+				FamilyID:   token.FamilyID,
+				CreatedIp:  token.CreatedIp,
+				UserAgent:  token.UserAgent,
+				LastUsedAt: token.LastUsedAt,
+				ExpiresAt:  token.ExpiresAt,
+				StartedAt:  token.CreatedAt,
+			})
+		}
+	}
+	return sessions, nil
+}
+
+func (db *memDB) CreateEmailVerification(ctx context.Context, arg database.CreateEmailVerificationParams) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.verificationLog = append(db.verificationLog, "send "+arg.Email)
+	return nil
+}
+
+func (db *memDB) InvalidateEmailVerifications(ctx context.Context, userID uuid.UUID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.verificationLog = append(db.verificationLog, "cancel")
+	return nil
+}
+
+func (db *memDB) GetLoginThrottles(ctx context.Context, throttleKeys []string) ([]database.LoginThrottle, error) {
+	return nil, nil
+}
+
+func (db *memDB) RecordLoginFailure(ctx context.Context, arg database.RecordLoginFailureParams) (database.LoginThrottle, error) {
+	return database.LoginThrottle{ThrottleKey: arg.ThrottleKey, Failures: 1, LastFailureAt: time.Now().UTC()}, nil
+}
+
+func (db *memDB) ClearLoginThrottle(ctx context.Context, throttleKey string) error {
+	return nil
+}
+
+func (db *memDB) CreateOAuthClient(ctx context.Context, arg database.CreateOAuthClientParams) (database.OauthClient, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	client := database.OauthClient{
+		ID:            uuid.New(),
+		CreatedAt:     time.Now().UTC(),
+		OwnerID:       arg.OwnerID,
+		Name:          arg.Name,
+		SecretHash:    arg.SecretHash,
+		RedirectUris:  arg.RedirectUris,
+		Scopes:        arg.Scopes,
+		CanIntrospect: arg.CanIntrospect,
+	}
+	db.clients[client.ID] = client
+	return client, nil
+}
+
+func (db *memDB) GetOAuthClient(ctx context.Context, id uuid.UUID) (database.OauthClient, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	client, ok := db.clients[id]
+	if !ok {
+		return database.OauthClient{}, sql.ErrNoRows
+	}
+	return client, nil
+}
+
+func (db *memDB) CreateAuthorizationCode(ctx context.Context, arg database.CreateAuthorizationCodeParams) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.codes[arg.CodeHash] = database.OauthAuthorizationCode{
+		CodeHash:      arg.CodeHash,
+		CreatedAt:     time.Now().UTC(),
+		ClientID:      arg.ClientID,
+		UserID:        arg.UserID,
+		RedirectUri:   arg.RedirectUri,
+		Scopes:        arg.Scopes,
+		CodeChallenge: arg.CodeChallenge,
+		FamilyID:      arg.FamilyID,
+		ExpiresAt:     arg.ExpiresAt,
+		Nonce:         arg.Nonce,
+	}
+	return nil
+}
+
+func (db *memDB) GetAuthorizationCode(ctx context.Context, codeHash string) (database.OauthAuthorizationCode, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	code, ok := db.codes[codeHash]
+	if !ok {
+		return database.OauthAuthorizationCode{}, sql.ErrNoRows
+	}
+	return code, nil
+}
+
+func (db *memDB) UseAuthorizationCode(ctx context.Context, codeHash string) (database.OauthAuthorizationCode, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	code, ok := db.codes[codeHash]
+	if !ok || code.UsedAt.Valid || !code.ExpiresAt.After(time.Now().UTC()) {
+		return database.OauthAuthorizationCode{}, sql.ErrNoRows
+	}
+	code.UsedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	db.codes[codeHash] = code
+	return code, nil
+}
+
+func (db *memDB) CreateRefreshToken(ctx context.Context, arg database.CreateRefreshTokenParams) (database.RefreshToken, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	now := time.Now().UTC()
+	token := database.RefreshToken{
+		TokenHash:  arg.TokenHash,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		UserID:     arg.UserID,
+		ExpiresAt:  arg.ExpiresAt,
+		FamilyID:   arg.FamilyID,
+		CreatedIp:  arg.CreatedIp,
+		UserAgent:  arg.UserAgent,
+		LastUsedAt: now,
+		ClientID:   arg.ClientID,
+		Scopes:     arg.Scopes,
+	}
+	db.refreshTokens[arg.TokenHash] = token
+	return token, nil
+}
+
+func (db *memDB) GetRefreshToken(ctx context.Context, tokenHash string) (database.RefreshToken, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	token, ok := db.refreshTokens[tokenHash]
+	if !ok {
+		return database.RefreshToken{}, sql.ErrNoRows
+	}
+	return token, nil
+}
+
+func (db *memDB) RotateRefreshToken(ctx context.Context, tokenHash string) (database.RefreshToken, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	token, ok := db.refreshTokens[tokenHash]
+	if !ok || token.RevokedAt.Valid || !token.ExpiresAt.After(time.Now().UTC()) {
+		return database.RefreshToken{}, sql.ErrNoRows
+	}
+	token.RevokedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	db.refreshTokens[tokenHash] = token
+	return token, nil
+}
+
+func (db *memDB) RevokeRefreshTokenFamily(ctx context.Context, familyID uuid.UUID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for hash, token := range db.refreshTokens {
+		if token.FamilyID == familyID && !token.RevokedAt.Valid {
+			token.RevokedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+			db.refreshTokens[hash] = token
+		}
+	}
+	return nil
+}
+
+func (db *memDB) GetChirp(ctx context.Context, id uuid.UUID) (database.Chirp, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	chirp, ok := db.chirps[id]
+	if !ok {
+		return database.Chirp{}, sql.ErrNoRows
+	}
+	return chirp, nil
+}
+
+// listChirps filters and orders chirps the way the ListChirps queries do.
+func (db *memDB) listChirps(authorID uuid.NullUUID, cursorCreatedAt sql.NullTime, cursorID uuid.NullUUID, rowLimit int32, ascending bool) []database.Chirp {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	compare := func(a, b database.Chirp) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID.String(), b.ID.String())
+	}
+	cursor := database.Chirp{CreatedAt: cursorCreatedAt.Time, ID: cursorID.UUID}
+	chirps := []database.Chirp{}
+	for _, chirp := range db.chirps {
+		if authorID.Valid && chirp.UserID != authorID.UUID {
+			continue
+		}
+		if cursorCreatedAt.Valid {
+			if c := compare(chirp, cursor); c == 0 || (c > 0) != ascending {
+				continue
+			}
+		}
+		chirps = append(chirps, chirp)
+	}
+	slices.SortFunc(chirps, compare)
+	if !ascending {
+		slices.Reverse(chirps)
+	}
+	return chirps[:min(len(chirps), int(rowLimit))]
+}
+
+func (db *memDB) ListChirpsAfter(ctx context.Context, arg database.ListChirpsAfterParams) ([]database.Chirp, error) {
+	return db.listChirps(arg.AuthorID, arg.CursorCreatedAt, arg.CursorID, arg.RowLimit, true), nil
+}
+
+func (db *memDB) ListChirpsBefore(ctx context.Context, arg database.ListChirpsBeforeParams) ([]database.Chirp, error) {
+	return db.listChirps(arg.AuthorID, arg.CursorCreatedAt, arg.CursorID, arg.RowLimit, false), nil
+}
+
+// DeleteChirp only records the call: rechirps and quotes are handled by
+// the query and the schema, which internal/database tests against Postgres.
+func (db *memDB) DeleteChirp(ctx context.Context, arg database.DeleteChirpParams) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.deleteChirpErr != nil {
+		return db.deleteChirpErr
+	}
+	db.deletedChirps = append(db.deletedChirps, arg)
+	return nil
+}
+
+// CreateRechirp returns sql.ErrNoRows for a chirp the user already
+// rechirped, as the query's ON CONFLICT DO NOTHING does.
+func (db *memDB) CreateRechirp(ctx context.Context, arg database.CreateRechirpParams) (database.Chirp, error) {
+	if _, err := db.GetRechirp(ctx, database.GetRechirpParams(arg)); err == nil {
+		return database.Chirp{}, sql.ErrNoRows
+	}
+	now := time.Now().UTC()
+	id := uuid.New()
+	chirp := database.Chirp{
+		ID:                id,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+		UserID:            arg.UserID,
+		ThreadID:          id,
+		Kind:              chirpKindRechirp,
+		ReferencedChirpID: arg.ReferencedChirpID,
+	}
+	db.mu.Lock()
+	db.chirps[id] = chirp
+	db.mu.Unlock()
+	return chirp, nil
+}
+
+func (db *memDB) GetRechirp(ctx context.Context, arg database.GetRechirpParams) (database.Chirp, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, chirp := range db.chirps {
+		if chirp.Kind == chirpKindRechirp && chirp.UserID == arg.UserID && chirp.ReferencedChirpID == arg.ReferencedChirpID {
+			return chirp, nil
+		}
+	}
+	return database.Chirp{}, sql.ErrNoRows
+}
+
+func (db *memDB) GetReactionSettings(ctx context.Context) (database.ReactionSetting, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.reactionSettings, nil
+}
+
+func (db *memDB) UpdateReactionSettings(ctx context.Context, arg database.UpdateReactionSettingsParams) (database.ReactionSetting, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.reactionSettings.AllowedEmoji = arg.AllowedEmoji
+	db.reactionSettings.MaxDistinctReactions = arg.MaxDistinctReactions
+	db.reactionSettings.UpdatedAt = time.Now().UTC()
+	return db.reactionSettings, nil
+}
+
+func (db *memDB) AddChirpReaction(ctx context.Context, arg database.AddChirpReactionParams) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.reactionsFull {
+		return 0, nil
+	}
+	db.reactions = append(db.reactions, arg)
+	return 1, nil
+}
+
+func (db *memDB) GetChirpsByIDs(ctx context.Context, chirpIds []uuid.UUID) ([]database.Chirp, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	chirps := []database.Chirp{}
+	for _, id := range chirpIds {
+		if chirp, ok := db.chirps[id]; ok {
+			chirps = append(chirps, chirp)
+		}
+	}
+	return chirps, nil
+}
+
+func (db *memDB) CountChirpReplies(ctx context.Context, chirpIds []uuid.UUID) ([]database.CountChirpRepliesRow, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	counts := map[uuid.UUID]int64{}
+	for _, chirp := range db.chirps {
+		if chirp.ParentID.Valid && slices.Contains(chirpIds, chirp.ParentID.UUID) {
+			counts[chirp.ParentID.UUID]++
+		}
+	}
+	rows := []database.CountChirpRepliesRow{}
+	for id, count := range counts {
+		rows = append(rows, database.CountChirpRepliesRow{ParentID: uuid.NullUUID{UUID: id, Valid: true}, ReplyCount: count})
+	}
+	return rows, nil
+}
+
+func (db *memDB) CountChirpReferences(ctx context.Context, chirpIds []uuid.UUID) ([]database.CountChirpReferencesRow, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	counts := map[database.CountChirpReferencesRow]int64{}
+	for _, chirp := range db.chirps {
+		if chirp.ReferencedChirpID.Valid && slices.Contains(chirpIds, chirp.ReferencedChirpID.UUID) {
+			counts[database.CountChirpReferencesRow{ReferencedChirpID: chirp.ReferencedChirpID, Kind: chirp.Kind}]++
+		}
+	}
+	rows := []database.CountChirpReferencesRow{}
+	for row, count := range counts {
+		row.ReferenceCount = count
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func (db *memDB) LikeChirp(ctx context.Context, arg database.LikeChirpParams) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.likes[arg] = true
+	return nil
+}
+
+func (db *memDB) UnlikeChirp(ctx context.Context, arg database.UnlikeChirpParams) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := database.LikeChirpParams{UserID: arg.UserID, ChirpID: arg.ChirpID}
+	if !db.likes[key] {
+		return 0, nil
+	}
+	delete(db.likes, key)
+	return 1, nil
+}
+
+func (db *memDB) CountChirpLikes(ctx context.Context, chirpIds []uuid.UUID) ([]database.CountChirpLikesRow, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	counts := map[uuid.UUID]int64{}
+	for like := range db.likes {
+		if slices.Contains(chirpIds, like.ChirpID) {
+			counts[like.ChirpID]++
+		}
+	}
+	rows := []database.CountChirpLikesRow{}
+	for id, count := range counts {
+		rows = append(rows, database.CountChirpLikesRow{ChirpID: id, LikeCount: count})
+	}
+	return rows, nil
+}
+
+func (db *memDB) ListLikedChirpIDs(ctx context.Context, arg database.ListLikedChirpIDsParams) ([]uuid.UUID, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ids := []uuid.UUID{}
+	for like := range db.likes {
+		if like.UserID == arg.UserID && slices.Contains(arg.ChirpIds, like.ChirpID) {
+			ids = append(ids, like.ChirpID)
+		}
+	}
+	return ids, nil
+}
+
+func (db *memDB) CountChirpReactions(ctx context.Context, chirpIds []uuid.UUID) ([]database.CountChirpReactionsRow, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	counts := map[database.CountChirpReactionsRow]int64{}
+	for _, reaction := range db.reactions {
+		if slices.Contains(chirpIds, reaction.ChirpID) {
+			counts[database.CountChirpReactionsRow{ChirpID: reaction.ChirpID, Emoji: reaction.Emoji}]++
+		}
+	}
+	rows := []database.CountChirpReactionsRow{}
+	for row, count := range counts {
+		row.ReactionCount = count
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func (db *memDB) ListUserChirpReactions(ctx context.Context, arg database.ListUserChirpReactionsParams) ([]database.ListUserChirpReactionsRow, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rows := []database.ListUserChirpReactionsRow{}
+	for _, reaction := range db.reactions {
+		if reaction.UserID == arg.UserID && slices.Contains(arg.ChirpIds, reaction.ChirpID) {
+			rows = append(rows, database.ListUserChirpReactionsRow{ChirpID: reaction.ChirpID, Emoji: reaction.Emoji})
+		}
+	}
+	return rows, nil
+}
+
+func newTestConfig(t *testing.T, db database.Querier) *apiConfig {
+	t.Helper()
+	params := auth.PasswordParams{Memory: 1024, Iterations: 1, Parallelism: 1}
+	dummyHash, err := auth.HashPassword("chirpy-dummy-password", params)
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+	return &apiConfig{
+		db:             db,
+		platform:       "dev",
+		jwtKeys:        auth.NewHMACKeySet("test-secret"),
+		publicURL:      "http://chirpy.test",
+		loginThrottle:  auth.DefaultLoginThrottle(),
+		dummyHash:      dummyHash,
+		passwordParams: params,
+		passwordPolicy: auth.DefaultPasswordPolicy(),
+		mailer:         mailer.NewLogMailer(io.Discard, "chirpy@example.com"),
+		denylist:       auth.NewDenylist(accessTokenTTL),
+	}
+}
+
+// addTestUser stores a user and returns it with an access token for a login
+// session.
+func addTestUser(t *testing.T, cfg *apiConfig, db *memDB, email, password string) (database.User, string) {
+	t.Helper()
+	hash, err := auth.HashPassword(password, cfg.passwordParams)
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+	now := time.Now().UTC()
+	user := database.User{
+		ID:             uuid.New(),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		Email:          email,
+		HashedPassword: hash,
+		EmailVerified:  true,
+		Role:           auth.RoleUser,
+	}
+	db.mu.Lock()
+	db.users[user.ID] = user
+	db.mu.Unlock()
+	token, err := auth.MakeJWT(user.ID, cfg.jwtKeys, accessTokenTTL, auth.WithRole(user.Role))
+	if err != nil {
+		t.Fatalf("MakeJWT() error = %v", err)
+	}
+	return user, token
+}
+
+// promoteTestUser gives user role and returns an access token carrying it.
+func promoteTestUser(t *testing.T, cfg *apiConfig, db *memDB, user database.User, role string) string {
+	t.Helper()
+	db.mu.Lock()
+	user.Role = role
+	db.users[user.ID] = user
+	db.mu.Unlock()
+	token, err := auth.MakeJWT(user.ID, cfg.jwtKeys, accessTokenTTL, auth.WithRole(role))
+	if err != nil {
+		t.Fatalf("MakeJWT() error = %v", err)
+	}
+	return token
+}
+
+// TestOAuthFlow plays an OAuth client against the real routes: it registers,
+// has the user approve it with PKCE, redeems the code, refreshes, and revokes.
+func TestOAuthFlow(t *testing.T) {
+	db := newMemDB()
+	cfg := newTestConfig(t, db)
+	user, sessionToken := addTestUser(t, cfg, db, "user@example.com", "correct horse battery staple")
+	srv := httptest.NewServer(cfg.routes())
+	defer srv.Close()
+	client := srv.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	const redirectURI = "http://127.0.0.1:9000/callback"
+
+	// Register a confidential client.
+	body := strings.NewReader(`{"name": "Test app", "redirect_uris": ["` + redirectURI + `"], "scopes": ["chirps:read", "chirps:write"], "confidential": true}`)
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/oauth/clients", body)
+	req.Header.Set("Authorization", "Bearer "+sessionToken)
+	resp := doRequest(t, client, req, http.StatusCreated)
+	registered := OAuthClient{}
+	decodeBody(t, resp, &registered)
+	if registered.ClientSecret == "" {
+		t.Fatalf("registering a confidential client returned no secret")
+	}
+	clientID := registered.ID.String()
+
+	// Show the consent page, then approve it.
+	verifier, err := auth.MakePKCEVerifier()
+	if err != nil {
+		t.Fatalf("MakePKCEVerifier() error = %v", err)
+	}
+	authorize := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {"chirps:read"},
+		"state":                 {"xyz"},
+		"code_challenge":        {auth.PKCEChallenge(verifier)},
+		"code_challenge_method": {auth.PKCEMethodS256},
+	}
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/api/oauth/authorize?"+authorize.Encode(), nil)
+	doRequest(t, client, req, http.StatusOK).Body.Close()
+
+	form := url.Values{"action": {"allow"}, "email": {user.Email}, "password": {"correct horse battery staple"}}
+	for key, values := range authorize {
+		form[key] = values
+	}
+	req, _ = http.NewRequest(http.MethodPost, srv.URL+"/api/oauth/authorize", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp = doRequest(t, client, req, http.StatusSeeOther)
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("Location %q: %v", resp.Header.Get("Location"), err)
+	}
+	code := location.Query().Get("code")
+	if code == "" || location.Query().Get("state") != "xyz" {
+		t.Fatalf("authorize redirected to %s, expected a code and the state", location)
+	}
+
+	tokenRequest := func(form url.Values) *http.Request {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/oauth/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(clientID, registered.ClientSecret)
+		return req
+	}
+
+	// A wrong verifier is rejected before the code is spent.
+	resp = doRequest(t, client, tokenRequest(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {strings.Repeat("a", 43)},
+	}), http.StatusBadRequest)
+	resp.Body.Close()
+
+	// The wrong verifier still used the code up, so start again.
+	req, _ = http.NewRequest(http.MethodPost, srv.URL+"/api/oauth/authorize", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp = doRequest(t, client, req, http.StatusSeeOther)
+	resp.Body.Close()
+	location, _ = url.Parse(resp.Header.Get("Location"))
+	code = location.Query().Get("code")
+
+	resp = doRequest(t, client, tokenRequest(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	}), http.StatusOK)
+	tokens := oauthTokenResponse{}
+	decodeBody(t, resp, &tokens)
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" || tokens.Scope != "chirps:read" {
+		t.Fatalf("token response = %+v, expected tokens with scope chirps:read", tokens)
+	}
+	claims, err := auth.ValidateJWT(tokens.AccessToken, cfg.jwtKeys, cfg.denylist)
+	if err != nil {
+		t.Fatalf("ValidateJWT() error = %v", err)
+	}
+	if claims.UserID != user.ID || claims.ClientID != clientID || claims.Scope != "chirps:read" {
+		t.Errorf("access token claims = %+v, expected user %v, client %v, scope chirps:read", claims, user.ID, clientID)
+	}
+
+	// Refreshing rotates the refresh token.
+	resp = doRequest(t, client, tokenRequest(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {tokens.RefreshToken},
+	}), http.StatusOK)
+	refreshed := oauthTokenResponse{}
+	decodeBody(t, resp, &refreshed)
+	if refreshed.RefreshToken == "" || refreshed.RefreshToken == tokens.RefreshToken {
+		t.Fatalf("refresh returned refresh token %q, expected a new one", refreshed.RefreshToken)
+	}
+
+	// Revoking the refresh token ends the grant.
+	req, _ = http.NewRequest(http.MethodPost, srv.URL+"/api/oauth/revoke", strings.NewReader(url.Values{"token": {refreshed.RefreshToken}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(clientID, registered.ClientSecret)
+	doRequest(t, client, req, http.StatusOK).Body.Close()
+
+	resp = doRequest(t, client, tokenRequest(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshed.RefreshToken},
+	}), http.StatusBadRequest)
+	oauthErr := struct {
+		Error string `json:"error"`
+	}{}
+	decodeBody(t, resp, &oauthErr)
+	if oauthErr.Error != "invalid_grant" {
+		t.Errorf("refresh after revoke error = %q, expected invalid_grant", oauthErr.Error)
+	}
+
+	events := db.auditEventTypes()
+	for _, want := range []string{auditLoginSucceeded, auditTokenRefreshed, auditTokenRevoked} {
+		if !slices.Contains(events, want) {
+			t.Errorf("audit events = %v, missing %q", events, want)
+		}
+	}
+}
+
+// addTestChirp stores a chirp of the given kind, pointing at referenced when
+// that isn't uuid.Nil.
+func addTestChirp(db *memDB, userID uuid.UUID, kind string, referenced uuid.UUID) database.Chirp {
+	now := time.Now().UTC()
+	id := uuid.New()
+	chirp := database.Chirp{
+		ID:        id,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Body:      "Hello, world!",
+		UserID:    userID,
+		ThreadID:  id,
+		Kind:      kind,
+	}
+	if referenced != uuid.Nil {
+		chirp.ReferencedChirpID = uuid.NullUUID{UUID: referenced, Valid: true}
+	}
+	if kind == chirpKindRechirp {
+		chirp.Body = ""
+	}
+	db.mu.Lock()
+	db.chirps[id] = chirp
+	db.mu.Unlock()
+	return chirp
+}
+
+func TestChirpsDelete(t *testing.T) {
+	tests := []struct {
+		name           string
+		byOther        bool
+		unknown        bool
+		deleteErr      error
+		expectedStatus int
+	}{
+		{
+			name:           "Author deletes chirp",
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "Someone else's chirp",
+			byOther:        true,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Unknown chirp",
+			unknown:        true,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Database error",
+			deleteErr:      errors.New("connection reset"),
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newMemDB()
+			cfg := newTestConfig(t, db)
+			author, authorToken := addTestUser(t, cfg, db, "author@example.com", "correct horse battery staple")
+			_, otherToken := addTestUser(t, cfg, db, "other@example.com", "correct horse battery staple")
+			chirp := addTestChirp(db, author.ID, chirpKindPost, uuid.Nil)
+			db.deleteChirpErr = tt.deleteErr
+			token, id := authorToken, chirp.ID
+			if tt.byOther {
+				token = otherToken
+			}
+			if tt.unknown {
+				id = uuid.New()
+			}
+
+			srv := httptest.NewServer(cfg.routes())
+			defer srv.Close()
+			req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/api/chirps/"+id.String(), nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			doRequest(t, srv.Client(), req, tt.expectedStatus).Body.Close()
+
+			var expectedDeleted []database.DeleteChirpParams
+			if tt.expectedStatus == http.StatusNoContent {
+				expectedDeleted = append(expectedDeleted, database.DeleteChirpParams{ID: chirp.ID, UserID: author.ID})
+			}
+			if !slices.Equal(db.deletedChirps, expectedDeleted) {
+				t.Errorf("DeleteChirp() calls = %v, expected %v", db.deletedChirps, expectedDeleted)
+			}
+		})
+	}
+}
+
+func TestRechirpCreate(t *testing.T) {
+	db := newMemDB()
+	cfg := newTestConfig(t, db)
+	author, _ := addTestUser(t, cfg, db, "author@example.com", "correct horse battery staple")
+	_, fanToken := addTestUser(t, cfg, db, "fan@example.com", "correct horse battery staple")
+	original := addTestChirp(db, author.ID, chirpKindPost, uuid.Nil)
+	addTestChirp(db, author.ID, chirpKindQuote, original.ID)
+	srv := httptest.NewServer(cfg.routes())
+	defer srv.Close()
+
+	rechirp := func(id uuid.UUID, expectedStatus int) Chirp {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/chirps/"+id.String()+"/rechirp", nil)
+		req.Header.Set("Authorization", "Bearer "+fanToken)
+		chirp := Chirp{}
+		decodeBody(t, doRequest(t, srv.Client(), req, expectedStatus), &chirp)
+		return chirp
+	}
+
+	created := rechirp(original.ID, http.StatusCreated)
+	if created.Kind != chirpKindRechirp || created.ReferencedChirp == nil || created.ReferencedChirp.ID != original.ID {
+		t.Fatalf("rechirp = %+v, expected a rechirp embedding %v", created, original.ID)
+	}
+	if created.ReferencedChirp.RechirpCount != 1 || created.ReferencedChirp.QuoteCount != 1 {
+		t.Errorf("embedded chirp rechirp_count = %d, quote_count = %d, expected 1 and 1",
+			created.ReferencedChirp.RechirpCount, created.ReferencedChirp.QuoteCount)
+	}
+
+	// Rechirping again, directly or through the rechirp, returns the first one.
+	for _, id := range []uuid.UUID{original.ID, created.ID} {
+		again := rechirp(id, http.StatusOK)
+		if again.ID != created.ID {
+			t.Errorf("rechirping %v again = %v, expected the existing rechirp %v", id, again.ID, created.ID)
+		}
+	}
+	if got := getChirp(t, srv, original.ID, ""); got.RechirpCount != 1 {
+		t.Errorf("rechirp_count = %d, expected 1", got.RechirpCount)
+	}
+}
+
+func TestRechirpCreateAccess(t *testing.T) {
+	db := newMemDB()
+	cfg := newTestConfig(t, db)
+	author, _ := addTestUser(t, cfg, db, "author@example.com", "correct horse battery staple")
+	fan, fanToken := addTestUser(t, cfg, db, "fan@example.com", "correct horse battery staple")
+	unverified, unverifiedToken := addTestUser(t, cfg, db, "unverified@example.com", "correct horse battery staple")
+	unverified.EmailVerified = false
+	db.users[unverified.ID] = unverified
+	readOnlyToken, err := auth.MakeJWT(fan.ID, cfg.jwtKeys, accessTokenTTL,
+		auth.WithClientID(uuid.NewString()), auth.WithScopes([]string{auth.ScopeChirpsRead}))
+	if err != nil {
+		t.Fatalf("MakeJWT() error = %v", err)
+	}
+	original := addTestChirp(db, author.ID, chirpKindPost, uuid.Nil)
+	srv := httptest.NewServer(cfg.routes())
+	defer srv.Close()
+
+	tests := []struct {
+		name            string
+		token           string
+		expectedStatus  int
+		expectedMessage string
+	}{
+		{name: "No token", token: "", expectedStatus: http.StatusUnauthorized, expectedMessage: "Unauthorized"},
+		{name: "Read-only token", token: readOnlyToken, expectedStatus: http.StatusForbidden, expectedMessage: "Insufficient scope"},
+		{name: "Email not verified", token: unverifiedToken, expectedStatus: http.StatusForbidden, expectedMessage: "Email not verified"},
+		{name: "Verified login", token: fanToken, expectedStatus: http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/chirps/"+original.ID.String()+"/rechirp", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp := doRequest(t, srv.Client(), req, tt.expectedStatus)
+			if tt.expectedMessage == "" {
+				resp.Body.Close()
+				return
+			}
+			got := errorResponse{}
+			decodeBody(t, resp, &got)
+			if got.Error != tt.expectedMessage {
+				t.Errorf("error = %q, expected %q", got.Error, tt.expectedMessage)
+			}
+		})
+	}
+}
+
+func TestReactionCreate(t *testing.T) {
+	tests := []struct {
+		name           string
+		chirpID        string
+		emoji          string
+		full           bool
+		expectedStatus int
+	}{
+		{name: "Allowed emoji", emoji: "👍", expectedStatus: http.StatusNoContent},
+		{name: "Emoji not allowed", emoji: "🦀", expectedStatus: http.StatusBadRequest},
+		{name: "No room for another emoji", emoji: "❤️", full: true, expectedStatus: http.StatusConflict},
+		{name: "Unknown chirp", chirpID: uuid.NewString(), emoji: "👍", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newMemDB()
+			db.reactionsFull = tt.full
+			cfg := newTestConfig(t, db)
+			user, token := addTestUser(t, cfg, db, "user@example.com", "correct horse battery staple")
+			chirp := addTestChirp(db, user.ID, chirpKindPost, uuid.Nil)
+			chirpID := tt.chirpID
+			if chirpID == "" {
+				chirpID = chirp.ID.String()
+			}
+			srv := httptest.NewServer(cfg.routes())
+			defer srv.Close()
+
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/chirps/"+chirpID+"/reactions", strings.NewReader(`{"emoji": "`+tt.emoji+`"}`))
+			req.Header.Set("Authorization", "Bearer "+token)
+			doRequest(t, srv.Client(), req, tt.expectedStatus).Body.Close()
+
+			added := tt.expectedStatus == http.StatusNoContent
+			if added != (len(db.reactions) == 1) {
+				t.Errorf("reactions stored = %v, expected added %v", db.reactions, added)
+			}
+		})
+	}
+}
+
+func TestReactionSettingsUpdate(t *testing.T) {
+	tests := []struct {
+		name           string
+		role           string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "Admin",
+			role:           auth.RoleAdmin,
+			body:           `{"allowed_emoji": ["🦀", "🐹"], "max_distinct_reactions": 1}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Not an admin",
+			role:           auth.RoleUser,
+			body:           `{"allowed_emoji": ["🦀", "🐹"], "max_distinct_reactions": 1}`,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "No emoji",
+			role:           auth.RoleAdmin,
+			body:           `{"allowed_emoji": [], "max_distinct_reactions": 1}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Duplicate emoji",
+			role:           auth.RoleAdmin,
+			body:           `{"allowed_emoji": ["🦀", "🦀"], "max_distinct_reactions": 1}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Emoji with a space",
+			role:           auth.RoleAdmin,
+			body:           `{"allowed_emoji": ["🦀 🐹"], "max_distinct_reactions": 1}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "No room for reactions",
+			role:           auth.RoleAdmin,
+			body:           `{"allowed_emoji": ["🦀"], "max_distinct_reactions": 0}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newMemDB()
+			cfg := newTestConfig(t, db)
+			user, _ := addTestUser(t, cfg, db, "admin@example.com", "correct horse battery staple")
+			token := promoteTestUser(t, cfg, db, user, tt.role)
+			srv := httptest.NewServer(cfg.routes())
+			defer srv.Close()
+
+			req, _ := http.NewRequest(http.MethodPut, srv.URL+"/admin/reactions", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			doRequest(t, srv.Client(), req, tt.expectedStatus).Body.Close()
+
+			req, _ = http.NewRequest(http.MethodGet, srv.URL+"/api/reactions", nil)
+			settings := ReactionSettings{}
+			decodeBody(t, doRequest(t, srv.Client(), req, http.StatusOK), &settings)
+			expected := []string{"👍", "❤️"}
+			if tt.expectedStatus == http.StatusOK {
+				expected = []string{"🦀", "🐹"}
+			}
+			if !slices.Equal(settings.AllowedEmoji, expected) {
+				t.Errorf("allowed emoji = %v, expected %v", settings.AllowedEmoji, expected)
+			}
+		})
+	}
+}
+
+// getChirp fetches a chirp as the holder of token, or anonymously if token
+// is empty.
+func getChirp(t *testing.T, srv *httptest.Server, id uuid.UUID, token string) Chirp {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/chirps/"+id.String(), nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	chirp := Chirp{}
+	decodeBody(t, doRequest(t, srv.Client(), req, http.StatusOK), &chirp)
+	return chirp
+}
+
+func TestLikes(t *testing.T) {
+	db := newMemDB()
+	cfg := newTestConfig(t, db)
+	author, authorToken := addTestUser(t, cfg, db, "author@example.com", "correct horse battery staple")
+	_, readerToken := addTestUser(t, cfg, db, "reader@example.com", "correct horse battery staple")
+	chirp := addTestChirp(db, author.ID, chirpKindPost, uuid.Nil)
+	rechirp := addTestChirp(db, author.ID, chirpKindRechirp, chirp.ID)
+	srv := httptest.NewServer(cfg.routes())
+	defer srv.Close()
+
+	like := func(method, token string, id uuid.UUID, expectedStatus int) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+"/api/chirps/"+id.String()+"/likes", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		doRequest(t, srv.Client(), req, expectedStatus).Body.Close()
+	}
+	like(http.MethodPost, readerToken, chirp.ID, http.StatusNoContent)
+	like(http.MethodPost, readerToken, chirp.ID, http.StatusNoContent)
+	// Liking a rechirp likes the chirp it repeats.
+	like(http.MethodPost, authorToken, rechirp.ID, http.StatusNoContent)
+	like(http.MethodPost, readerToken, uuid.New(), http.StatusNotFound)
+
+	liked := true
+	tests := []struct {
+		name              string
+		token             string
+		expectedCount     int64
+		expectedLikedByMe *bool
+	}{
+		{name: "Anonymous reader", expectedCount: 2},
+		{name: "Reader who liked it", token: readerToken, expectedCount: 2, expectedLikedByMe: &liked},
+	}
+	for _, tt := range tests {
+		got := getChirp(t, srv, chirp.ID, tt.token)
+		if got.LikeCount != tt.expectedCount {
+			t.Errorf("%s: like_count = %d, expected %d", tt.name, got.LikeCount, tt.expectedCount)
+		}
+		if (got.LikedByMe == nil) != (tt.expectedLikedByMe == nil) || (got.LikedByMe != nil && *got.LikedByMe != *tt.expectedLikedByMe) {
+			t.Errorf("%s: liked_by_me = %v, expected %v", tt.name, got.LikedByMe, tt.expectedLikedByMe)
+		}
+	}
+
+	like(http.MethodDelete, readerToken, chirp.ID, http.StatusNoContent)
+	like(http.MethodDelete, readerToken, chirp.ID, http.StatusNotFound)
+	got := getChirp(t, srv, chirp.ID, readerToken)
+	if got.LikeCount != 1 || got.LikedByMe == nil || *got.LikedByMe {
+		t.Errorf("after unliking: like_count = %d, liked_by_me = %v, expected 1 and false", got.LikeCount, got.LikedByMe)
+	}
+}
+
+func TestUsersUpdateEmailVerification(t *testing.T) {
+	const password = "correct horse battery staple"
+	tests := []struct {
+		name        string
+		body        string
+		expectedLog []string
+	}{
+		{
+			name:        "New email",
+			body:        `{"email": "new@example.com", "password": "` + password + `"}`,
+			expectedLog: []string{"send new@example.com"},
+		},
+		{
+			name:        "New email and password",
+			body:        `{"email": "new@example.com", "password": "a different horse staple"}`,
+			expectedLog: []string{"cancel", "send new@example.com"},
+		},
+		{
+			name:        "New password",
+			body:        `{"email": "user@example.com", "password": "a different horse staple"}`,
+			expectedLog: []string{"cancel"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newMemDB()
+			cfg := newTestConfig(t, db)
+			_, token := addTestUser(t, cfg, db, "user@example.com", password)
+			srv := httptest.NewServer(cfg.routes())
+			defer srv.Close()
+
+			req, _ := http.NewRequest(http.MethodPut, srv.URL+"/api/users", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			doRequest(t, srv.Client(), req, http.StatusOK).Body.Close()
+			if !slices.Equal(db.verificationLog, tt.expectedLog) {
+				t.Errorf("verification links = %v, expected %v", db.verificationLog, tt.expectedLog)
+			}
+		})
+	}
+}
+
+// TestUsersUpdatePasswordTokens changes a password straight after logging
+// in, so the old token and the cutoff usually share a second.
+func TestUsersUpdatePasswordTokens(t *testing.T) {
+	db := newMemDB()
+	cfg := newTestConfig(t, db)
+	_, oldToken := addTestUser(t, cfg, db, "user@example.com", "correct horse battery staple")
+	srv := httptest.NewServer(cfg.routes())
+	defer srv.Close()
+
+	update := func(token, password string, expectedStatus int) User {
+		t.Helper()
+		body := `{"email": "user@example.com", "password": "` + password + `"}`
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/api/users", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := doRequest(t, srv.Client(), req, expectedStatus)
+		user := User{}
+		if expectedStatus != http.StatusOK {
+			resp.Body.Close()
+			return user
+		}
+		decodeBody(t, resp, &user)
+		return user
+	}
+
+	updated := update(oldToken, "a different horse staple", http.StatusOK)
+	if updated.Token == "" || updated.RefreshToken == "" {
+		t.Fatalf("PUT /api/users = %+v, expected fresh tokens", updated)
+	}
+	update(oldToken, "a different horse staple", http.StatusUnauthorized)
+	update(updated.Token, "a different horse staple", http.StatusOK)
+}
+
+// login logs in over srv and returns the access and refresh tokens.
+func login(t *testing.T, srv *httptest.Server, email, password string) (string, string) {
+	t.Helper()
+	body := `{"email": "` + email + `", "password": "` + password + `"}`
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/login", strings.NewReader(body))
+	user := User{}
+	decodeBody(t, doRequest(t, srv.Client(), req, http.StatusOK), &user)
+	return user.Token, user.RefreshToken
+}
+
+// refresh spends refreshToken and returns its replacement, if the request
+// is expected to succeed.
+func refresh(t *testing.T, srv *httptest.Server, refreshToken string, expectedStatus int) string {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/refresh", nil)
+	req.Header.Set("Authorization", "Bearer "+refreshToken)
+	resp := doRequest(t, srv.Client(), req, expectedStatus)
+	if expectedStatus != http.StatusOK {
+		resp.Body.Close()
+		return ""
+	}
+	tokens := struct {
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	decodeBody(t, resp, &tokens)
+	return tokens.RefreshToken
+}
+
+func TestRefreshRotation(t *testing.T) {
+	const password = "correct horse battery staple"
+	db := newMemDB()
+	cfg := newTestConfig(t, db)
+	addTestUser(t, cfg, db, "user@example.com", password)
+	srv := httptest.NewServer(cfg.routes())
+	defer srv.Close()
+
+	_, first := login(t, srv, "user@example.com", password)
+	_, otherLogin := login(t, srv, "user@example.com", password)
+	second := refresh(t, srv, first, http.StatusOK)
+	third := refresh(t, srv, second, http.StatusOK)
+	if second == first || third == second {
+		t.Fatalf("refresh tokens weren't rotated")
+	}
+
+	// Replaying a spent token shuts down the whole login, including the
+	// token that replaced it, but no other login.
+	refresh(t, srv, first, http.StatusUnauthorized)
+	refresh(t, srv, third, http.StatusUnauthorized)
+	refresh(t, srv, otherLogin, http.StatusOK)
+	if !slices.Contains(db.auditEventTypes(), auditTokenReused) {
+		t.Errorf("audit events = %v, expected %s", db.auditEventTypes(), auditTokenReused)
+	}
+	refresh(t, srv, "not-a-token", http.StatusUnauthorized)
+}
+
+func TestSessions(t *testing.T) {
+	const password = "correct horse battery staple"
+	db := newMemDB()
+	cfg := newTestConfig(t, db)
+	addTestUser(t, cfg, db, "user@example.com", password)
+	addTestUser(t, cfg, db, "other@example.com", password)
+	srv := httptest.NewServer(cfg.routes())
+	defer srv.Close()
+
+	accessToken, _ := login(t, srv, "user@example.com", password)
+	_, laptopRefresh := login(t, srv, "user@example.com", password)
+	_, otherRefresh := login(t, srv, "other@example.com", password)
+	otherSession := db.refreshTokens[auth.HashToken(otherRefresh)].FamilyID
+
+	listSessions := func() []Session {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/sessions", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		sessions := []Session{}
+		decodeBody(t, doRequest(t, srv.Client(), req, http.StatusOK), &sessions)
+		return sessions
+	}
+	sessions := listSessions()
+	if len(sessions) != 2 {
+		t.Fatalf("GET /api/sessions = %d sessions, expected 2", len(sessions))
+	}
+	laptop := db.refreshTokens[auth.HashToken(laptopRefresh)].FamilyID
+
+	tests := []struct {
+		name           string
+		sessionID      string
+		expectedStatus int
+	}{
+		{name: "Own session", sessionID: laptop.String(), expectedStatus: http.StatusNoContent},
+		{name: "Already revoked", sessionID: laptop.String(), expectedStatus: http.StatusNotFound},
+		{name: "Someone else's session", sessionID: otherSession.String(), expectedStatus: http.StatusNotFound},
+		{name: "Invalid ID", sessionID: "laptop", expectedStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/api/sessions/"+tt.sessionID, nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		doRequest(t, srv.Client(), req, tt.expectedStatus).Body.Close()
+	}
+
+	refresh(t, srv, laptopRefresh, http.StatusUnauthorized)
+	refresh(t, srv, otherRefresh, http.StatusOK)
+	sessions = listSessions()
+	if len(sessions) != 1 || sessions[0].ID == laptop {
+		t.Errorf("GET /api/sessions = %+v, expected only the first session", sessions)
+	}
+}
+
+// TestUsersUpdateBadStoredHash covers a stored hash that can't be checked,
+// which must fail the request rather than count as a different password.
+func TestUsersUpdateBadStoredHash(t *testing.T) {
+	db := newMemDB()
+	cfg := newTestConfig(t, db)
+	user, token := addTestUser(t, cfg, db, "user@example.com", "correct horse battery staple")
+	user.HashedPassword = "not-a-hash"
+	db.users[user.ID] = user
+	srv := httptest.NewServer(cfg.routes())
+	defer srv.Close()
+
+	body := `{"email": "user@example.com", "password": "a different horse staple"}`
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/api/users", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	doRequest(t, srv.Client(), req, http.StatusInternalServerError).Body.Close()
+	if len(db.verificationLog) != 0 || db.users[user.ID].HashedPassword != "not-a-hash" {
+		t.Errorf("password changed despite the error")
+	}
+}
+
+func TestLoginUnknownEmailAudit(t *testing.T) {
+	db := newMemDB()
+	cfg := newTestConfig(t, db)
+	srv := httptest.NewServer(cfg.routes())
+	defer srv.Close()
+
+	const email = "nobody@example.com"
+	body := `{"email":"` + email + `","password":"correct horse battery staple"}`
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/login", strings.NewReader(body))
+	doRequest(t, srv.Client(), req, http.StatusUnauthorized).Body.Close()
+
+	if len(db.auditEvents) != 1 || db.auditEvents[0].EventType != auditLoginFailed {
+		t.Fatalf("audit events = %v, expected one %s", db.auditEventTypes(), auditLoginFailed)
+	}
+	if metadata := string(db.auditEvents[0].Metadata); strings.Contains(metadata, email) {
+		t.Errorf("audit metadata = %s, expected no email", metadata)
+	}
+}
+
+func TestMiddlewareAuditImpersonation(t *testing.T) {
+	db := newMemDB()
+	cfg := newTestConfig(t, db)
+	admin, _ := addTestUser(t, cfg, db, "admin@example.com", "correct horse battery staple")
+	user, userToken := addTestUser(t, cfg, db, "user@example.com", "correct horse battery staple")
+	impersonationToken, err := auth.MakeJWT(user.ID, cfg.jwtKeys, accessTokenTTL, auth.WithActor(admin.ID))
+	if err != nil {
+		t.Fatalf("MakeJWT() error = %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		token          string
+		auditErr       error
+		expectedStatus int
+		expectedAudit  bool
+	}{
+		{name: "Write while impersonating", method: http.MethodPost, token: impersonationToken, expectedStatus: http.StatusNoContent, expectedAudit: true},
+		{name: "Read while impersonating", method: http.MethodGet, token: impersonationToken, expectedStatus: http.StatusNoContent},
+		{name: "Write as the user", method: http.MethodPost, token: userToken, expectedStatus: http.StatusNoContent},
+		{name: "Invalid token", method: http.MethodPost, token: "not-a-jwt", expectedStatus: http.StatusNoContent},
+		{name: "Audit log unavailable", method: http.MethodDelete, token: impersonationToken, auditErr: errors.New("connection reset"), expectedStatus: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.auditEvents = nil
+			db.auditErr = tt.auditErr
+			reached := false
+			handler := cfg.middlewareAuditImpersonation(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			req := httptest.NewRequest(tt.method, "/api/chirps", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("status = %d, expected %d", w.Code, tt.expectedStatus)
+			}
+			if reached != (tt.expectedStatus == http.StatusNoContent) {
+				t.Errorf("handler reached = %v, expected %v", reached, !reached)
+			}
+			if !tt.expectedAudit {
+				if len(db.auditEvents) != 0 {
+					t.Errorf("audit events = %v, expected none", db.auditEventTypes())
+				}
+				return
+			}
+			if len(db.auditEvents) != 1 {
+				t.Fatalf("audit events = %v, expected one", db.auditEventTypes())
+			}
+			event := db.auditEvents[0]
+			if event.EventType != auditImpersonationWrite || event.UserID.UUID != user.ID || event.ActorID != (uuid.NullUUID{UUID: admin.ID, Valid: true}) {
+				t.Errorf("audit event = %+v, expected %s of %v by %v", event, auditImpersonationWrite, user.ID, admin.ID)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyFromEnv(t *testing.T) {
+	corpus := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(corpus, nil, 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	tests := []struct {
+		name             string
+		platform         string
+		file             string
+		expectedError    bool
+		expectedBreached bool
+	}{
+		{name: "Production with a file", platform: "prod", file: corpus, expectedBreached: true},
+		{name: "Production without a file", platform: "prod", expectedError: true},
+		{name: "Production opting out", platform: "prod", file: "off"},
+		{name: "Dev without a file", platform: "dev"},
+		{name: "Missing file", platform: "dev", file: filepath.Join(t.TempDir(), "missing.txt"), expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("BREACHED_PASSWORDS_FILE", tt.file)
+			policy, err := passwordPolicyFromEnv(tt.platform)
+			if (err != nil) != tt.expectedError {
+				t.Fatalf("passwordPolicyFromEnv() error = %v, expected error %v", err, tt.expectedError)
+			}
+			if (policy.Breached != nil) != tt.expectedBreached {
+				t.Errorf("passwordPolicyFromEnv() breach check = %v, expected %v", policy.Breached != nil, tt.expectedBreached)
+			}
+		})
+	}
+}
+
+func TestParsePageQuery(t *testing.T) {
+	cursor := pageCursor{CreatedAt: time.Date(2026, 10, 18, 12, 0, 0, 123456000, time.UTC), ID: uuid.New(), Prev: true}
+	tests := []struct {
+		name          string
+		query         string
+		expectedPage  pageQuery
+		expectedError string
+	}{
+		{name: "Defaults", expectedPage: pageQuery{limit: defaultPageLimit}},
+		{name: "Descending", query: "sort=desc", expectedPage: pageQuery{limit: defaultPageLimit, desc: true}},
+		{name: "Ascending", query: "sort=asc&limit=5", expectedPage: pageQuery{limit: 5}},
+		{name: "Unknown sort order", query: "sort=random", expectedError: "invalid sort order"},
+		{name: "Smallest limit", query: "limit=1", expectedPage: pageQuery{limit: 1}},
+		{name: "Limit capped", query: "limit=1000", expectedPage: pageQuery{limit: maxPageLimit}},
+		{name: "Zero limit", query: "limit=0", expectedError: "invalid limit"},
+		{name: "Negative limit", query: "limit=-3", expectedError: "invalid limit"},
+		{name: "Limit not a number", query: "limit=ten", expectedError: "invalid limit"},
+		{name: "Cursor round trip", query: "cursor=" + encodeCursor(cursor), expectedPage: pageQuery{cursor: &cursor, limit: defaultPageLimit}},
+		{name: "Cursor not base64", query: "cursor=not*base64", expectedError: "invalid cursor"},
+		{name: "Cursor not JSON", query: "cursor=" + base64.RawURLEncoding.EncodeToString([]byte("{oops")), expectedError: "invalid cursor"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/chirps?"+tt.query, nil)
+			page, err := parsePageQuery(r)
+			if tt.expectedError != "" {
+				if err == nil || err.Error() != tt.expectedError {
+					t.Fatalf("parsePageQuery() error = %v, expected %q", err, tt.expectedError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePageQuery() error = %v", err)
+			}
+			if page.limit != tt.expectedPage.limit || page.desc != tt.expectedPage.desc {
+				t.Errorf("parsePageQuery() = %+v, expected %+v", page, tt.expectedPage)
+			}
+			if (page.cursor == nil) != (tt.expectedPage.cursor == nil) {
+				t.Fatalf("parsePageQuery() cursor = %v, expected %v", page.cursor, tt.expectedPage.cursor)
+			}
+			if page.cursor != nil && (!page.cursor.CreatedAt.Equal(cursor.CreatedAt) || page.cursor.ID != cursor.ID || page.cursor.Prev != cursor.Prev) {
+				t.Errorf("parsePageQuery() cursor = %+v, expected %+v", *page.cursor, cursor)
+			}
+		})
+	}
+}
+
+func TestBuildPage(t *testing.T) {
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	rows := []pageCursor{}
+	for i := range 5 {
+		rows = append(rows, pageCursor{CreatedAt: start.Add(time.Duration(i) * time.Minute), ID: uuid.New()})
+	}
+	key := func(c pageCursor) pageCursor { return c }
+	after := func(i int) *pageCursor { return &rows[i] }
+	before := func(i int) *pageCursor {
+		c := rows[i]
+		c.Prev = true
+		return &c
+	}
+
+	tests := []struct {
+		name         string
+		page         pageQuery
+		fetched      []pageCursor
+		expectedRows []pageCursor
+		expectedNext *pageCursor
+		expectedPrev *pageCursor
+	}{
+		{
+			name:         "First page",
+			page:         pageQuery{limit: 2},
+			fetched:      rows[:3],
+			expectedRows: rows[:2],
+			expectedNext: after(1),
+		},
+		{
+			name:         "Middle page",
+			page:         pageQuery{limit: 2, cursor: after(1)},
+			fetched:      rows[2:5],
+			expectedRows: rows[2:4],
+			expectedNext: after(3),
+			expectedPrev: before(2),
+		},
+		{
+			name:         "Last page",
+			page:         pageQuery{limit: 2, cursor: after(3)},
+			fetched:      rows[4:],
+			expectedRows: rows[4:],
+			expectedPrev: before(4),
+		},
+		{
+			name:         "Everything fits on the first page",
+			page:         pageQuery{limit: 5},
+			fetched:      rows,
+			expectedRows: rows,
+		},
+		{
+			name:         "Back from the last page",
+			page:         pageQuery{limit: 2, cursor: before(4)},
+			fetched:      []pageCursor{rows[3], rows[2], rows[1]},
+			expectedRows: rows[2:4],
+			expectedNext: after(3),
+			expectedPrev: before(2),
+		},
+		{
+			name:         "Back to the first page",
+			page:         pageQuery{limit: 2, cursor: before(2)},
+			fetched:      []pageCursor{rows[1], rows[0]},
+			expectedRows: rows[:2],
+			expectedNext: after(1),
+		},
+		{
+			name:         "Descending first page",
+			page:         pageQuery{limit: 2, desc: true},
+			fetched:      []pageCursor{rows[4], rows[3], rows[2]},
+			expectedRows: []pageCursor{rows[4], rows[3]},
+			expectedNext: after(3),
+		},
+		{
+			name:         "Every row for unpaged clients",
+			page:         pageQuery{limit: 2, all: true},
+			fetched:      rows,
+			expectedRows: rows,
+		},
+		{
+			name:    "Past the end",
+			page:    pageQuery{limit: 2, cursor: after(4)},
+			fetched: []pageCursor{},
+		},
+	}
+
+	cursorString := func(c *pageCursor) string {
+		if c == nil {
+			return ""
+		}
+		return encodeCursor(*c)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, next, prev := buildPage(tt.page, slices.Clone(tt.fetched), key)
+			if !slices.Equal(got, tt.expectedRows) {
+				t.Errorf("buildPage() rows = %v, expected %v", got, tt.expectedRows)
+			}
+			if expected := cursorString(tt.expectedNext); next != expected {
+				t.Errorf("buildPage() next cursor = %q, expected %q", next, expected)
+			}
+			if expected := cursorString(tt.expectedPrev); prev != expected {
+				t.Errorf("buildPage() prev cursor = %q, expected %q", prev, expected)
+			}
+		})
+	}
+}
+
+func TestChirpsGetPaging(t *testing.T) {
+	db := newMemDB()
+	cfg := newTestConfig(t, db)
+	author, _ := addTestUser(t, cfg, db, "author@example.com", "correct horse battery staple")
+	for range 3 {
+		addTestChirp(db, author.ID, chirpKindPost, uuid.Nil)
+	}
+	srv := httptest.NewServer(cfg.routes())
+	defer srv.Close()
+
+	get := func(path string) ([]Chirp, map[string]string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		resp := doRequest(t, srv.Client(), req, http.StatusOK)
+		links := map[string]string{}
+		for _, link := range resp.Header.Values("Link") {
+			target, rel, _ := strings.Cut(link, ">; rel=")
+			links[strings.Trim(rel, `"`)] = strings.TrimPrefix(target, "<")
+		}
+		chirps := []Chirp{}
+		decodeBody(t, resp, &chirps)
+		return chirps, links
+	}
+
+	all, links := get("/api/chirps")
+	if len(all) != 3 || len(links) != 0 {
+		t.Fatalf("GET /api/chirps = %d chirps, links %v, expected all 3 and no links", len(all), links)
+	}
+
+	first, links := get("/api/chirps?limit=2")
+	if len(first) != 2 || first[0].ID != all[0].ID || links["prev"] != "" {
+		t.Fatalf("first page = %d chirps, links %v, expected the first 2 and no prev link", len(first), links)
+	}
+	last, links := get(links["next"])
+	if len(last) != 1 || last[0].ID != all[2].ID || links["next"] != "" {
+		t.Fatalf("last page = %d chirps, links %v, expected the last chirp and no next link", len(last), links)
+	}
+	back, _ := get(links["prev"])
+	if len(back) != 2 || back[0].ID != all[0].ID || back[1].ID != all[1].ID {
+		t.Errorf("prev page = %v, expected the first 2 chirps", back)
+	}
+}
+
+func doRequest(t *testing.T, client *http.Client, req *http.Request, expectedStatus int) *http.Response {
+	t.Helper()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s error = %v", req.Method, req.URL.Path, err)
+	}
+	if resp.StatusCode != expectedStatus {
+		dat, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		t.Fatalf("%s %s = %d %s, expected %d", req.Method, req.URL.Path, resp.StatusCode, dat, expectedStatus)
+	}
+	return resp
+}
+
+func decodeBody(t *testing.T, resp *http.Response, v any) {
+	t.Helper()
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+}
@@ -0,0 +1,906 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Numpkens/chirpy/internal/auth"
+	"github.com/Numpkens/chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+// OAuthClient is a third-party app registered by a user. ClientSecret is only
+// set in the response that registers a confidential client.
+type OAuthClient struct {
+	ID            uuid.UUID `json:"client_id"`
+	Name          string    `json:"name"`
+	RedirectURIs  []string  `json:"redirect_uris"`
+	Scopes        []string  `json:"scopes"`
+	Confidential  bool      `json:"confidential"`
+	CanIntrospect bool      `json:"can_introspect"`
+	CreatedAt     time.Time `json:"created_at"`
+	ClientSecret  string    `json:"client_secret,omitempty"`
+}
+
+// oauthError is an error response in the form RFC 6749 defines, both for the
+// token endpoint and for redirects back to a client.
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *oauthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// introspectionResponse is an RFC 7662 token introspection response. Only
+// Active is set for a token that isn't.
+type introspectionResponse struct {
+	Active    bool   `json:"active"`
+	Sub       string `json:"sub,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	// Act names the admin behind an impersonation token, as in RFC 8693.
+	Act *auth.Actor `json:"act,omitempty"`
+}
+
+// authorizeRequest is a validated OAuth authorization request.
+type authorizeRequest struct {
+	Client        database.OauthClient
+	RedirectURI   string
+	Scopes        []string
+	State         string
+	CodeChallenge string
+	Nonce         string
+}
+
+var scopeDescriptions = map[string]string{
+	auth.ScopeChirpsRead:   "Read chirps",
+	auth.ScopeChirpsWrite:  "Post and delete chirps as you",
+	auth.ScopeProfileWrite: "Change your email address and password",
+	auth.ScopeOpenID:       "Sign you in with your Chirpy account",
+	auth.ScopeEmail:        "See your email address",
+}
+
+// oidcConfiguration is the OpenID Connect discovery document.
+type oidcConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+type userInfo struct {
+	Sub           uuid.UUID `json:"sub"`
+	Email         string    `json:"email,omitempty"`
+	EmailVerified *bool     `json:"email_verified,omitempty"`
+}
+
+var consentPage = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Authorize {{.ClientName}}</title>
+</head>
+<body>
+<h1>{{.ClientName}} wants to use your Chirpy account</h1>
+<p>It will be able to:</p>
+<ul>
+{{range .Scopes}}<li>{{.}}</li>
+{{end}}</ul>
+{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+<form method="post" action="/api/oauth/authorize">
+<input type="hidden" name="response_type" value="code">
+<input type="hidden" name="client_id" value="{{.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+<input type="hidden" name="scope" value="{{.Scope}}">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="code_challenge" value="{{.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="S256">
+<input type="hidden" name="nonce" value="{{.Nonce}}">
+<p><label>Email <input type="email" name="email" value="{{.Email}}" required></label></p>
+<p><label>Password <input type="password" name="password" required></label></p>
+<p><label>Two-factor code, if enabled <input type="text" name="code" inputmode="numeric" autocomplete="one-time-code"></label></p>
+<p><label>Or a recovery code <input type="text" name="recovery_code"></label></p>
+<button type="submit" name="action" value="allow">Allow</button>
+<button type="submit" name="action" value="deny" formnovalidate>Deny</button>
+</form>
+</body>
+</html>
+`))
+
+func (cfg *apiConfig) handlerOAuthClientsCreate(w http.ResponseWriter, r *http.Request) {
+	caller, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !caller.isSession() {
+		respondWithError(w, http.StatusForbidden, "Requires a login session")
+		return
+	}
+
+	type parameters struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	name := strings.TrimSpace(params.Name)
+	if name == "" || len(name) > 100 {
+		respondWithError(w, http.StatusBadRequest, "Name must be between 1 and 100 characters")
+		return
+	}
+	if len(params.RedirectURIs) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one redirect URI is required")
+		return
+	}
+	for _, uri := range params.RedirectURIs {
+		if err := auth.ValidateRedirectURI(uri); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	scopes, err := auth.NormalizeOAuthScopes(params.Scopes)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(scopes) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one scope is required")
+		return
+	}
+	if slices.Contains(scopes, auth.ScopeOpenID) && !cfg.oidcEnabled() {
+		respondWithError(w, http.StatusBadRequest, "OpenID Connect is not enabled on this server")
+		return
+	}
+
+	secret := ""
+	secretHash := sql.NullString{}
+	if params.Confidential {
+		secret, err = auth.MakeOpaqueToken()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create client")
+			return
+		}
+		secretHash = sql.NullString{String: auth.HashToken(secret), Valid: true}
+	}
+	client, err := cfg.db.CreateOAuthClient(r.Context(), database.CreateOAuthClientParams{
+		OwnerID:      caller.UserID,
+		Name:         name,
+		SecretHash:   secretHash,
+		RedirectUris: params.RedirectURIs,
+		Scopes:       scopes,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create client")
+		return
+	}
+	resp := oauthClientFromDB(client)
+	resp.ClientSecret = secret
+	respondWithJSON(w, http.StatusCreated, resp)
+}
+
+func (cfg *apiConfig) handlerOAuthClientsList(w http.ResponseWriter, r *http.Request) {
+	caller, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !caller.isSession() {
+		respondWithError(w, http.StatusForbidden, "Requires a login session")
+		return
+	}
+	dbClients, err := cfg.db.ListOAuthClients(r.Context(), caller.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching clients")
+		return
+	}
+	clients := []OAuthClient{}
+	for _, dbClient := range dbClients {
+		clients = append(clients, oauthClientFromDB(dbClient))
+	}
+	respondWithJSON(w, http.StatusOK, clients)
+}
+
+// handlerOAuthClientsDelete removes a client along with every token it holds.
+func (cfg *apiConfig) handlerOAuthClientsDelete(w http.ResponseWriter, r *http.Request) {
+	caller, err := cfg.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !caller.isSession() {
+		respondWithError(w, http.StatusForbidden, "Requires a login session")
+		return
+	}
+	clientID, err := uuid.Parse(r.PathValue("clientID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	deleted, err := cfg.db.DeleteOAuthClient(r.Context(), database.DeleteOAuthClientParams{
+		ID:      clientID,
+		OwnerID: caller.UserID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete client")
+		return
+	}
+	if deleted == 0 {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func oauthClientFromDB(c database.OauthClient) OAuthClient {
+	return OAuthClient{
+		ID:            c.ID,
+		Name:          c.Name,
+		RedirectURIs:  c.RedirectUris,
+		Scopes:        c.Scopes,
+		Confidential:  c.SecretHash.Valid,
+		CanIntrospect: c.CanIntrospect,
+		CreatedAt:     c.CreatedAt,
+	}
+}
+
+// handlerOAuthAuthorize shows the consent page for an authorization request.
+func (cfg *apiConfig) handlerOAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	req, err := cfg.parseAuthorizeRequest(r.Context(), r.URL.Query())
+	if handleAuthorizeError(w, r, req, err) {
+		return
+	}
+	renderConsent(w, http.StatusOK, req, "", "")
+}
+
+// handlerOAuthAuthorizeSubmit handles the consent form. The user signs in on
+// the form itself, so the client never sees their password, and allowing
+// access sends them back to the client with a single-use code.
+func (cfg *apiConfig) handlerOAuthAuthorizeSubmit(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	req, err := cfg.parseAuthorizeRequest(r.Context(), r.PostForm)
+	if handleAuthorizeError(w, r, req, err) {
+		return
+	}
+	if r.PostForm.Get("action") != "allow" {
+		redirectAuthorize(w, r, req, url.Values{"error": {"access_denied"}})
+		return
+	}
+
+	email := r.PostForm.Get("email")
+	password := r.PostForm.Get("password")
+	throttleKeys := loginThrottleKeys(email, r)
+	retryAt, err := cfg.loginRetryAt(r.Context(), throttleKeys)
+	if err != nil {
+		http.Error(w, "Couldn't check login attempts", http.StatusInternalServerError)
+		return
+	}
+	if retryAt.After(time.Now().UTC()) {
+		renderConsent(w, http.StatusTooManyRequests, req, email, "Too many login attempts, try again later")
+		return
+	}
+	user, err := cfg.db.GetUserByEmail(r.Context(), email)
+	if err != nil {
+		auth.CheckPasswordHash(password, cfg.dummyHash)
+		cfg.recordLoginFailure(r.Context(), throttleKeys)
+		cfg.audit(r, auditEvent{
+			Type:     auditLoginFailed,
+			Metadata: map[string]any{"reason": "unknown_email", "client_id": req.Client.ID},
+		})
+		renderConsent(w, http.StatusUnauthorized, req, email, "Incorrect email or password")
+		return
+	}
+	match, err := auth.CheckPasswordHash(password, user.HashedPassword)
+	if err != nil || !match {
+		cfg.recordLoginFailure(r.Context(), throttleKeys)
+		cfg.audit(r, auditEvent{
+			Type:     auditLoginFailed,
+			UserID:   user.ID,
+			Metadata: map[string]any{"reason": "wrong_password", "client_id": req.Client.ID},
+		})
+		renderConsent(w, http.StatusUnauthorized, req, email, "Incorrect email or password")
+		return
+	}
+	if user.TotpEnabled {
+		ok, err := cfg.checkSecondFactor(r.Context(), user, r.PostForm.Get("code"), r.PostForm.Get("recovery_code"))
+		if err != nil {
+			http.Error(w, "Couldn't check code", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			cfg.recordLoginFailure(r.Context(), throttleKeys)
+			cfg.audit(r, auditEvent{
+				Type:     auditLoginFailed,
+				UserID:   user.ID,
+				Metadata: map[string]any{"reason": "wrong_code", "client_id": req.Client.ID},
+			})
+			renderConsent(w, http.StatusUnauthorized, req, email, "Enter a current two-factor code or an unused recovery code")
+			return
+		}
+	}
+	cfg.db.ClearLoginThrottle(r.Context(), throttleKeys[0])
+	cfg.rehashPasswordIfNeeded(r.Context(), user, password)
+	method := "password"
+	if user.TotpEnabled {
+		method = secondFactorMethod(r.PostForm.Get("recovery_code"))
+	}
+	cfg.audit(r, auditEvent{
+		Type:     auditLoginSucceeded,
+		UserID:   user.ID,
+		ActorID:  user.ID,
+		Metadata: map[string]any{"method": method, "client_id": req.Client.ID},
+	})
+
+	code, err := auth.MakeOpaqueToken()
+	if err != nil {
+		http.Error(w, "Couldn't create authorization code", http.StatusInternalServerError)
+		return
+	}
+	err = cfg.db.CreateAuthorizationCode(r.Context(), database.CreateAuthorizationCodeParams{
+		CodeHash:      auth.HashToken(code),
+		ClientID:      req.Client.ID,
+		UserID:        user.ID,
+		RedirectUri:   req.RedirectURI,
+		Scopes:        req.Scopes,
+		CodeChallenge: req.CodeChallenge,
+		FamilyID:      uuid.New(),
+		ExpiresAt:     time.Now().UTC().Add(oauthCodeTTL),
+		Nonce:         req.Nonce,
+	})
+	if err != nil {
+		http.Error(w, "Couldn't create authorization code", http.StatusInternalServerError)
+		return
+	}
+	redirectAuthorize(w, r, req, url.Values{"code": {code}})
+}
+
+// parseAuthorizeRequest validates an authorization request. A bad client or
+// redirect URI is returned as a plain error to show to the user, since
+// redirecting would send them somewhere unverified. Anything else is an
+// *oauthError to send back to the client.
+func (cfg *apiConfig) parseAuthorizeRequest(ctx context.Context, form url.Values) (authorizeRequest, error) {
+	clientID, err := uuid.Parse(form.Get("client_id"))
+	if err != nil {
+		return authorizeRequest{}, fmt.Errorf("unknown client")
+	}
+	client, err := cfg.db.GetOAuthClient(ctx, clientID)
+	if err != nil {
+		return authorizeRequest{}, fmt.Errorf("unknown client")
+	}
+	redirectURI := form.Get("redirect_uri")
+	if !slices.Contains(client.RedirectUris, redirectURI) {
+		return authorizeRequest{}, fmt.Errorf("redirect URI is not registered for this client")
+	}
+
+	req := authorizeRequest{
+		Client:      client,
+		RedirectURI: redirectURI,
+		State:       form.Get("state"),
+		Nonce:       form.Get("nonce"),
+	}
+	if form.Get("response_type") != "code" {
+		return req, &oauthError{Code: "unsupported_response_type", Description: "only the code response type is supported"}
+	}
+	req.CodeChallenge = form.Get("code_challenge")
+	if req.CodeChallenge == "" || form.Get("code_challenge_method") != auth.PKCEMethodS256 {
+		return req, &oauthError{Code: "invalid_request", Description: "PKCE with code_challenge_method S256 is required"}
+	}
+	scopes, err := auth.ParseScope(form.Get("scope"))
+	if err != nil {
+		return req, &oauthError{Code: "invalid_scope", Description: err.Error()}
+	}
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(client.Scopes, scope) {
+			return req, &oauthError{Code: "invalid_scope", Description: fmt.Sprintf("client may not request scope %q", scope)}
+		}
+	}
+	if slices.Contains(scopes, auth.ScopeOpenID) && !cfg.oidcEnabled() {
+		return req, &oauthError{Code: "invalid_scope", Description: "OpenID Connect is not enabled on this server"}
+	}
+	req.Scopes = scopes
+	return req, nil
+}
+
+// handleAuthorizeError answers an invalid authorization request, and reports
+// whether there was an error to answer.
+func handleAuthorizeError(w http.ResponseWriter, r *http.Request, req authorizeRequest, err error) bool {
+	if err == nil {
+		return false
+	}
+	var oauthErr *oauthError
+	if errors.As(err, &oauthErr) {
+		redirectAuthorize(w, r, req, url.Values{
+			"error":             {oauthErr.Code},
+			"error_description": {oauthErr.Description},
+		})
+		return true
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+	return true
+}
+
+// redirectAuthorize sends the user back to the client's redirect URI with
+// params and the request's state.
+func redirectAuthorize(w http.ResponseWriter, r *http.Request, req authorizeRequest, params url.Values) {
+	// Registered redirect URIs were validated when the client was created.
+	u, _ := url.Parse(req.RedirectURI)
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	u.RawQuery = query.Encode()
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+func renderConsent(w http.ResponseWriter, status int, req authorizeRequest, email, errMsg string) {
+	scopes := []string{}
+	for _, scope := range req.Scopes {
+		scopes = append(scopes, scopeDescriptions[scope])
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// The page must not be framed, or another site could trick users into
+	// clicking Allow.
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(status)
+	err := consentPage.Execute(w, struct {
+		ClientName    string
+		ClientID      uuid.UUID
+		RedirectURI   string
+		Scope         string
+		Scopes        []string
+		State         string
+		CodeChallenge string
+		Nonce         string
+		Email         string
+		Error         string
+	}{
+		ClientName:    req.Client.Name,
+		ClientID:      req.Client.ID,
+		RedirectURI:   req.RedirectURI,
+		Scope:         auth.FormatScope(req.Scopes),
+		Scopes:        scopes,
+		State:         req.State,
+		CodeChallenge: req.CodeChallenge,
+		Nonce:         req.Nonce,
+		Email:         email,
+		Error:         errMsg,
+	})
+	if err != nil {
+		log.Printf("Error rendering consent page: %s", err)
+	}
+}
+
+// handlerOAuthToken is the token endpoint. It supports the
+// authorization_code grant, with PKCE, and the refresh_token grant.
+func (cfg *apiConfig) handlerOAuthToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if err := r.ParseForm(); err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_request", "malformed form body")
+		return
+	}
+	client, err := cfg.authenticateClient(r)
+	if err != nil {
+		if _, _, ok := r.BasicAuth(); ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+		}
+		respondWithOAuthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		cfg.grantAuthorizationCode(w, r, client)
+	case "refresh_token":
+		cfg.grantRefreshToken(w, r, client)
+	default:
+		respondWithOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+}
+
+func (cfg *apiConfig) grantAuthorizationCode(w http.ResponseWriter, r *http.Request, client database.OauthClient) {
+	codeHash := auth.HashToken(r.PostForm.Get("code"))
+	code, err := cfg.db.UseAuthorizationCode(r.Context(), codeHash)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			respondWithOAuthError(w, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+		// A code is only good once. If it comes back, whoever redeemed it
+		// first may not have been the client, so revoke what it was
+		// exchanged for.
+		if used, err := cfg.db.GetAuthorizationCode(r.Context(), codeHash); err == nil && used.UsedAt.Valid {
+			cfg.db.RevokeRefreshTokenFamily(r.Context(), used.FamilyID)
+		}
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "invalid or expired code")
+		return
+	}
+	if code.ClientID != client.ID || code.RedirectUri != r.PostForm.Get("redirect_uri") {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "code was issued to another client or redirect URI")
+		return
+	}
+	if !auth.VerifyPKCE(r.PostForm.Get("code_verifier"), code.CodeChallenge) {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "code_verifier doesn't match the code challenge")
+		return
+	}
+	cfg.respondWithOAuthTokens(w, r, client.ID, code.UserID, code.FamilyID, code.Scopes, code.Nonce)
+}
+
+// grantRefreshToken rotates a client's refresh token. The new tokens carry the
+// scopes of the original grant; narrowing them with a scope parameter isn't
+// supported.
+func (cfg *apiConfig) grantRefreshToken(w http.ResponseWriter, r *http.Request, client database.OauthClient) {
+	clientID := uuid.NullUUID{UUID: client.ID, Valid: true}
+	storedToken, err := cfg.useRefreshToken(r, r.PostForm.Get("refresh_token"), clientID)
+	if err != nil {
+		if errors.Is(err, errInvalidRefreshToken) {
+			respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "invalid refresh token")
+			return
+		}
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	cfg.audit(r, auditEvent{
+		Type:     auditTokenRefreshed,
+		UserID:   storedToken.UserID,
+		Metadata: map[string]any{"family_id": storedToken.FamilyID, "client_id": client.ID},
+	})
+	cfg.respondWithOAuthTokens(w, r, client.ID, storedToken.UserID, storedToken.FamilyID, storedToken.Scopes, "")
+}
+
+// respondWithOAuthTokens issues an access and refresh token for a grant, and
+// an ID token if the openid scope was granted. nonce is only set when the
+// grant came straight from an authorization request.
+func (cfg *apiConfig) respondWithOAuthTokens(w http.ResponseWriter, r *http.Request, clientID, userID, familyID uuid.UUID, scopes []string, nonce string) {
+	accessToken, err := auth.MakeJWT(userID, cfg.jwtKeys, accessTokenTTL,
+		auth.WithClientID(clientID.String()),
+		auth.WithScopes(scopes),
+	)
+	if err != nil {
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	refreshToken, err := cfg.issueRefreshToken(r, database.CreateRefreshTokenParams{
+		UserID:   userID,
+		FamilyID: familyID,
+		ClientID: uuid.NullUUID{UUID: clientID, Valid: true},
+		Scopes:   scopes,
+	})
+	if err != nil {
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	idToken := ""
+	if slices.Contains(scopes, auth.ScopeOpenID) {
+		user, err := cfg.db.GetUserByID(r.Context(), userID)
+		if err != nil {
+			respondWithOAuthError(w, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+		claims := auth.IDTokenClaims{Nonce: nonce}
+		if slices.Contains(scopes, auth.ScopeEmail) {
+			claims.Email = user.Email
+			claims.EmailVerified = &user.EmailVerified
+		}
+		idToken, err = auth.MakeIDToken(cfg.publicURL, clientID.String(), userID, cfg.jwtKeys, accessTokenTTL, claims)
+		if err != nil {
+			respondWithOAuthError(w, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+	}
+	respondWithJSON(w, http.StatusOK, oauthTokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        auth.FormatScope(scopes),
+		IDToken:      idToken,
+	})
+}
+
+// oidcEnabled reports whether ID tokens can be issued. They are signed like
+// access tokens, so that takes an asymmetric key from JWT_KEYS_DIR: handing
+// relying parties the HS256 secret would let them forge access tokens.
+func (cfg *apiConfig) oidcEnabled() bool {
+	return cfg.jwtKeys.Current().Asymmetric()
+}
+
+// handlerUserInfo is the OpenID Connect userinfo endpoint. The email claims
+// need the email scope.
+func (cfg *apiConfig) handlerUserInfo(w http.ResponseWriter, r *http.Request) {
+	caller, err := cfg.authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if !caller.hasScope(auth.ScopeOpenID) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		respondWithError(w, http.StatusForbidden, "Insufficient scope")
+		return
+	}
+	user, err := cfg.db.GetUserByID(r.Context(), caller.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user")
+		return
+	}
+	info := userInfo{Sub: user.ID}
+	if caller.hasScope(auth.ScopeEmail) {
+		info.Email = user.Email
+		info.EmailVerified = &user.EmailVerified
+	}
+	respondWithJSON(w, http.StatusOK, info)
+}
+
+// handlerOIDCConfiguration serves the discovery document. Without an
+// asymmetric key it still describes the OAuth endpoints, but offers no ID
+// token algorithms or OpenID Connect scopes.
+func (cfg *apiConfig) handlerOIDCConfiguration(w http.ResponseWriter, r *http.Request) {
+	algs, scopes := []string{}, auth.KnownScopes()
+	if cfg.oidcEnabled() {
+		algs, scopes = []string{cfg.jwtKeys.Current().Method.Alg()}, auth.OAuthScopes()
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, oidcConfiguration{
+		Issuer:                            cfg.publicURL,
+		AuthorizationEndpoint:             cfg.publicURL + "/api/oauth/authorize",
+		TokenEndpoint:                     cfg.publicURL + "/api/oauth/token",
+		IntrospectionEndpoint:             cfg.publicURL + "/api/oauth/introspect",
+		UserinfoEndpoint:                  cfg.publicURL + "/api/oauth/userinfo",
+		RevocationEndpoint:                cfg.publicURL + "/api/oauth/revoke",
+		JWKSURI:                           cfg.publicURL + "/.well-known/jwks.json",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  algs,
+		ScopesSupported:                   scopes,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{auth.PKCEMethodS256},
+		ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "nonce", "email", "email_verified"},
+	})
+}
+
+// handlerOAuthRevoke implements RFC 7009. A refresh token revokes the whole
+// grant; an access token only itself. As the RFC requires, unknown tokens are
+// not an error.
+func (cfg *apiConfig) handlerOAuthRevoke(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_request", "malformed form body")
+		return
+	}
+	client, err := cfg.authenticateClient(r)
+	if err != nil {
+		respondWithOAuthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+	token := r.PostForm.Get("token")
+	if claims, err := auth.ValidateJWT(token, cfg.jwtKeys, cfg.denylist); err == nil {
+		if claims.ClientID == client.ID.String() && claims.ID != "" {
+			if err := cfg.revokeAccessToken(r.Context(), claims.UserID, claims.ID, claims.ExpiresAt.Time); err != nil {
+				respondWithOAuthError(w, http.StatusInternalServerError, "server_error", "")
+				return
+			}
+			cfg.audit(r, auditEvent{
+				Type:     auditTokenRevoked,
+				UserID:   claims.UserID,
+				Metadata: map[string]any{"token_id": claims.ID, "client_id": client.ID},
+			})
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	storedToken, err := cfg.db.GetRefreshToken(r.Context(), auth.HashToken(token))
+	if err == nil && storedToken.ClientID == (uuid.NullUUID{UUID: client.ID, Valid: true}) {
+		if err := cfg.db.RevokeRefreshTokenFamily(r.Context(), storedToken.FamilyID); err != nil {
+			respondWithOAuthError(w, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+		cfg.audit(r, auditEvent{
+			Type:     auditTokenRevoked,
+			UserID:   storedToken.UserID,
+			Metadata: map[string]any{"family_id": storedToken.FamilyID, "client_id": client.ID},
+		})
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlerOAuthIntrospect implements RFC 7662 for service clients, telling
+// them whether an access, refresh or personal access token is active and
+// whose it is.
+func (cfg *apiConfig) handlerOAuthIntrospect(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if err := r.ParseForm(); err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_request", "malformed form body")
+		return
+	}
+	client, err := cfg.authenticateClient(r)
+	if err != nil {
+		if _, _, ok := r.BasicAuth(); ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+		}
+		respondWithOAuthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+	if !client.CanIntrospect || !client.SecretHash.Valid {
+		respondWithOAuthError(w, http.StatusForbidden, "unauthorized_client", "client may not introspect tokens")
+		return
+	}
+	resp, err := cfg.introspect(r.Context(), r.PostForm.Get("token"))
+	if err != nil {
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// introspect looks a token up wherever its kind is kept. Access tokens are
+// checked against the database as well as the denylist, which may not have
+// caught up with other instances yet. First-party tokens carry every scope
+// but the OpenID Connect ones, which only OAuth clients are granted.
+func (cfg *apiConfig) introspect(ctx context.Context, token string) (introspectionResponse, error) {
+	inactive := introspectionResponse{}
+	allScopes := auth.FormatScope(auth.KnownScopes())
+
+	if auth.IsPersonalAccessToken(token) {
+		pat, err := cfg.db.GetActivePersonalAccessToken(ctx, auth.HashToken(token))
+		if err == sql.ErrNoRows {
+			return inactive, nil
+		}
+		if err != nil {
+			return inactive, err
+		}
+		resp := introspectionResponse{
+			Active:    true,
+			Sub:       pat.UserID.String(),
+			Iat:       pat.CreatedAt.Unix(),
+			Scope:     auth.FormatScope(pat.Scopes),
+			TokenType: "personal_access_token",
+		}
+		if pat.ExpiresAt.Valid {
+			resp.Exp = pat.ExpiresAt.Time.Unix()
+		}
+		return resp, nil
+	}
+
+	if claims, err := auth.ValidateJWT(token, cfg.jwtKeys, cfg.denylist); err == nil {
+		revoked, err := cfg.db.IsAccessTokenRevoked(ctx, claims.ID)
+		if err != nil {
+			return inactive, err
+		}
+		user, err := cfg.db.GetUserByID(ctx, claims.UserID)
+		if err == sql.ErrNoRows {
+			return inactive, nil
+		}
+		if err != nil {
+			return inactive, err
+		}
+		if revoked || claims.IssuedAt == nil ||
+			user.TokensValidAfter.Valid && claims.IssuedBefore(user.TokensValidAfter.Time) {
+			return inactive, nil
+		}
+		resp := introspectionResponse{
+			Active:    true,
+			Sub:       claims.UserID.String(),
+			Exp:       claims.ExpiresAt.Unix(),
+			Iat:       claims.IssuedAt.Unix(),
+			Scope:     claims.Scope,
+			ClientID:  claims.ClientID,
+			TokenType: "access_token",
+		}
+		if claims.ClientID == "" {
+			resp.Scope = allScopes
+		}
+		if claims.ActorID.Valid {
+			resp.Act = &auth.Actor{Subject: claims.ActorID.UUID.String()}
+		}
+		return resp, nil
+	}
+
+	storedToken, err := cfg.db.GetRefreshToken(ctx, auth.HashToken(token))
+	if err == sql.ErrNoRows {
+		return inactive, nil
+	}
+	if err != nil {
+		return inactive, err
+	}
+	if storedToken.RevokedAt.Valid || storedToken.ExpiresAt.Before(time.Now().UTC()) {
+		return inactive, nil
+	}
+	resp := introspectionResponse{
+		Active:    true,
+		Sub:       storedToken.UserID.String(),
+		Exp:       storedToken.ExpiresAt.Unix(),
+		Iat:       storedToken.CreatedAt.Unix(),
+		Scope:     allScopes,
+		TokenType: "refresh_token",
+	}
+	if storedToken.ClientID.Valid {
+		resp.Scope = auth.FormatScope(storedToken.Scopes)
+		resp.ClientID = storedToken.ClientID.UUID.String()
+	}
+	return resp, nil
+}
+
+// authenticateClient identifies the OAuth client making a request from HTTP
+// Basic credentials or the client_id and client_secret form fields. Public
+// clients have no secret and rely on PKCE instead.
+func (cfg *apiConfig) authenticateClient(r *http.Request) (database.OauthClient, error) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	clientID, err := uuid.Parse(id)
+	if err != nil {
+		return database.OauthClient{}, err
+	}
+	client, err := cfg.db.GetOAuthClient(r.Context(), clientID)
+	if err != nil {
+		return database.OauthClient{}, err
+	}
+	if !client.SecretHash.Valid {
+		if secret != "" {
+			return database.OauthClient{}, fmt.Errorf("public clients have no secret")
+		}
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(auth.HashToken(secret)), []byte(client.SecretHash.String)) != 1 {
+		return database.OauthClient{}, fmt.Errorf("incorrect client secret")
+	}
+	return client, nil
+}
+
+func respondWithOAuthError(w http.ResponseWriter, code int, errCode, description string) {
+	respondWithJSON(w, code, oauthError{Code: errCode, Description: description})
+}
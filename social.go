@@ -0,0 +1,468 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Numpkens/chirpy/internal/database"
+	"github.com/Numpkens/chirpy/internal/hashtags"
+	"github.com/google/uuid"
+)
+
+// TrendingHashtag is a tag and how much it has been used lately. Score
+// weighs recent chirps more, and is what tags are ranked by.
+type TrendingHashtag struct {
+	Tag        string  `json:"tag"`
+	ChirpCount int64   `json:"chirp_count"`
+	Score      float64 `json:"score"`
+}
+
+// ReactionSettings are the emoji chirps can be reacted with, and how many
+// different ones a single chirp can collect.
+type ReactionSettings struct {
+	AllowedEmoji         []string  `json:"allowed_emoji"`
+	MaxDistinctReactions int32     `json:"max_distinct_reactions"`
+	UpdatedAt            time.Time `json:"updated_at"`
+}
+
+// Trending tags are scored over the last trendingWindow by default, with
+// each use losing half its weight every window/trendingHalfLives.
+const (
+	trendingWindow       = 24 * time.Hour
+	maxTrendingWindow    = 7 * 24 * time.Hour
+	trendingHalfLives    = 4
+	defaultTrendingLimit = 10
+	maxTrendingLimit     = 50
+)
+
+// handlerHashtagChirpsList pages through the chirps tagged with a hashtag,
+// which may be given with or without its #.
+func (cfg *apiConfig) handlerHashtagChirpsList(w http.ResponseWriter, r *http.Request) {
+	tag, ok := hashtags.Normalize(r.PathValue("tag"))
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid hashtag")
+		return
+	}
+	page, err := parsePageQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cursorCreatedAt, cursorID := page.cursorParams()
+	var dbChirps []database.Chirp
+	if page.ascending() {
+		dbChirps, err = cfg.db.ListHashtagChirpsAfter(r.Context(), database.ListHashtagChirpsAfterParams{
+			Tag:             tag,
+			CursorCreatedAt: cursorCreatedAt,
+			CursorID:        cursorID,
+			RowLimit:        page.fetchLimit(),
+		})
+	} else {
+		dbChirps, err = cfg.db.ListHashtagChirpsBefore(r.Context(), database.ListHashtagChirpsBeforeParams{
+			Tag:             tag,
+			CursorCreatedAt: cursorCreatedAt,
+			CursorID:        cursorID,
+			RowLimit:        page.fetchLimit(),
+		})
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching chirps")
+		return
+	}
+
+	dbChirps, next, prev := buildPage(page, dbChirps, func(c database.Chirp) pageCursor {
+		return pageCursor{CreatedAt: c.CreatedAt, ID: c.ID}
+	})
+	chirps := []Chirp{}
+	for _, dbChirp := range dbChirps {
+		chirps = append(chirps, chirpFromDB(dbChirp))
+	}
+	if err := cfg.enrichChirps(r.Context(), cfg.viewer(r), chirps); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching chirps")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, chirpPage{
+		Chirps:     chirps,
+		NextCursor: next,
+		PrevCursor: prev,
+	})
+}
+
+// handlerHashtagsTrending ranks the tags used within ?window (a duration like
+// "6h", 24h by default). Older uses fade rather than dropping out all at once
+// at the window's edge, so a tag has to keep being used to stay on top.
+func (cfg *apiConfig) handlerHashtagsTrending(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	window := trendingWindow
+	if windowStr := query.Get("window"); windowStr != "" {
+		d, err := time.ParseDuration(windowStr)
+		if err != nil || d < time.Minute || d > maxTrendingWindow {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("window must be between 1m and %v", maxTrendingWindow))
+			return
+		}
+		window = d
+	}
+	limit := defaultTrendingLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l < 1 {
+			respondWithError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = min(l, maxTrendingLimit)
+	}
+
+	rows, err := cfg.db.ListTrendingHashtags(r.Context(), database.ListTrendingHashtagsParams{
+		HalfLifeSeconds: (window / trendingHalfLives).Seconds(),
+		WindowSeconds:   window.Seconds(),
+		RowLimit:        int32(limit),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching trending hashtags")
+		return
+	}
+	trending := []TrendingHashtag{}
+	for _, row := range rows {
+		trending = append(trending, TrendingHashtag{
+			Tag:        row.Tag,
+			ChirpCount: row.ChirpCount,
+			Score:      row.Score,
+		})
+	}
+	respondWithJSON(w, http.StatusOK, trending)
+}
+
+// handlerRechirpCreate rechirps a chirp for the caller. Doing it again
+// returns the existing rechirp.
+func (cfg *apiConfig) handlerRechirpCreate(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+	id, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	original, err := cfg.resolveChirp(r.Context(), id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	originalID := uuid.NullUUID{UUID: original.ID, Valid: true}
+	rechirp, err := cfg.db.CreateRechirp(r.Context(), database.CreateRechirpParams{
+		UserID:            caller.UserID,
+		ReferencedChirpID: originalID,
+	})
+	if err == sql.ErrNoRows {
+		rechirp, err = cfg.db.GetRechirp(r.Context(), database.GetRechirpParams{
+			UserID:            caller.UserID,
+			ReferencedChirpID: originalID,
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error creating rechirp")
+			return
+		}
+		cfg.respondWithChirp(w, r, http.StatusOK, uuid.NullUUID{UUID: caller.UserID, Valid: true}, rechirp)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error creating rechirp")
+		return
+	}
+	cfg.respondWithChirp(w, r, http.StatusCreated, uuid.NullUUID{UUID: caller.UserID, Valid: true}, rechirp)
+}
+
+func (cfg *apiConfig) handlerRechirpDelete(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+	id, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	original, err := cfg.resolveChirp(r.Context(), id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	deleted, err := cfg.db.DeleteRechirp(r.Context(), database.DeleteRechirpParams{
+		UserID:            caller.UserID,
+		ReferencedChirpID: uuid.NullUUID{UUID: original.ID, Valid: true},
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error deleting rechirp")
+		return
+	}
+	if deleted == 0 {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerLikeCreate(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+	id, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	chirp, err := cfg.resolveChirp(r.Context(), id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	err = cfg.db.LikeChirp(r.Context(), database.LikeChirpParams{
+		UserID:  caller.UserID,
+		ChirpID: chirp.ID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error liking chirp")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerLikeDelete(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+	id, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	chirp, err := cfg.resolveChirp(r.Context(), id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	deleted, err := cfg.db.UnlikeChirp(r.Context(), database.UnlikeChirpParams{
+		UserID:  caller.UserID,
+		ChirpID: chirp.ID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error unliking chirp")
+		return
+	}
+	if deleted == 0 {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerReactionCreate reacts to a chirp with one of the allowed emoji.
+// Reacting again with the same one does nothing.
+func (cfg *apiConfig) handlerReactionCreate(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+	id, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	type parameters struct {
+		Emoji string `json:"emoji"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	settings, err := cfg.db.GetReactionSettings(r.Context())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't load reaction settings")
+		return
+	}
+	if !slices.Contains(settings.AllowedEmoji, params.Emoji) {
+		respondWithError(w, http.StatusBadRequest, "Reaction not allowed")
+		return
+	}
+
+	chirp, err := cfg.resolveChirp(r.Context(), id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	added, err := cfg.db.AddChirpReaction(r.Context(), database.AddChirpReactionParams{
+		UserID:  caller.UserID,
+		ChirpID: chirp.ID,
+		Emoji:   params.Emoji,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error adding reaction")
+		return
+	}
+	if added == 0 {
+		respondWithError(w, http.StatusConflict, "Too many different reactions")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerReactionDelete(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+	id, err := uuid.Parse(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	chirp, err := cfg.resolveChirp(r.Context(), id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	// Reactions with emoji no longer allowed can still be taken back.
+	deleted, err := cfg.db.RemoveChirpReaction(r.Context(), database.RemoveChirpReactionParams{
+		UserID:  caller.UserID,
+		ChirpID: chirp.ID,
+		Emoji:   r.PathValue("emoji"),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error removing reaction")
+		return
+	}
+	if deleted == 0 {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerReactionSettingsGet(w http.ResponseWriter, r *http.Request) {
+	settings, err := cfg.db.GetReactionSettings(r.Context())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't load reaction settings")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, reactionSettingsFromDB(settings))
+}
+
+// handlerReactionSettingsUpdate replaces the allowed emoji and the limit on
+// different reactions per chirp. Reactions already left with emoji that are
+// dropped stay, and chirps over a lowered limit keep what they have.
+func (cfg *apiConfig) handlerReactionSettingsUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		AllowedEmoji         []string `json:"allowed_emoji"`
+		MaxDistinctReactions int32    `json:"max_distinct_reactions"`
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if len(params.AllowedEmoji) == 0 || len(params.AllowedEmoji) > maxAllowedEmoji {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Between 1 and %d emoji must be allowed", maxAllowedEmoji))
+		return
+	}
+	for i, emoji := range params.AllowedEmoji {
+		if emoji == "" || len(emoji) > maxEmojiLength || strings.ContainsFunc(emoji, unicode.IsSpace) {
+			respondWithError(w, http.StatusBadRequest, "Invalid emoji")
+			return
+		}
+		if slices.Contains(params.AllowedEmoji[:i], emoji) {
+			respondWithError(w, http.StatusBadRequest, "Duplicate emoji")
+			return
+		}
+	}
+	if params.MaxDistinctReactions < 1 {
+		respondWithError(w, http.StatusBadRequest, "max_distinct_reactions must be at least 1")
+		return
+	}
+
+	settings, err := cfg.db.UpdateReactionSettings(r.Context(), database.UpdateReactionSettingsParams{
+		AllowedEmoji:         params.AllowedEmoji,
+		MaxDistinctReactions: params.MaxDistinctReactions,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update reaction settings")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, reactionSettingsFromDB(settings))
+}
+
+func reactionSettingsFromDB(s database.ReactionSetting) ReactionSettings {
+	return ReactionSettings{
+		AllowedEmoji:         s.AllowedEmoji,
+		MaxDistinctReactions: s.MaxDistinctReactions,
+		UpdatedAt:            s.UpdatedAt,
+	}
+}
+
+// handlerUserLikesList pages through the chirps a user has liked. The
+// cursor and sort order go by when they were liked.
+func (cfg *apiConfig) handlerUserLikesList(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	page, err := parsePageQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, err := cfg.db.GetUserByID(r.Context(), userID); err != nil {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	cursorCreatedAt, cursorID := page.cursorParams()
+	var rows []database.ListUserLikesAfterRow
+	if page.ascending() {
+		rows, err = cfg.db.ListUserLikesAfter(r.Context(), database.ListUserLikesAfterParams{
+			UserID:          userID,
+			CursorCreatedAt: cursorCreatedAt,
+			CursorID:        cursorID,
+			RowLimit:        page.fetchLimit(),
+		})
+	} else {
+		var before []database.ListUserLikesBeforeRow
+		before, err = cfg.db.ListUserLikesBefore(r.Context(), database.ListUserLikesBeforeParams{
+			UserID:          userID,
+			CursorCreatedAt: cursorCreatedAt,
+			CursorID:        cursorID,
+			RowLimit:        page.fetchLimit(),
+		})
+		for _, row := range before {
+			rows = append(rows, database.ListUserLikesAfterRow(row))
+		}
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching likes")
+		return
+	}
+
+	rows, next, prev := buildPage(page, rows, func(row database.ListUserLikesAfterRow) pageCursor {
+		return pageCursor{CreatedAt: row.LikedAt, ID: row.ID}
+	})
+	chirps := []Chirp{}
+	for _, row := range rows {
+		chirps = append(chirps, chirpFromDB(database.Chirp{
+			ID:                row.ID,
+			CreatedAt:         row.CreatedAt,
+			UpdatedAt:         row.UpdatedAt,
+			Body:              row.Body,
+			UserID:            row.UserID,
+			EditedAt:          row.EditedAt,
+			ParentID:          row.ParentID,
+			ThreadID:          row.ThreadID,
+			Kind:              row.Kind,
+			ReferencedChirpID: row.ReferencedChirpID,
+		}))
+	}
+	if err := cfg.enrichChirps(r.Context(), cfg.viewer(r), chirps); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error fetching likes")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, chirpPage{
+		Chirps:     chirps,
+		NextCursor: next,
+		PrevCursor: prev,
+	})
+}
@@ -0,0 +1,38 @@
+-- name: CreateAuditEvent :exec
+INSERT INTO audit_events (id, created_at, event_type, user_id, actor_id, ip, user_agent, metadata)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    $6
+);
+
+-- name: ListAuditEventsAfter :many
+SELECT * FROM audit_events
+WHERE (sqlc.narg('user_id')::uuid IS NULL OR user_id = sqlc.narg('user_id'))
+AND (sqlc.narg('actor_id')::uuid IS NULL OR actor_id = sqlc.narg('actor_id'))
+AND (sqlc.narg('event_type')::text IS NULL OR event_type = sqlc.narg('event_type'))
+AND (sqlc.narg('ip')::text IS NULL OR ip = sqlc.narg('ip'))
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (created_at, id) > (sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY created_at ASC, id ASC
+LIMIT sqlc.arg('row_limit');
+
+-- name: ListAuditEventsBefore :many
+SELECT * FROM audit_events
+WHERE (sqlc.narg('user_id')::uuid IS NULL OR user_id = sqlc.narg('user_id'))
+AND (sqlc.narg('actor_id')::uuid IS NULL OR actor_id = sqlc.narg('actor_id'))
+AND (sqlc.narg('event_type')::text IS NULL OR event_type = sqlc.narg('event_type'))
+AND (sqlc.narg('ip')::text IS NULL OR ip = sqlc.narg('ip'))
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (created_at, id) < (sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg('row_limit');
@@ -1,22 +1,57 @@
 -- name: CreateChirp :one
-INSERT INTO chirps (id, created_at, updated_at, body, user_id)
-VALUES (
-    gen_random_uuid(),
+-- A reply joins its parent's thread; any other chirp starts its own.
+WITH new_chirp AS (
+    SELECT gen_random_uuid() AS id
+), tags AS (
+    INSERT INTO chirp_hashtags (chirp_id, tag, created_at)
+    SELECT new_chirp.id, tag, NOW()
+    FROM new_chirp, unnest(sqlc.arg('hashtags')::text[]) AS tag
+)
+INSERT INTO chirps (id, created_at, updated_at, body, user_id, parent_id, thread_id, kind, referenced_chirp_id)
+SELECT
+    new_chirp.id,
     NOW(),
     NOW(),
-    $1,
-    $2
+    sqlc.arg('body'),
+    sqlc.arg('user_id'),
+    sqlc.narg('parent_id'),
+    COALESCE((SELECT thread_id FROM chirps WHERE id = sqlc.narg('parent_id')), new_chirp.id),
+    sqlc.arg('kind'),
+    sqlc.narg('referenced_chirp_id')
+FROM new_chirp
+RETURNING *;
+
+-- name: CreateRechirp :one
+-- Returns no row if the user has already rechirped the chirp.
+WITH new_chirp AS (
+    SELECT gen_random_uuid() AS id
 )
+INSERT INTO chirps (id, created_at, updated_at, body, user_id, parent_id, thread_id, kind, referenced_chirp_id)
+SELECT new_chirp.id, NOW(), NOW(), '', $1, NULL, new_chirp.id, 'rechirp', $2
+FROM new_chirp
+ON CONFLICT (user_id, referenced_chirp_id) WHERE kind = 'rechirp' DO NOTHING
 RETURNING *;
 
--- name: GetChirps :many
+-- name: GetRechirp :one
 SELECT * FROM chirps
-ORDER BY created_at ASC;
+WHERE user_id = $1
+AND referenced_chirp_id = $2
+AND kind = 'rechirp';
 
--- name: GetChirpsByAuthorID :many
-SELECT * FROM chirps
+-- name: DeleteRechirp :execrows
+DELETE FROM chirps
 WHERE user_id = $1
-ORDER BY created_at ASC;
+AND referenced_chirp_id = $2
+AND kind = 'rechirp';
+
+-- name: GetChirpsByIDs :many
+SELECT * FROM chirps
+WHERE id = ANY(sqlc.arg('chirp_ids')::uuid[]);
+
+-- name: CountChirpReferences :many
+SELECT referenced_chirp_id, kind, COUNT(*) AS reference_count FROM chirps
+WHERE referenced_chirp_id = ANY(sqlc.arg('chirp_ids')::uuid[])
+GROUP BY referenced_chirp_id, kind;
 
 -- name: GetChirp :one
 
@@ -24,4 +59,89 @@ SELECT * FROM chirps
 WHERE id = $1;
 
 -- name: DeleteChirp :exec
-DELETE FROM chirps WHERE id = $1 AND user_id = $2;
+-- Rechirps go with the chirp they point at.
+WITH rechirps AS (
+    DELETE FROM chirps r
+    WHERE r.referenced_chirp_id = $1
+    AND r.kind = 'rechirp'
+    AND EXISTS (SELECT 1 FROM chirps c WHERE c.id = $1 AND c.user_id = $2)
+)
+DELETE FROM chirps WHERE chirps.id = $1 AND chirps.user_id = $2;
+
+-- name: ListChirpsAfter :many
+SELECT * FROM chirps
+WHERE (sqlc.narg('author_id')::uuid IS NULL OR user_id = sqlc.narg('author_id'))
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (created_at, id) > (sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY created_at ASC, id ASC
+LIMIT sqlc.arg('row_limit');
+
+-- name: ListChirpsBefore :many
+SELECT * FROM chirps
+WHERE (sqlc.narg('author_id')::uuid IS NULL OR user_id = sqlc.narg('author_id'))
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (created_at, id) < (sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg('row_limit');
+
+-- name: EditChirp :one
+-- The row lock makes concurrent edits take turns, so each one saves the
+-- body it actually replaced. Hashtags are swapped for the new body's, but
+-- keep the chirp's created_at so editing doesn't bump them up trending.
+WITH current AS (
+    SELECT chirps.id, chirps.body, chirps.created_at, chirps.updated_at FROM chirps
+    WHERE chirps.id = sqlc.arg('id')
+    FOR UPDATE
+), revision AS (
+    INSERT INTO chirp_revisions (id, chirp_id, body, created_at, replaced_at)
+    SELECT gen_random_uuid(), id, body, updated_at, NOW() FROM current
+), old_tags AS (
+    DELETE FROM chirp_hashtags
+    WHERE chirp_id = (SELECT id FROM current)
+    AND tag <> ALL(sqlc.arg('hashtags')::text[])
+), new_tags AS (
+    INSERT INTO chirp_hashtags (chirp_id, tag, created_at)
+    SELECT current.id, tag, current.created_at
+    FROM current, unnest(sqlc.arg('hashtags')::text[]) AS tag
+    ON CONFLICT (chirp_id, tag) DO NOTHING
+)
+UPDATE chirps
+SET body = sqlc.arg('body'),
+    updated_at = NOW(),
+    edited_at = NOW()
+FROM current
+WHERE chirps.id = current.id
+RETURNING chirps.*;
+
+-- name: ListChirpRevisions :many
+SELECT * FROM chirp_revisions
+WHERE chirp_id = $1
+ORDER BY created_at ASC;
+
+-- name: GetChirpThread :many
+-- Walks the thread holding chirp_id down from its top-level chirps: the one
+-- that started it, and any whose parent has since been deleted. Sorting by
+-- path lists each chirp's replies, oldest first, straight after it.
+WITH RECURSIVE thread AS (
+    SELECT c.*, 0 AS depth, ARRAY[to_char(c.created_at, 'YYYYMMDDHH24MISSUS') || c.id::text] AS path
+    FROM chirps c
+    WHERE c.thread_id = (SELECT t.thread_id FROM chirps t WHERE t.id = sqlc.arg('chirp_id'))
+    AND c.parent_id IS NULL
+    UNION ALL
+    SELECT c.*, thread.depth + 1, thread.path || (to_char(c.created_at, 'YYYYMMDDHH24MISSUS') || c.id::text)
+    FROM chirps c
+    JOIN thread ON c.parent_id = thread.id
+    WHERE thread.depth < sqlc.arg('max_depth')::int
+)
+SELECT id, created_at, updated_at, body, user_id, edited_at, parent_id, thread_id, kind, referenced_chirp_id, depth FROM thread
+ORDER BY path
+LIMIT sqlc.arg('row_limit');
+
+-- name: CountChirpReplies :many
+SELECT parent_id, COUNT(*) AS reply_count FROM chirps
+WHERE parent_id = ANY(sqlc.arg('chirp_ids')::uuid[])
+GROUP BY parent_id;
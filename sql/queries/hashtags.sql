@@ -0,0 +1,42 @@
+-- name: ListHashtagChirpsAfter :many
+SELECT chirps.* FROM chirp_hashtags
+JOIN chirps ON chirps.id = chirp_hashtags.chirp_id
+WHERE chirp_hashtags.tag = sqlc.arg('tag')
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (chirp_hashtags.created_at, chirp_hashtags.chirp_id) > (sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY chirp_hashtags.created_at ASC, chirp_hashtags.chirp_id ASC
+LIMIT sqlc.arg('row_limit');
+
+-- name: ListHashtagChirpsBefore :many
+SELECT chirps.* FROM chirp_hashtags
+JOIN chirps ON chirps.id = chirp_hashtags.chirp_id
+WHERE chirp_hashtags.tag = sqlc.arg('tag')
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (chirp_hashtags.created_at, chirp_hashtags.chirp_id) < (sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY chirp_hashtags.created_at DESC, chirp_hashtags.chirp_id DESC
+LIMIT sqlc.arg('row_limit');
+
+-- name: ListTrendingHashtags :many
+-- Each chirp in the window adds to its tags' scores, halving in weight every
+-- half_life_seconds, so a burst of recent use beats a steady trickle.
+SELECT
+    tag,
+    COUNT(*) AS chirp_count,
+    SUM(POWER(0.5, EXTRACT(EPOCH FROM NOW() - created_at) / sqlc.arg('half_life_seconds')::float8))::float8 AS score
+FROM chirp_hashtags
+WHERE created_at > NOW() - make_interval(secs => sqlc.arg('window_seconds')::float8)
+GROUP BY tag
+ORDER BY score DESC, tag ASC
+LIMIT sqlc.arg('row_limit');
+
+-- name: AddChirpHashtags :exec
+-- Tags an existing chirp. Tags it already has are left alone.
+INSERT INTO chirp_hashtags (chirp_id, tag, created_at)
+SELECT chirps.id, tag, chirps.created_at
+FROM chirps, unnest(sqlc.arg('hashtags')::text[]) AS tag
+WHERE chirps.id = sqlc.arg('chirp_id')
+ON CONFLICT (chirp_id, tag) DO NOTHING;
@@ -0,0 +1,22 @@
+-- name: GetLoginThrottles :many
+SELECT * FROM login_throttles
+WHERE throttle_key = ANY(sqlc.arg('throttle_keys')::text[]);
+
+-- name: RecordLoginFailure :one
+INSERT INTO login_throttles (throttle_key, failures, last_failure_at)
+VALUES (sqlc.arg('throttle_key'), 1, NOW())
+ON CONFLICT (throttle_key) DO UPDATE
+SET failures = CASE
+        WHEN login_throttles.last_failure_at < sqlc.arg('window_start') THEN 1
+        ELSE login_throttles.failures + 1
+    END,
+    last_failure_at = NOW()
+RETURNING *;
+
+-- name: ClearLoginThrottle :exec
+DELETE FROM login_throttles WHERE throttle_key = $1;
+
+-- name: ListLoginThrottles :many
+SELECT * FROM login_throttles
+WHERE last_failure_at > $1
+ORDER BY last_failure_at DESC;
@@ -0,0 +1,41 @@
+-- name: GetReactionSettings :one
+SELECT * FROM reaction_settings;
+
+-- name: UpdateReactionSettings :one
+UPDATE reaction_settings
+SET allowed_emoji = $1,
+    max_distinct_reactions = $2,
+    updated_at = NOW()
+RETURNING *;
+
+-- name: AddChirpReaction :execrows
+-- Adds nothing if the chirp already has the allowed number of different
+-- emoji and this isn't one of them; the chirp_reactions_limit trigger
+-- enforces that.
+INSERT INTO chirp_reactions (user_id, chirp_id, emoji, created_at)
+VALUES (
+    $1,
+    $2,
+    $3,
+    NOW()
+)
+ON CONFLICT (chirp_id, emoji, user_id) DO UPDATE
+SET created_at = chirp_reactions.created_at;
+
+-- name: RemoveChirpReaction :execrows
+DELETE FROM chirp_reactions
+WHERE user_id = $1
+AND chirp_id = $2
+AND emoji = $3;
+
+-- name: CountChirpReactions :many
+SELECT chirp_id, emoji, COUNT(*) AS reaction_count FROM chirp_reactions
+WHERE chirp_id = ANY(sqlc.arg('chirp_ids')::uuid[])
+GROUP BY chirp_id, emoji;
+
+-- name: ListUserChirpReactions :many
+-- The reactions the user has left on chirp_ids.
+SELECT chirp_id, emoji FROM chirp_reactions
+WHERE user_id = sqlc.arg('user_id')
+AND chirp_id = ANY(sqlc.arg('chirp_ids')::uuid[])
+ORDER BY chirp_id, created_at;
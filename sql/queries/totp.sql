@@ -0,0 +1,47 @@
+-- name: SetTOTPSecret :execrows
+UPDATE users
+SET totp_secret = $2,
+    totp_last_step = NULL,
+    updated_at = NOW()
+WHERE id = $1
+AND totp_enabled = FALSE;
+
+-- name: EnableTOTP :exec
+UPDATE users
+SET totp_enabled = TRUE,
+    updated_at = NOW()
+WHERE id = $1;
+
+-- name: DisableTOTP :exec
+UPDATE users
+SET totp_secret = NULL,
+    totp_enabled = FALSE,
+    totp_last_step = NULL,
+    updated_at = NOW()
+WHERE id = $1;
+
+-- name: UseTOTPStep :execrows
+UPDATE users
+SET totp_last_step = $2
+WHERE id = $1
+AND (totp_last_step IS NULL OR totp_last_step < $2);
+
+-- name: CreateRecoveryCode :exec
+INSERT INTO totp_recovery_codes (id, created_at, user_id, code_hash, used_at)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    $1,
+    $2,
+    NULL
+);
+
+-- name: DeleteRecoveryCodes :exec
+DELETE FROM totp_recovery_codes WHERE user_id = $1;
+
+-- name: UseRecoveryCode :execrows
+UPDATE totp_recovery_codes
+SET used_at = NOW()
+WHERE user_id = $1
+AND code_hash = $2
+AND used_at IS NULL;
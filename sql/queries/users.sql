@@ -16,28 +16,44 @@ RETURNING *;
 SELECT * FROM users WHERE email = $1;
 
 -- name: CreateRefreshToken :one
-INSERT INTO refresh_tokens (token, created_at, updated_at, user_id, expires_at, revoked_at)
+INSERT INTO refresh_tokens (token_hash, created_at, updated_at, user_id, expires_at, revoked_at, family_id, created_ip, user_agent, last_used_at, client_id, scopes)
 VALUES (
     $1,
     NOW(),
     NOW(),
     $2,
     $3,
-    NULL
+    NULL,
+    $4,
+    $5,
+    $6,
+    NOW(),
+    $7,
+    $8
 )
 RETURNING *;
 
--- name: GetUserFromRefreshToken :one
-SELECT users.* FROM users
-JOIN refresh_tokens ON users.id = refresh_tokens.user_id
-WHERE refresh_tokens.token = $1
-AND refresh_tokens.expires_at > NOW()
-AND refresh_tokens.revoked_at IS NULL;
+-- name: GetRefreshToken :one
+SELECT * FROM refresh_tokens WHERE token_hash = $1;
+
+-- name: RotateRefreshToken :one
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW(), last_used_at = NOW()
+WHERE token_hash = $1
+AND revoked_at IS NULL
+AND expires_at > NOW()
+RETURNING *;
+
+-- name: RevokeRefreshTokenFamily :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE family_id = $1
+AND revoked_at IS NULL;
 
 -- name: RevokeRefreshToken :one
 UPDATE refresh_tokens
 SET revoked_at = NOW(), updated_at = NOW()
-WHERE token = $1
+WHERE token_hash = $1
 RETURNING *;
 
 -- name: UpdateUser :one
@@ -48,9 +64,67 @@ SET email = $2,
 WHERE id = $1
 RETURNING *;
 
+-- name: UpdateUserPassword :exec
+UPDATE users
+SET hashed_password = $2,
+    updated_at = NOW()
+WHERE id = $1;
+
+-- name: UpdateUserRole :one
+UPDATE users
+SET role = $2,
+    updated_at = NOW()
+WHERE id = $1
+RETURNING *;
+
 -- name: UpgradeToChirpyRed :one
 UPDATE users
 SET is_chirpy_red = true,
     updated_at = NOW()
 WHERE id = $1
 RETURNING *;
+
+-- name: InvalidateUserTokens :exec
+UPDATE users
+SET tokens_valid_after = $2
+WHERE id = $1;
+
+-- name: ListTokenCutoffs :many
+SELECT id, tokens_valid_after FROM users
+WHERE tokens_valid_after > $1;
+
+-- name: ListUserSessions :many
+SELECT
+    family_id,
+    created_ip,
+    user_agent,
+    last_used_at,
+    expires_at,
+    (SELECT MIN(f.created_at) FROM refresh_tokens f WHERE f.family_id = refresh_tokens.family_id)::timestamp AS started_at
+FROM refresh_tokens
+WHERE refresh_tokens.user_id = $1
+AND refresh_tokens.revoked_at IS NULL
+AND refresh_tokens.expires_at > NOW()
+ORDER BY refresh_tokens.last_used_at DESC;
+
+-- name: RevokeUserSession :execrows
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE family_id = $1
+AND user_id = $2
+AND revoked_at IS NULL;
+
+-- name: RevokeUserSessions :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE user_id = $1
+AND revoked_at IS NULL;
+
+-- name: VerifyUserEmail :one
+UPDATE users
+SET email = sqlc.arg('email'),
+    email_verified = TRUE,
+    updated_at = NOW()
+WHERE id = sqlc.arg('id')
+AND (tokens_valid_after IS NULL OR tokens_valid_after <= sqlc.arg('requested_at')::timestamp)
+RETURNING *;
@@ -0,0 +1,9 @@
+-- +goose Up
+-- Rehash the existing plaintext tokens in place so current sessions survive.
+UPDATE refresh_tokens SET token = encode(sha256(convert_to(token, 'UTF8')), 'hex');
+ALTER TABLE refresh_tokens RENAME COLUMN token TO token_hash;
+
+-- +goose Down
+-- A digest can't be turned back into its token, so every session is dropped.
+DELETE FROM refresh_tokens;
+ALTER TABLE refresh_tokens RENAME COLUMN token_hash TO token;
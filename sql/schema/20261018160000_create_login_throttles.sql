@@ -0,0 +1,11 @@
+-- +goose Up
+-- One row per email address or client IP with recent failed logins. Keys
+-- look like "email:someone@example.com" or "ip:203.0.113.7".
+CREATE TABLE login_throttles (
+    throttle_key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_failure_at TIMESTAMP NOT NULL
+);
+
+-- +goose Down
+DROP TABLE login_throttles;
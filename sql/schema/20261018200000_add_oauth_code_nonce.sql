@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE oauth_authorization_codes ADD COLUMN nonce TEXT NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE oauth_authorization_codes DROP COLUMN nonce;
@@ -0,0 +1,6 @@
+-- +goose Up
+-- Service clients created by admins may ask whether tokens are active.
+ALTER TABLE oauth_clients ADD COLUMN can_introspect BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +goose Down
+ALTER TABLE oauth_clients DROP COLUMN can_introspect;
@@ -0,0 +1,18 @@
+-- +goose Up
+-- A log of who did what: user_id is who an event concerns and actor_id who
+-- caused it, and either may be unknown. Impersonation is the first thing
+-- recorded here, as impersonation.started when an admin starts and
+-- impersonation.write for every write made with the token. Neither id
+-- references users, so history outlives the account.
+CREATE TABLE audit_events (
+    id UUID PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    event_type TEXT NOT NULL,
+    user_id UUID,
+    actor_id UUID,
+    metadata JSONB NOT NULL DEFAULT '{}'
+);
+CREATE INDEX audit_events_user_id_idx ON audit_events (user_id, created_at, id);
+
+-- +goose Down
+DROP TABLE audit_events;
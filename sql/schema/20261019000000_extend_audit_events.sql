@@ -0,0 +1,30 @@
+-- +goose Up
+-- Authentication events join the log, with where the request came from.
+-- Once written, an event can't be changed or removed.
+ALTER TABLE audit_events ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE audit_events ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+CREATE INDEX audit_events_created_at_idx ON audit_events (created_at, id);
+
+-- +goose StatementBegin
+CREATE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER audit_events_no_modify
+BEFORE UPDATE OR DELETE ON audit_events
+FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+
+CREATE TRIGGER audit_events_no_truncate
+BEFORE TRUNCATE ON audit_events
+FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
+
+-- +goose Down
+DROP TRIGGER audit_events_no_truncate ON audit_events;
+DROP TRIGGER audit_events_no_modify ON audit_events;
+DROP FUNCTION audit_events_append_only();
+DROP INDEX audit_events_created_at_idx;
+ALTER TABLE audit_events DROP COLUMN user_agent;
+ALTER TABLE audit_events DROP COLUMN ip;
@@ -0,0 +1,13 @@
+-- +goose Up
+-- thread_id is the ID of the chirp that started the conversation. It isn't a
+-- foreign key: the thread keeps its ID after that chirp is deleted.
+ALTER TABLE chirps ADD COLUMN parent_id UUID REFERENCES chirps(id) ON DELETE SET NULL;
+ALTER TABLE chirps ADD COLUMN thread_id UUID;
+UPDATE chirps SET thread_id = id;
+ALTER TABLE chirps ALTER COLUMN thread_id SET NOT NULL;
+CREATE INDEX chirps_parent_id_idx ON chirps (parent_id);
+CREATE INDEX chirps_thread_id_idx ON chirps (thread_id);
+
+-- +goose Down
+ALTER TABLE chirps DROP COLUMN thread_id;
+ALTER TABLE chirps DROP COLUMN parent_id;
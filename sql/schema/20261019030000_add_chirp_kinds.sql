@@ -0,0 +1,17 @@
+-- +goose Up
+-- A rechirp has no body of its own; a quote adds one. Deleting a chirp
+-- deletes its rechirps along with it (see DeleteChirp), while quotes are
+-- kept with the reference cleared. The check stops a rechirp from ever
+-- being left pointing at nothing.
+ALTER TABLE chirps ADD COLUMN kind TEXT NOT NULL DEFAULT 'post'
+    CHECK (kind IN ('post', 'rechirp', 'quote'));
+ALTER TABLE chirps ADD COLUMN referenced_chirp_id UUID REFERENCES chirps(id) ON DELETE SET NULL;
+ALTER TABLE chirps ADD CONSTRAINT chirps_rechirp_reference_check
+    CHECK (kind <> 'rechirp' OR referenced_chirp_id IS NOT NULL);
+CREATE UNIQUE INDEX chirps_rechirp_unique_idx ON chirps (user_id, referenced_chirp_id) WHERE kind = 'rechirp';
+CREATE INDEX chirps_referenced_chirp_id_idx ON chirps (referenced_chirp_id);
+
+-- +goose Down
+ALTER TABLE chirps DROP CONSTRAINT chirps_rechirp_reference_check;
+ALTER TABLE chirps DROP COLUMN referenced_chirp_id;
+ALTER TABLE chirps DROP COLUMN kind;
@@ -0,0 +1,50 @@
+-- +goose Up
+-- reaction_settings holds a single row, so admins can change it at runtime.
+CREATE TABLE reaction_settings (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    allowed_emoji TEXT[] NOT NULL,
+    max_distinct_reactions INTEGER NOT NULL CHECK (max_distinct_reactions > 0),
+    updated_at TIMESTAMP NOT NULL
+);
+INSERT INTO reaction_settings (allowed_emoji, max_distinct_reactions, updated_at)
+VALUES (ARRAY['👍', '❤️', '😂', '🎉', '😮', '😢'], 6, NOW());
+
+CREATE TABLE chirp_reactions (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    chirp_id UUID NOT NULL REFERENCES chirps(id) ON DELETE CASCADE,
+    emoji TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (chirp_id, emoji, user_id)
+);
+CREATE INDEX chirp_reactions_user_id_idx ON chirp_reactions (user_id);
+
+-- A reaction with an emoji the chirp doesn't have yet is dropped once the
+-- chirp has max_distinct_reactions different ones. Locking the chirp makes
+-- reactions to it take turns, so two new emoji can't both squeeze in.
+-- +goose StatementBegin
+CREATE FUNCTION chirp_reactions_limit() RETURNS trigger AS $$
+BEGIN
+    PERFORM 1 FROM chirps WHERE id = NEW.chirp_id FOR NO KEY UPDATE;
+    IF NOT EXISTS (
+        SELECT 1 FROM chirp_reactions
+        WHERE chirp_id = NEW.chirp_id
+        AND emoji = NEW.emoji
+    ) AND (
+        SELECT COUNT(DISTINCT emoji) FROM chirp_reactions
+        WHERE chirp_id = NEW.chirp_id
+    ) >= (SELECT max_distinct_reactions FROM reaction_settings) THEN
+        RETURN NULL;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER chirp_reactions_limit
+BEFORE INSERT ON chirp_reactions
+FOR EACH ROW EXECUTE FUNCTION chirp_reactions_limit();
+
+-- +goose Down
+DROP TABLE chirp_reactions;
+DROP FUNCTION chirp_reactions_limit();
+DROP TABLE reaction_settings;
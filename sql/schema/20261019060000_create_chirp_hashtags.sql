@@ -0,0 +1,18 @@
+-- +goose Up
+-- created_at is the chirp's, so tag pages and trending don't need to join
+-- chirps to order or window by it.
+CREATE TABLE chirp_hashtags (
+    chirp_id UUID NOT NULL REFERENCES chirps(id) ON DELETE CASCADE,
+    tag TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (chirp_id, tag)
+);
+CREATE INDEX chirp_hashtags_tag_created_at_idx ON chirp_hashtags (tag, created_at, chirp_id);
+CREATE INDEX chirp_hashtags_created_at_idx ON chirp_hashtags (created_at);
+
+-- Chirps posted before this are tagged by running chirpy backfill-hashtags.
+-- It uses hashtags.Extract itself: what Postgres counts as a letter depends
+-- on the database's locale, so a regex here could tag them differently.
+
+-- +goose Down
+DROP TABLE chirp_hashtags;